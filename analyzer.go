@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// GridAnalyzer extracts a crossword grid from a photo. kind is the kind of
+// grid expected on the photo, KindArrow or KindClassic.
+// GeminiClient is the production implementation; FixtureAnalyzer
+// replays a recorded grid for tests and offline demos.
+type GridAnalyzer interface {
+	AnalyzeImage(ctx context.Context, imageData []byte, mimeType, kind string) (*Grid, error)
+}
+
+// Photo is an uploaded image given to an analyzer.
+type Photo struct {
+	Data     []byte
+	MIMEType string
+}
+
+// MultiImageAnalyzer is implemented by analyzers that can read a grid
+// photographed in several parts (top and bottom halves, or the grid and a
+// separate clue page) at once, seeing all the photos together. It returns
+// the grid read on each photo, in order, for mergeGrids to assemble; a
+// photo without cells gives a grid with no rows. Other analyzers read the
+// photos one by one.
+type MultiImageAnalyzer interface {
+	AnalyzeImages(ctx context.Context, photos []Photo, kind string) ([]*Grid, error)
+}
+
+// SolutionAnalyzer is implemented by analyzers that can also read the
+// published answers page of a grid. It returns one string per row with the
+// expected letters, in the format accepted by Grid.SetSolution.
+type SolutionAnalyzer interface {
+	AnalyzeSolution(ctx context.Context, imageData []byte, mimeType string, grid *Grid) ([]string, error)
+}
+
+// AnalyzerInfo describes the analyzer a server runs, so that the grids it
+// extracts can be compared with those of other analyzers, models or
+// prompts (see cmd/evaluate).
+type AnalyzerInfo struct {
+	Name          string `json:"name"`                     // gemini, local or fixture
+	Model         string `json:"model,omitempty"`          // model asked first
+	FallbackModel string `json:"fallback_model,omitempty"` // model asked when the first keeps failing
+	Prompt        string `json:"prompt,omitempty"`         // changes with the prompts and response schemas
+}
+
+// DescribedAnalyzer is implemented by analyzers that can describe
+// themselves.
+type DescribedAnalyzer interface {
+	Describe() AnalyzerInfo
+}
+
+// FixtureAnalyzer returns the same grid for every image, read from a JSON file.
+type FixtureAnalyzer struct {
+	data []byte
+}
+
+// NewFixtureAnalyzer loads the grid fixture at path and checks it decodes.
+func NewFixtureAnalyzer(path string) (*FixtureAnalyzer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+	var grid Grid
+	if err := json.Unmarshal(data, &grid); err != nil {
+		return nil, fmt.Errorf("parse fixture %s: %w", path, err)
+	}
+	return &FixtureAnalyzer{data: data}, nil
+}
+
+// AnalyzeImage ignores the image and the kind, and returns a fresh copy of
+// the fixture grid. Like a photo of an unsolved grid, the copy carries no
+// solution.
+func (f *FixtureAnalyzer) AnalyzeImage(ctx context.Context, _ []byte, _, _ string) (*Grid, error) {
+	grid, err := f.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range grid.Cells {
+		for j := range grid.Cells[i] {
+			grid.Cells[i][j].Solution = ""
+		}
+	}
+	grid.HasSolution = false
+	return grid, nil
+}
+
+// AnalyzeSolution ignores the image and returns the solution recorded in the
+// fixture, if any.
+func (f *FixtureAnalyzer) AnalyzeSolution(ctx context.Context, _ []byte, _ string, grid *Grid) ([]string, error) {
+	fixture, err := f.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if fixture.Rows != grid.Rows || fixture.Cols != grid.Cols {
+		return nil, fmt.Errorf("fixture is %dx%d, grid is %dx%d", fixture.Rows, fixture.Cols, grid.Rows, grid.Cols)
+	}
+	rows := fixture.SolutionRows()
+	for _, row := range rows {
+		if strings.Contains(row, ".") {
+			return nil, fmt.Errorf("fixture has no complete solution")
+		}
+	}
+	return rows, nil
+}
+
+// Describe names the fixture analyzer.
+func (f *FixtureAnalyzer) Describe() AnalyzerInfo {
+	return AnalyzerInfo{Name: "fixture"}
+}
+
+func (f *FixtureAnalyzer) load(ctx context.Context) (*Grid, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var grid Grid
+	if err := json.Unmarshal(f.data, &grid); err != nil {
+		return nil, fmt.Errorf("parse fixture: %w", err)
+	}
+	return &grid, nil
+}
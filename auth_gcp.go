@@ -8,14 +8,20 @@ import (
 )
 
 const (
-	defaultRegion = "europe-west1"
-	defaultModel  = "gemini-2.5-flash"
+	defaultRegion        = "europe-west1"
+	defaultModel         = "gemini-2.5-flash"
+	defaultFallbackModel = "gemini-2.5-pro"
 )
 
 // GeminiClient wraps the Google GenAI client for VertexAI.
 type GeminiClient struct {
-	client    *genai.Client
-	modelName string
+	client        *genai.Client
+	modelName     string
+	fallbackModel string // tried when modelName keeps failing, "" for none
+	retry         RetryPolicy
+
+	// generate is client.Models.GenerateContent, replaced in tests.
+	generate func(ctx context.Context, model string, contents []*genai.Content, config *genai.GenerateContentConfig) (*genai.GenerateContentResponse, error)
 }
 
 // NewGeminiClient creates a client using Application Default Credentials.
@@ -35,8 +41,11 @@ func NewGeminiClient(ctx context.Context, projectID, region string) (*GeminiClie
 	}
 
 	return &GeminiClient{
-		client:    client,
-		modelName: defaultModel,
+		client:        client,
+		modelName:     defaultModel,
+		fallbackModel: defaultFallbackModel,
+		retry:         defaultRetryPolicy,
+		generate:      client.Models.GenerateContent,
 	}, nil
 }
 
@@ -0,0 +1,463 @@
+// Command evaluate measures how well grids are read from photos, to compare
+// analyzers, models and prompts objectively.
+//
+// A fixtures directory holds photos of grids, each next to the expected
+// grid in a JSON file of the same name (grille.jpg and grille.json), in the
+// format of GET /api/grids/{id}: a grid extracted then corrected by hand can
+// be saved as is. Other photos of the same grid share its expected grid
+// through their name (grille_penchee.jpg). Every photo is uploaded to a
+// running server, and the grid it reads is recorded under recordings/<label>/
+// in the fixtures directory, label naming the analyzer, model and prompt of
+// the server (GET /api/analyzer). The recordings of every label are then scored against
+// the expected grids: cell types, arrows, and similarity of the definition
+// texts.
+//
+// With -replay, nothing is uploaded: the recordings are scored again,
+// without server or network.
+//
+//	go run ./cmd/evaluate -server http://localhost:8080
+//	go run ./cmd/evaluate -replay
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	recordingsDir   = "recordings"
+	analyzerFile    = "analyzer.json"
+	analysisTimeout = 6 * time.Minute // per photo, a bit more than the server's
+	pollInterval    = 500 * time.Millisecond
+	rateLimitWait   = 15 * time.Second // before uploading again when the server refuses
+)
+
+// imageExtensions are those of the photos of the fixtures.
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".heic", ".heif", ".pdf"}
+
+func main() {
+	fixturesDir := flag.String("fixtures", "test_data/evaluation", "directory of the photos and expected grids")
+	server := flag.String("server", "http://localhost:8080", "server analyzing the photos")
+	replay := flag.Bool("replay", false, "score the recorded grids again, without uploading")
+	label := flag.String("label", "", "name of the recordings (default: from the server's analyzer); with -replay, score only these")
+	preprocess := flag.String("preprocess", "", "preparation steps of the photos, as the preprocess field of an upload")
+	verbose := flag.Bool("v", false, "show the score of each photo")
+	flag.Parse()
+	log.SetFlags(0)
+
+	fixtures, err := loadFixtures(*fixturesDir)
+	if err != nil {
+		log.Fatalf("Impossible de lire les fixtures : %v", err)
+	}
+	if len(fixtures) == 0 {
+		log.Fatalf("Aucune fixture dans %s (photo et grille attendue .json de même nom)", *fixturesDir)
+	}
+	recordings := filepath.Join(*fixturesDir, recordingsDir)
+
+	if !*replay {
+		c := &client{base: strings.TrimSuffix(*server, "/"), http: http.DefaultClient, poll: pollInterval, wait: rateLimitWait}
+		if _, err := c.record(context.Background(), fixtures, recordings, *label, *preprocess); err != nil {
+			log.Fatalf("Évaluation interrompue : %v", err)
+		}
+	}
+
+	// The new recordings are compared with all the earlier ones.
+	only := ""
+	if *replay {
+		only = *label
+	}
+	results, err := scoreRecordings(fixtures, recordings, only)
+	if err != nil {
+		log.Fatalf("Impossible de lire les enregistrements : %v", err)
+	}
+	if len(results) == 0 {
+		log.Fatalf("Aucun enregistrement dans %s", recordings)
+	}
+	report(os.Stdout, results, *verbose)
+}
+
+// fixture is a photo of a grid and the grid expected to be read on it.
+type fixture struct {
+	name     string // file name without extension
+	image    string // path of the photo
+	expected *grid
+}
+
+// loadFixtures returns the fixtures of a directory, sorted by name.
+func loadFixtures(dir string) ([]fixture, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []fixture
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || !slices.Contains(imageExtensions, ext) {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		var expected grid
+		if err := readJSON(expectedFile(dir, name), &expected); err != nil {
+			return nil, fmt.Errorf("expected grid of %s: %w", e.Name(), err)
+		}
+		fixtures = append(fixtures, fixture{name: name, image: filepath.Join(dir, e.Name()), expected: &expected})
+	}
+	return fixtures, nil
+}
+
+// expectedFile returns the path of the expected grid of the photo name:
+// name.json, or for another photo of the same grid (grille_penchee.jpg),
+// the expected grid it is named after (grille.json).
+func expectedFile(dir, name string) string {
+	for base := name; ; {
+		path := filepath.Join(dir, base+".json")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		i := strings.LastIndex(base, "_")
+		if i < 0 {
+			return filepath.Join(dir, name+".json")
+		}
+		base = base[:i]
+	}
+}
+
+// analyzerInfo is the answer of GET /api/analyzer.
+type analyzerInfo struct {
+	Name          string `json:"name"`
+	Model         string `json:"model,omitempty"`
+	FallbackModel string `json:"fallback_model,omitempty"`
+	Prompt        string `json:"prompt,omitempty"`
+	Preprocess    string `json:"preprocess,omitempty"` // set by evaluate, not the server
+}
+
+// label names the recordings of an analyzer: its name, model and prompt
+// version, and the preparation of the photos if not the default one.
+func (a analyzerInfo) label() string {
+	parts := []string{cmp.Or(a.Name, "inconnu")}
+	for _, p := range []string{a.Model, a.Prompt} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if a.Preprocess != "" {
+		parts = append(parts, "preprocess="+strings.ReplaceAll(a.Preprocess, ",", "+"))
+	}
+	return strings.Join(parts, "_")
+}
+
+// recording is what the server answered for a fixture.
+type recording struct {
+	Grid  json.RawMessage `json:"grid,omitempty"`
+	Error string          `json:"error,omitempty"` // the analysis failed
+}
+
+// client uploads the fixtures to a server.
+type client struct {
+	base string
+	http *http.Client
+	poll time.Duration // between two reads of the state of a job
+	wait time.Duration // before uploading again after a 429
+}
+
+// record analyzes every fixture on the server and saves the answers under
+// the label, returned.
+func (c *client) record(ctx context.Context, fixtures []fixture, dir, label, preprocess string) (string, error) {
+	var info analyzerInfo
+	if err := c.getJSON(ctx, "/api/analyzer", &info); err != nil {
+		return "", fmt.Errorf("analyzer: %w", err)
+	}
+	info.Preprocess = preprocess
+	if label == "" {
+		label = info.label()
+	}
+	dir = filepath.Join(dir, label)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if err := writeJSON(filepath.Join(dir, analyzerFile), info); err != nil {
+		return "", err
+	}
+
+	log.Printf("Analyse de %d photo(s) par %s", len(fixtures), label)
+	for _, f := range fixtures {
+		rec, err := c.analyze(ctx, f, preprocess)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", f.name, err)
+		}
+		if rec.Error != "" {
+			log.Printf("  %s : échec (%s)", f.name, rec.Error)
+		} else {
+			log.Printf("  %s : lue", f.name)
+		}
+		if err := writeJSON(filepath.Join(dir, f.name+".json"), rec); err != nil {
+			return "", err
+		}
+	}
+	return label, nil
+}
+
+// job is the part of an analysis job the client follows.
+type job struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`
+	GridID string `json:"grid_id"`
+	Cached bool   `json:"cached"`
+	Error  string `json:"error"`
+}
+
+// analyze uploads the photo of a fixture and waits for its grid. A failed
+// analysis is recorded; only errors talking to the server are returned.
+func (c *client) analyze(ctx context.Context, f fixture, preprocess string) (recording, error) {
+	ctx, cancel := context.WithTimeout(ctx, analysisTimeout)
+	defer cancel()
+
+	data, err := os.ReadFile(f.image)
+	if err != nil {
+		return recording{}, err
+	}
+	var j job
+	for {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("image", filepath.Base(f.image))
+		part.Write(data)
+		mw.WriteField("kind", cmp.Or(f.expected.Kind, "arrow"))
+		if preprocess != "" {
+			mw.WriteField("preprocess", preprocess)
+		}
+		mw.Close()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/api/grids", &body)
+		if err != nil {
+			return recording{}, err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		err = c.do(req, &j)
+		var status *statusError
+		if errors.As(err, &status) && status.code == http.StatusTooManyRequests {
+			log.Printf("  trop d'envois, nouvel essai dans %s", c.wait)
+			if err := sleep(ctx, c.wait); err != nil {
+				return recording{}, err
+			}
+			continue
+		}
+		if errors.As(err, &status) && status.code < http.StatusInternalServerError {
+			// The server refused the photo itself: unreadable, wrong format...
+			return recording{Error: status.message}, nil
+		}
+		if err != nil {
+			return recording{}, err
+		}
+		break
+	}
+	if j.Cached {
+		log.Printf("  %s : déjà analysée par ce serveur, grille reprise du cache", f.name)
+	}
+
+	for j.State != "done" && j.State != "failed" {
+		if err := sleep(ctx, c.poll); err != nil {
+			return recording{}, err
+		}
+		if err := c.getJSON(ctx, "/api/jobs/"+url.PathEscape(j.ID), &j); err != nil {
+			return recording{}, err
+		}
+	}
+	if j.State == "failed" {
+		return recording{Error: j.Error}, nil
+	}
+	var g json.RawMessage
+	if err := c.getJSON(ctx, "/api/grids/"+url.PathEscape(j.GridID), &g); err != nil {
+		return recording{}, err
+	}
+	return recording{Grid: g}, nil
+}
+
+// statusError is an error answer of the server.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.message)
+}
+
+func (c *client) getJSON(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, v)
+}
+
+// do sends a request and decodes its JSON answer into v, or returns a
+// statusError for an error status.
+func (c *client) do(req *http.Request, v any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var answer struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &answer) != nil || answer.Error == "" {
+			answer.Error = strings.TrimSpace(string(body))
+		}
+		return &statusError{resp.StatusCode, answer.Error}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// result is the score of the recordings of a label.
+type result struct {
+	label    string
+	info     analyzerInfo
+	total    score
+	fixtures []fixtureScore
+}
+
+type fixtureScore struct {
+	name  string
+	score score
+	error string
+}
+
+// scoreRecordings scores the recordings of every label, or of only one,
+// against the fixtures. Fixtures not recorded for a label are left out of
+// its score.
+func scoreRecordings(fixtures []fixture, dir, only string) ([]result, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var results []result
+	for _, e := range entries {
+		if !e.IsDir() || only != "" && e.Name() != only {
+			continue
+		}
+		r := result{label: e.Name()}
+		if err := readJSON(filepath.Join(dir, e.Name(), analyzerFile), &r.info); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, f := range fixtures {
+			var rec recording
+			err := readJSON(filepath.Join(dir, e.Name(), f.name+".json"), &rec)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			var got *grid
+			if rec.Error == "" {
+				got = &grid{}
+				if err := json.Unmarshal(rec.Grid, got); err != nil {
+					return nil, fmt.Errorf("%s/%s: %w", e.Name(), f.name, err)
+				}
+			}
+			s := compareGrids(f.expected, got)
+			r.total.add(s)
+			r.fixtures = append(r.fixtures, fixtureScore{f.name, s, rec.Error})
+		}
+		if r.total.Fixtures > 0 {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// report prints the scores of the labels, best structure first.
+func report(w io.Writer, results []result, verbose bool) {
+	slices.SortStableFunc(results, func(a, b result) int {
+		switch {
+		case a.total.cellAccuracy() > b.total.cellAccuracy():
+			return -1
+		case a.total.cellAccuracy() < b.total.cellAccuracy():
+			return 1
+		}
+		return 0
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "analyseur\tphotos\téchecs\tstructure\tflèches\ttextes")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", r.label, r.total.Fixtures, r.total.Failed,
+			percent(r.total.cellAccuracy()), percent(r.total.arrowAccuracy()), percent(r.total.textSimilarity()))
+		if !verbose {
+			continue
+		}
+		for _, f := range r.fixtures {
+			name := "  " + f.name
+			if f.error != "" {
+				name += " (" + f.error + ")"
+			}
+			fmt.Fprintf(tw, "%s\t\t\t%s\t%s\t%s\n", name,
+				percent(f.score.cellAccuracy()), percent(f.score.arrowAccuracy()), percent(f.score.textSimilarity()))
+		}
+	}
+	tw.Flush()
+}
+
+func percent(rate float64) string {
+	if rate < 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f %%", 100*rate)
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeFixture saves a photo and its expected grid in dir.
+func writeFixture(t *testing.T, dir, name string, expected *grid) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name+".png"), []byte(name), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSON(filepath.Join(dir, name+".json"), expected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeServer answers like the crossword server: the photo "good" is read
+// as the arrow test grid, after a 429 and a poll; "bad" fails.
+func fakeServer(t *testing.T) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var requests []string
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/analyzer", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"gemini","model":"flash","prompt":"0badcafe"}`))
+	})
+	mux.HandleFunc("POST /api/grids", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			t.Errorf("upload without image: %v", err)
+			return
+		}
+		var photo bytes.Buffer
+		photo.ReadFrom(file)
+		requests = append(requests, photo.String()+" "+r.FormValue("kind")+" "+r.FormValue("preprocess"))
+		if len(requests) == 1 {
+			http.Error(w, `{"error":"Trop de requêtes, réessayez plus tard"}`, http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"id":"` + photo.String() + `","state":"queued"}`))
+	})
+	mux.HandleFunc("GET /api/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch polls++; {
+		case r.PathValue("id") == "bad":
+			w.Write([]byte(`{"id":"bad","state":"failed","error":"Aucune grille n'a pu être lue"}`))
+		case polls == 1:
+			w.Write([]byte(`{"id":"good","state":"analyzing"}`))
+		default:
+			w.Write([]byte(`{"id":"good","state":"done","grid_id":"g1"}`))
+		}
+	})
+	mux.HandleFunc("GET /api/grids/g1", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(arrowTestGrid())
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "good", arrowTestGrid())
+	writeFixture(t, dir, "bad", arrowTestGrid())
+	fixtures, err := loadFixtures(dir)
+	if err != nil || len(fixtures) != 2 || fixtures[0].name != "bad" {
+		t.Fatalf("fixtures = %+v, %v", fixtures, err)
+	}
+
+	srv, requests := fakeServer(t)
+	c := &client{base: srv.URL, http: srv.Client()}
+	recordings := filepath.Join(dir, recordingsDir)
+	label, err := c.record(context.Background(), fixtures, recordings, "", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label != "gemini_flash_0badcafe_preprocess=none" {
+		t.Errorf("label = %q", label)
+	}
+	if got := strings.Join(*requests, "|"); got != "bad arrow none|bad arrow none|good arrow none" {
+		t.Errorf("uploads = %s", got)
+	}
+
+	// A recording of another analyzer, without server.
+	other := filepath.Join(recordings, "local")
+	os.MkdirAll(other, 0o755)
+	missed := arrowTestGrid()
+	missed.Cells[1][1] = cell{}
+	data, _ := json.Marshal(missed)
+	writeJSON(filepath.Join(other, "good.json"), recording{Grid: data})
+
+	results, err := scoreRecordings(fixtures, recordings, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %+v", results)
+	}
+	byLabel := map[string]result{}
+	for _, r := range results {
+		byLabel[r.label] = r
+	}
+	gemini := byLabel[label]
+	if gemini.info.Model != "flash" || gemini.total.Fixtures != 2 || gemini.total.Failed != 1 || gemini.total.cellAccuracy() != 0.5 {
+		t.Errorf("gemini = %+v", gemini)
+	}
+	if len(gemini.fixtures) != 2 || gemini.fixtures[0].error != "Aucune grille n'a pu être lue" {
+		t.Errorf("gemini fixtures = %+v", gemini.fixtures)
+	}
+	local := byLabel["local"]
+	if local.total.Fixtures != 1 || local.total.CellsRight != 5 || local.total.ArrowsRight != 2 {
+		t.Errorf("local = %+v", local)
+	}
+
+	if only, _ := scoreRecordings(fixtures, recordings, "local"); len(only) != 1 {
+		t.Errorf("only local: %+v", only)
+	}
+
+	var out bytes.Buffer
+	report(&out, results, true)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 || !strings.HasPrefix(lines[1], "local ") || !strings.Contains(lines[1], "83.3 %") {
+		t.Errorf("report:\n%s", out.String())
+	}
+}
+
+func TestLoadFixturesSharedExpectedGrid(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "grille", arrowTestGrid())
+	for _, name := range []string{"grille_penchee.jpg", "grille_penchee_petite.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixtures, err := loadFixtures(dir)
+	if err != nil || len(fixtures) != 3 {
+		t.Fatalf("fixtures = %+v, %v", fixtures, err)
+	}
+	for _, f := range fixtures {
+		if f.expected.Rows != arrowTestGrid().Rows || len(f.expected.Cells) != arrowTestGrid().Rows {
+			t.Errorf("%s: expected grid = %+v", f.name, f.expected)
+		}
+	}
+
+	// A photo whose name matches no expected grid is an error.
+	os.WriteFile(filepath.Join(dir, "autre.png"), []byte("autre"), 0o644)
+	if _, err := loadFixtures(dir); err == nil || !strings.Contains(err.Error(), "autre.png") {
+		t.Errorf("expected an error for autre.png, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// grid is what evaluation compares of a grid, as served by
+// GET /api/grids/{id} and stored in the fixtures.
+type grid struct {
+	Kind  string   `json:"kind,omitempty"`
+	Rows  int      `json:"rows"`
+	Cols  int      `json:"cols"`
+	Cells [][]cell `json:"cells"`
+	Clues *clues   `json:"clues,omitempty"`
+}
+
+type cell struct {
+	Black       bool         `json:"black"`
+	Definitions []definition `json:"definitions,omitempty"`
+}
+
+type definition struct {
+	Text      string `json:"text"`
+	Direction string `json:"direction"`
+	Start     string `json:"start,omitempty"`
+}
+
+// startSide returns the side of the definition cell where the word starts.
+func (d definition) startSide() string {
+	if d.Start == "" {
+		return d.Direction
+	}
+	return d.Start
+}
+
+type clues struct {
+	Horizontal []clue `json:"horizontal"`
+	Vertical   []clue `json:"vertical"`
+}
+
+type clue struct {
+	Number int      `json:"number"`
+	Texts  []string `json:"texts"`
+}
+
+// cellAt returns the cell at (i, j), and whether the grid has one there.
+func (g *grid) cellAt(i, j int) (cell, bool) {
+	if i < 0 || i >= len(g.Cells) || j < 0 || j >= len(g.Cells[i]) {
+		return cell{}, false
+	}
+	return g.Cells[i][j], true
+}
+
+// score counts what an analyzer read right on one or more grids.
+type score struct {
+	Fixtures int // grids scored
+	Failed   int // analyses that gave no grid
+
+	Cells      int // positions in either grid
+	CellsRight int // of which with the expected type in both
+
+	Arrows      int // expected definitions
+	ArrowsRight int // of which read in their cell with the expected direction and start
+
+	Texts          int     // expected definition texts
+	TextSimilarity float64 // summed over Texts, see similarity
+}
+
+func (s *score) add(o score) {
+	s.Fixtures += o.Fixtures
+	s.Failed += o.Failed
+	s.Cells += o.Cells
+	s.CellsRight += o.CellsRight
+	s.Arrows += o.Arrows
+	s.ArrowsRight += o.ArrowsRight
+	s.Texts += o.Texts
+	s.TextSimilarity += o.TextSimilarity
+}
+
+// Rates from 0 to 1, or -1 when there is nothing to measure.
+
+func (s score) cellAccuracy() float64  { return ratio(float64(s.CellsRight), s.Cells) }
+func (s score) arrowAccuracy() float64 { return ratio(float64(s.ArrowsRight), s.Arrows) }
+func (s score) textSimilarity() float64 {
+	return ratio(s.TextSimilarity, s.Texts)
+}
+
+func ratio(n float64, total int) float64 {
+	if total == 0 {
+		return -1
+	}
+	return n / float64(total)
+}
+
+// compareGrids scores the grid read by an analyzer (got, nil if the
+// analysis failed) against the expected one:
+//   - structure: each position of either grid counts, right when both
+//     grids have a cell there and agree on its type (letter, or definition
+//     cell and black square);
+//   - arrows: each expected definition counts, right when the cell read
+//     has a definition at the same rank running the same way from the same
+//     side;
+//   - texts: each expected definition text, or clue text of a classic
+//     grid, scores its similarity with the text read at the same place, 0
+//     when there is none.
+func compareGrids(expected, got *grid) score {
+	s := score{Fixtures: 1}
+	if got == nil {
+		s.Failed = 1
+		got = &grid{}
+	}
+
+	rows := max(len(expected.Cells), len(got.Cells))
+	for i := range rows {
+		cols := 0
+		if i < len(expected.Cells) {
+			cols = len(expected.Cells[i])
+		}
+		if i < len(got.Cells) {
+			cols = max(cols, len(got.Cells[i]))
+		}
+		for j := range cols {
+			e, inExpected := expected.cellAt(i, j)
+			g, inGot := got.cellAt(i, j)
+			s.Cells++
+			if inExpected && inGot && e.Black == g.Black {
+				s.CellsRight++
+			}
+			for k, d := range e.Definitions {
+				s.Arrows++
+				s.Texts++
+				if k >= len(g.Definitions) {
+					continue
+				}
+				read := g.Definitions[k]
+				if read.Direction == d.Direction && read.startSide() == d.startSide() {
+					s.ArrowsRight++
+				}
+				s.TextSimilarity += similarity(d.Text, read.Text)
+			}
+		}
+	}
+
+	if expected.Clues != nil {
+		var read clues
+		if got.Clues != nil {
+			read = *got.Clues
+		}
+		for _, list := range [][2][]clue{{expected.Clues.Horizontal, read.Horizontal}, {expected.Clues.Vertical, read.Vertical}} {
+			for _, c := range list[0] {
+				var texts []string
+				for _, r := range list[1] {
+					if r.Number == c.Number {
+						texts = r.Texts
+					}
+				}
+				for k, text := range c.Texts {
+					s.Texts++
+					if k < len(texts) {
+						s.TextSimilarity += similarity(text, texts[k])
+					}
+				}
+			}
+		}
+	}
+	return s
+}
+
+// similarity compares two texts from 0 (nothing in common) to 1 (the
+// same), ignoring case and spacing: one minus their edit distance in
+// letters over the length of the longer one. Accents count: reading them
+// is part of the work.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(normalizeText(a)), []rune(normalizeText(b))
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(longest)
+}
+
+func normalizeText(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), unicode.IsSpace), " ")
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range a {
+		cur[0] = i + 1
+		for j := range b {
+			cost := 1
+			if a[i] == b[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func arrowTestGrid() *grid {
+	return &grid{Rows: 2, Cols: 3, Cells: [][]cell{
+		{{Black: true, Definitions: []definition{
+			{Text: "Rongeur", Direction: "right"},
+			{Text: "Copain", Direction: "right", Start: "down"},
+		}}, {}, {}},
+		{{}, {Black: true, Definitions: []definition{{Text: "Note", Direction: "right"}}}, {}},
+	}}
+}
+
+func TestCompareGridsIdentical(t *testing.T) {
+	s := compareGrids(arrowTestGrid(), arrowTestGrid())
+	if s.cellAccuracy() != 1 || s.arrowAccuracy() != 1 || s.textSimilarity() != 1 {
+		t.Errorf("score = %+v", s)
+	}
+	if s.Cells != 6 || s.Arrows != 3 || s.Texts != 3 {
+		t.Errorf("counts = %+v", s)
+	}
+}
+
+func TestCompareGridsErrors(t *testing.T) {
+	got := arrowTestGrid()
+	got.Cells[0][0].Definitions[0].Text = "rongeurs"       // one letter more
+	got.Cells[0][0].Definitions[1].Start = ""              // straight arrow read
+	got.Cells[1][1] = cell{}                               // definition cell missed
+	got.Cells = append(got.Cells, []cell{{}, {}, {}})      // extra row
+	got.Cells[0] = append(got.Cells[0], cell{Black: true}) // extra column on one row
+
+	s := compareGrids(arrowTestGrid(), got)
+	if s.Cells != 10 || s.CellsRight != 5 {
+		t.Errorf("cells = %d/%d, want 5/10", s.CellsRight, s.Cells)
+	}
+	if s.Arrows != 3 || s.ArrowsRight != 1 {
+		t.Errorf("arrows = %d/%d, want 1/3", s.ArrowsRight, s.Arrows)
+	}
+	if want := (1 - 1.0/8 + 1) / 3; math.Abs(s.textSimilarity()-want) > 1e-9 {
+		t.Errorf("text similarity = %f, want %f", s.textSimilarity(), want)
+	}
+}
+
+func TestCompareGridsFailed(t *testing.T) {
+	s := compareGrids(arrowTestGrid(), nil)
+	if s.Failed != 1 || s.CellsRight != 0 || s.Cells != 6 || s.TextSimilarity != 0 {
+		t.Errorf("score = %+v", s)
+	}
+}
+
+func TestCompareGridsClues(t *testing.T) {
+	expected := &grid{Kind: "classic", Rows: 1, Cols: 2, Cells: [][]cell{{{}, {Black: true}}}, Clues: &clues{
+		Horizontal: []clue{{Number: 1, Texts: []string{"Capitale", "Note"}}},
+		Vertical:   []clue{{Number: 1, Texts: []string{"Avant"}}},
+	}}
+	got := &grid{Kind: "classic", Rows: 1, Cols: 2, Cells: [][]cell{{{}, {Black: true}}}, Clues: &clues{
+		Horizontal: []clue{{Number: 1, Texts: []string{"capitale"}}},
+	}}
+	s := compareGrids(expected, got)
+	if s.cellAccuracy() != 1 || s.arrowAccuracy() != -1 || s.Texts != 3 || s.TextSimilarity != 1 {
+		t.Errorf("score = %+v", s)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want float64
+	}{
+		{"Tondu de près", "TONDU  DE PRÈS", 1},
+		{"Tondu de près", "Tondu de pres", 1 - 1.0/13},
+		{"Note", "", 0},
+		{"", "", 1},
+	} {
+		if got := similarity(tc.a, tc.b); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q) = %f, want %f", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -11,15 +11,20 @@ const uploadStatus = $("#upload-status");
 btnUpload.addEventListener("click", () => fileInput.click());
 
 fileInput.addEventListener("change", async () => {
-    const file = fileInput.files[0];
-    if (!file) return;
+    // Several photos of one grid are sent in order, to be assembled.
+    const files = [...fileInput.files];
+    if (!files.length) return;
 
     btnUpload.disabled = true;
     uploadStatus.hidden = false;
     clearError();
 
     const form = new FormData();
-    form.append("image", file);
+    for (const file of files) form.append("image", file);
+    form.append("kind", $("#kind-select").value);
+    const steps = [...document.querySelectorAll("input[name=preprocess]:checked")].map((c) => c.value);
+    form.append("preprocess", steps.length ? steps.join(",") : "none");
+    form.append("page", $("#pdf-page").value || "1");
 
     try {
         const resp = await fetch("/api/grids", { method: "POST", body: form });
@@ -27,7 +32,13 @@ fileInput.addEventListener("change", async () => {
             const data = await resp.json();
             throw new Error(data.error || "Erreur inconnue");
         }
-        const grid = await resp.json();
+        const job = await waitForJob(await resp.json());
+        const gridResp = await fetch("/api/grids/" + encodeURIComponent(job.grid_id));
+        if (!gridResp.ok) throw new Error("Grille introuvable");
+        const grid = await gridResp.json();
+        // Overlaps with cells read differently on two photos need a look.
+        const overlaps = (job.overlaps || []).map((o) => ({ message: o.message, repaired: !o.conflicts }));
+        grid.warnings = [...(job.warnings || []), ...overlaps];
         renderGridPreview(grid);
         loadGridList();
     } catch (err) {
@@ -39,6 +50,75 @@ fileInput.addEventListener("change", async () => {
     }
 });
 
+const jobLabels = {
+    queued: "En attente d'analyse...",
+    analyzing: "Analyse de la grille en cours...",
+    validating: "V\u00e9rification de la grille...",
+};
+
+// waitForJob follows an analysis job on its event stream until it is done,
+// and rejects if it fails.
+function waitForJob(job) {
+    // A photo analyzed before comes back as a job already done.
+    if (job.state === "done") return Promise.resolve(job);
+    const statusText = $("#upload-status-text");
+    return new Promise((resolve, reject) => {
+        const source = new EventSource("/api/jobs/" + encodeURIComponent(job.id) + "/events");
+        source.onmessage = (e) => {
+            const data = JSON.parse(e.data);
+            if (data.type !== "job") return;
+            if (jobLabels[data.state]) statusText.textContent = jobLabels[data.state];
+            if (data.state === "done") {
+                source.close();
+                resolve(data);
+            } else if (data.state === "failed") {
+                source.close();
+                reject(new Error(data.error || "Erreur lors de l'analyse de la grille"));
+            }
+        };
+        source.onerror = () => {
+            // The browser reconnects by itself; give up only if the job is gone.
+            if (source.readyState === EventSource.CLOSED) {
+                reject(new Error("Suivi de l'analyse interrompu"));
+            }
+        };
+    });
+}
+
+// --- Import (ipuz, .puz, XD) ---
+
+const importInput = $("#import-input");
+const btnImport = $("#btn-import");
+
+btnImport.addEventListener("click", () => importInput.click());
+
+importInput.addEventListener("change", async () => {
+    const file = importInput.files[0];
+    if (!file) return;
+
+    btnImport.disabled = true;
+    clearError();
+
+    const form = new FormData();
+    form.append("file", file);
+
+    try {
+        const resp = await fetch("/api/grids/import", { method: "POST", body: form });
+        if (!resp.ok) {
+            const data = await resp.json();
+            throw new Error(data.error || "Erreur inconnue");
+        }
+        const grid = await resp.json();
+        renderGridPreview(grid);
+        loadGridList();
+    } catch (err) {
+        showError(err.message);
+    } finally {
+        btnImport.disabled = false;
+        importInput.value = "";
+    }
+});
+
 // --- Grid list ---
 
 async function loadGridList() {
@@ -100,14 +180,37 @@ function createGridCard(g) {
     btnView.textContent = "Voir";
     btnView.addEventListener("click", () => showGrid(g.id));
 
+    const btnSolution = document.createElement("button");
+    btnSolution.className = "btn btn-secondary";
+    btnSolution.textContent = g.has_solution ? "Solution \u2713" : "Solution";
+    btnSolution.title = "Ajouter la photo de la page des solutions";
+    btnSolution.addEventListener("click", () => pickSolution(g.id, g.version));
+
+    const linkExport = document.createElement("a");
+    linkExport.className = "btn btn-secondary";
+    linkExport.textContent = "ipuz";
+    linkExport.title = "Exporter la grille au format ipuz";
+    linkExport.href = "/api/grids/" + encodeURIComponent(g.id) + "/export?format=ipuz";
+    linkExport.download = g.id + ".ipuz";
+
     const btnPlay = document.createElement("button");
     btnPlay.className = "btn btn-primary";
     btnPlay.textContent = "Jouer";
     btnPlay.addEventListener("click", () => createGame(g.id));
 
     actions.appendChild(btnView);
+    actions.appendChild(btnSolution);
+    actions.appendChild(linkExport);
     actions.appendChild(btnPlay);
 
+    if (g.image_hash) {
+        const thumb = document.createElement("img");
+        thumb.className = "grid-card-thumb";
+        thumb.src = "/api/grids/" + encodeURIComponent(g.id) + "/image?size=preview";
+        thumb.alt = "";
+        thumb.loading = "lazy";
+        card.appendChild(thumb);
+    }
     card.appendChild(info);
     card.appendChild(actions);
     return card;
@@ -124,6 +227,51 @@ async function showGrid(id) {
     }
 }
 
+// --- Solution ---
+
+const solutionInput = $("#solution-input");
+let solutionGridID = null;
+let solutionGridVersion = null;
+
+function pickSolution(gridID, version) {
+    solutionGridID = gridID;
+    solutionGridVersion = version;
+    solutionInput.click();
+}
+
+solutionInput.addEventListener("change", async () => {
+    const file = solutionInput.files[0];
+    if (!file || !solutionGridID) return;
+
+    uploadStatus.hidden = false;
+    clearError();
+
+    const form = new FormData();
+    form.append("image", file);
+    form.append("kind", $("#kind-select").value);
+    form.append("page", $("#pdf-page").value || "1");
+    if (solutionGridVersion) form.append("version", solutionGridVersion);
+
+    try {
+        const resp = await fetch(
+            "/api/grids/" + encodeURIComponent(solutionGridID) + "/solution",
+            { method: "PUT", body: form }
+        );
+        if (!resp.ok) {
+            const data = await resp.json();
+            throw new Error(data.error || "Erreur inconnue");
+        }
+        loadGridList();
+    } catch (err) {
+        showError(err.message);
+    } finally {
+        uploadStatus.hidden = true;
+        solutionInput.value = "";
+        solutionGridID = null;
+        solutionGridVersion = null;
+    }
+});
+
 // --- Create game ---
 
 async function createGame(gridID) {
@@ -155,7 +303,9 @@ function renderGridPreview(grid) {
         const tr = document.createElement("tr");
         for (const cell of row) {
             const td = document.createElement("td");
-            if (cell.black) {
+            if (cell.black && grid.kind === "classic") {
+                td.className = "cell-black";
+            } else if (cell.black) {
                 td.className = "cell-def";
                 renderDefsInto(td, cell.definitions);
             } else {
@@ -166,10 +316,20 @@ function renderGridPreview(grid) {
         table.appendChild(tr);
     }
 
+    renderWarnings(grid.warnings || []);
+    loadReview(grid);
     section.hidden = false;
     section.scrollIntoView({ behavior: "smooth", block: "start" });
 }
 
+// defArrow returns the arrow of a definition: straight, or bent when the
+// word starts on another side than it runs.
+function defArrow(d) {
+    const start = d.start || d.direction;
+    if (start === d.direction) return d.direction === "right" ? "\u2192" : "\u2193";
+    return d.direction === "right" ? "\u21b3" : "\u21b4";
+}
+
 function renderDefsInto(td, defs) {
     if (!defs || defs.length === 0) return;
     for (const d of defs) {
@@ -179,7 +339,7 @@ function renderDefsInto(td, defs) {
 
         const arrow = document.createElement("span");
         arrow.className = "def-arrow";
-        arrow.textContent = d.direction === "right" ? "\u2192" : "\u2193";
+        arrow.textContent = defArrow(d);
 
         td.appendChild(text);
         td.appendChild(arrow);
@@ -190,6 +350,11 @@ function renderDefsInto(td, defs) {
 
 function countDefs(grid) {
     let n = 0;
+    if (grid.clues) {
+        for (const c of [...(grid.clues.horizontal || []), ...(grid.clues.vertical || [])]) {
+            n += c.texts.length;
+        }
+    }
     for (const row of grid.cells) {
         for (const cell of row) {
             if (cell.black && cell.definitions) n += cell.definitions.length;
@@ -198,6 +363,75 @@ function countDefs(grid) {
     return n;
 }
 
+// Problems found by the server when reading the grid; those it could not
+// repair are listed first.
+function renderWarnings(warnings) {
+    const list = $("#grid-warnings");
+    list.textContent = "";
+    const sorted = [...warnings].sort((a, b) => a.repaired - b.repaired);
+    for (const w of sorted) {
+        const li = document.createElement("li");
+        li.textContent = w.message;
+        if (!w.repaired) li.className = "warning-unrepaired";
+        list.appendChild(li);
+    }
+    list.hidden = warnings.length === 0;
+}
+
+// Parts of the grid the analyzer is unsure about: their cells are outlined
+// and each can be confirmed before starting a game.
+async function loadReview(grid) {
+    const box = $("#grid-review");
+    const list = $("#review-list");
+    list.textContent = "";
+    box.hidden = true;
+    try {
+        const resp = await fetch("/api/grids/" + encodeURIComponent(grid.id) + "/review");
+        if (!resp.ok) return;
+        const review = await resp.json();
+        const rows = $("#grid-table").rows;
+        for (const item of review.items) {
+            if (item.cell) rows[item.cell.row].cells[item.cell.col].classList.add("cell-doubt");
+
+            const li = document.createElement("li");
+            const text = document.createElement("span");
+            text.textContent = item.message;
+            const score = document.createElement("span");
+            score.className = "review-confidence";
+            score.textContent = Math.round(item.confidence * 100) + " %";
+            const btn = document.createElement("button");
+            btn.className = "btn btn-secondary";
+            btn.textContent = "Confirmer";
+            btn.addEventListener("click", () => confirmItem(grid.id, review.version, item));
+            li.append(text, score, btn);
+            list.appendChild(li);
+        }
+        box.hidden = review.items.length === 0;
+    } catch {
+        // The review is a hint: the preview stays usable without it.
+    }
+}
+
+async function confirmItem(gridID, version, item) {
+    const edit = item.type === "clue"
+        ? { op: "confirm_clue", direction: item.direction, index: item.number }
+        : { op: "confirm", row: item.cell.row, col: item.cell.col };
+    try {
+        const resp = await fetch("/api/grids/" + encodeURIComponent(gridID), {
+            method: "PATCH",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ version, edits: [edit] }),
+        });
+        if (!resp.ok) {
+            const data = await resp.json();
+            throw new Error(data.error || "Erreur");
+        }
+        showGrid(gridID);
+    } catch (err) {
+        showError(err.message);
+    }
+}
+
 function showError(msg) {
     clearError();
     const p = document.createElement("p");
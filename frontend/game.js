@@ -6,12 +6,15 @@ const $ = (sel) => document.querySelector(sel);
 const gameID = location.pathname.split("/").pop();
 
 let grid = null;       // Grid data (cells, rows, cols)
+let words = [];        // Entries of the grid, as derived by the server
 let state = null;      // Current game state [row][col]
 let pseudo = null;     // Current player pseudo
 let eventSource = null;
+let socket = null;     // WebSocket, when that transport is in use
 let selectedRow = -1;
 let selectedCol = -1;
 let direction = "right"; // "right" or "down"
+let completed = false;   // board frozen once the grid is solved
 
 // --- Join ---
 
@@ -52,10 +55,14 @@ async function loadGame() {
         if (!resp.ok) throw new Error("Partie introuvable");
         const data = await resp.json();
         grid = data.grid;
+        words = data.words || [];
         state = data.state;
+        $("#btn-check").hidden = !grid.has_solution;
+        $("#revision-notice").hidden = !(data.latest_grid_version > grid.version);
         renderPlayers(data.players);
         renderGrid();
-        connectSSE();
+        if (data.completion) showCompletion(data.completion);
+        connect();
     } catch (err) {
         showJoinError(err.message);
     }
@@ -67,15 +74,29 @@ function renderGrid() {
     const table = $("#game-grid");
     table.textContent = "";
 
+    const classic = grid.kind === "classic";
+    if (classic) {
+        // Column numbers above the grid.
+        const tr = document.createElement("tr");
+        tr.appendChild(document.createElement("th"));
+        for (let c = 0; c < grid.cols; c++) {
+            tr.appendChild(gridNumber(String(c + 1)));
+        }
+        table.appendChild(tr);
+    }
+
     for (let r = 0; r < grid.rows; r++) {
         const tr = document.createElement("tr");
+        if (classic) tr.appendChild(gridNumber(roman(r + 1)));
         for (let c = 0; c < grid.cols; c++) {
             const cell = grid.cells[r][c];
             const td = document.createElement("td");
             td.dataset.row = r;
             td.dataset.col = c;
 
-            if (cell.black) {
+            if (cell.black && classic) {
+                td.className = "cell-black";
+            } else if (cell.black) {
                 td.className = "cell-def";
                 renderDefsInto(td, cell.definitions);
             } else {
@@ -91,10 +112,86 @@ function renderGrid() {
         table.appendChild(tr);
     }
 
+    renderClues();
+
     // Select first available cell.
     selectFirstCell();
 }
 
+function gridNumber(label) {
+    const th = document.createElement("th");
+    th.className = "grid-number";
+    th.textContent = label;
+    return th;
+}
+
+// roman returns the row number as printed in mots croisés: I, II, III...
+function roman(n) {
+    const numerals = [[10, "X"], [9, "IX"], [5, "V"], [4, "IV"], [1, "I"]];
+    let s = "";
+    for (const [value, numeral] of numerals) {
+        for (; n >= value; n -= value) s += numeral;
+    }
+    return s;
+}
+
+// numberLabel returns how a classic clue number is printed: roman for rows,
+// arabic for columns.
+function numberLabel(dir, number) {
+    return dir === "right" ? roman(number) : String(number);
+}
+
+// renderClues lists the clues of a classic grid beside it, one entry per
+// row or column; clicking a clue selects its word.
+function renderClues() {
+    const section = $("#clue-lists");
+    if (grid.kind !== "classic") {
+        section.hidden = true;
+        return;
+    }
+    for (const [dir, id] of [["right", "#clues-horizontal"], ["down", "#clues-vertical"]]) {
+        const list = $(id);
+        list.textContent = "";
+        const byNumber = new Map();
+        for (const w of words) {
+            if (w.direction !== dir || !w.definition) continue;
+            if (!byNumber.has(w.definition.number)) byNumber.set(w.definition.number, []);
+            byNumber.get(w.definition.number).push(w);
+        }
+        for (const [number, entries] of byNumber) {
+            const li = document.createElement("li");
+            const label = document.createElement("strong");
+            label.textContent = numberLabel(dir, number) + ". ";
+            li.appendChild(label);
+            entries.forEach((w, i) => {
+                if (i > 0) li.appendChild(document.createTextNode(" \u2013 "));
+                const span = document.createElement("span");
+                span.className = "clue";
+                span.dataset.dir = dir;
+                span.dataset.row = w.start.row;
+                span.dataset.col = w.start.col;
+                span.textContent = w.definition.text;
+                span.addEventListener("click", () => {
+                    direction = dir;
+                    selectedRow = selectedCol = -1;
+                    selectCell(w.start.row, w.start.col);
+                });
+                li.appendChild(span);
+            });
+            list.appendChild(li);
+        }
+    }
+    section.hidden = false;
+}
+
+// defArrow returns the arrow of a definition: straight, or bent when the
+// word starts on another side than it runs.
+function defArrow(d) {
+    const start = d.start || d.direction;
+    if (start === d.direction) return d.direction === "right" ? "\u2192" : "\u2193";
+    return d.direction === "right" ? "\u21b3" : "\u21b4";
+}
+
 function renderDefsInto(td, defs) {
     if (!defs || defs.length === 0) return;
     for (const d of defs) {
@@ -104,7 +201,7 @@ function renderDefsInto(td, defs) {
 
         const arrow = document.createElement("span");
         arrow.className = "def-arrow";
-        arrow.textContent = d.direction === "right" ? "\u2192" : "\u2193";
+        arrow.textContent = defArrow(d);
 
         td.appendChild(text);
         td.appendChild(arrow);
@@ -157,27 +254,25 @@ function getCell(row, col) {
     );
 }
 
+// wordAt returns the entry containing (row, col) in direction dir,
+// preferring one that has a definition.
+function wordAt(row, col, dir) {
+    let found = null;
+    for (const w of words) {
+        if (w.direction !== dir) continue;
+        if (!w.cells.some((p) => p.row === row && p.col === col)) continue;
+        if (w.definition) return w;
+        found = found || w;
+    }
+    return found;
+}
+
 function highlightWord(row, col) {
-    if (direction === "right") {
-        // Highlight all letter cells in the same row, from the nearest def cell to the left.
-        let startCol = col;
-        while (startCol > 0 && !grid.cells[row][startCol - 1].black) {
-            startCol--;
-        }
-        for (let c = startCol; c < grid.cols && !grid.cells[row][c].black; c++) {
-            const td = getCell(row, c);
-            if (td && c !== col) td.classList.add("highlighted");
-        }
-    } else {
-        // Highlight all letter cells in the same column, from the nearest def cell above.
-        let startRow = row;
-        while (startRow > 0 && !grid.cells[startRow - 1][col].black) {
-            startRow--;
-        }
-        for (let r = startRow; r < grid.rows && !grid.cells[r][col].black; r++) {
-            const td = getCell(r, col);
-            if (td && r !== row) td.classList.add("highlighted");
-        }
+    const word = wordAt(row, col, direction);
+    if (!word) return;
+    for (const p of word.cells) {
+        const td = getCell(p.row, p.col);
+        if (td && !(p.row === row && p.col === col)) td.classList.add("highlighted");
     }
 }
 
@@ -185,47 +280,103 @@ function showDefinition(row, col) {
     const defSection = $("#current-def");
     const defText = $("#def-text");
 
-    let def = null;
-
-    if (direction === "right") {
-        // Find the definition cell to the left of this word.
-        let c = col;
-        while (c > 0 && !grid.cells[row][c - 1].black) {
-            c--;
-        }
-        // Check cell at c-1 (or c if it's at the edge).
-        if (c > 0) {
-            const defCell = grid.cells[row][c - 1];
-            if (defCell.definitions) {
-                def = defCell.definitions.find((d) => d.direction === "right");
-            }
-        }
-    } else {
-        // Find the definition cell above this word.
-        let r = row;
-        while (r > 0 && !grid.cells[r - 1][col].black) {
-            r--;
-        }
-        if (r > 0) {
-            const defCell = grid.cells[r - 1][col];
-            if (defCell.definitions) {
-                def = defCell.definitions.find((d) => d.direction === "down");
-            }
-        }
-    }
-
-    if (def) {
-        defText.textContent = (direction === "right" ? "\u2192 " : "\u2193 ") + def.text;
+    const word = wordAt(row, col, direction);
+    if (word && word.definition) {
+        let label = direction === "right" ? "\u2192 " : "\u2193 ";
+        if (word.definition.number) label += numberLabel(direction, word.definition.number) + ". ";
+        defText.textContent = label + word.definition.text;
         defSection.hidden = false;
     } else {
         defSection.hidden = true;
     }
+
+    $("#def-crop").hidden = true;
+    $("#btn-original").hidden = !(word && grid.image_hash && wordBox(word));
+
+    for (const span of document.querySelectorAll("#clue-lists .clue")) {
+        span.classList.toggle("clue-active", !!word &&
+            span.dataset.dir === word.direction &&
+            Number(span.dataset.row) === word.start.row &&
+            Number(span.dataset.col) === word.start.col);
+    }
 }
 
+// --- Source photo ---
+
+let photo = null; // loaded on first use
+
+// wordBox returns the region of the photo showing a word's definition: its
+// definition cell, or for classic grids the word itself, with a margin.
+function wordBox(word) {
+    let cells = word.cells;
+    if (word.definition && word.definition.cell) cells = [word.definition.cell];
+    let box = null;
+    for (const p of cells) {
+        const b = grid.cells[p.row][p.col].box;
+        if (!b) return null;
+        box = box ? {
+            x: Math.min(box.x, b.x),
+            y: Math.min(box.y, b.y),
+            right: Math.max(box.right, b.x + b.width),
+            bottom: Math.max(box.bottom, b.y + b.height),
+            cw: b.width, ch: b.height,
+        } : { x: b.x, y: b.y, right: b.x + b.width, bottom: b.y + b.height, cw: b.width, ch: b.height };
+    }
+    if (!box) return null;
+    const x = Math.max(0, box.x - box.cw / 2);
+    const y = Math.max(0, box.y - box.ch / 2);
+    return {
+        x, y,
+        width: Math.min(1, box.right + box.cw / 2) - x,
+        height: Math.min(1, box.bottom + box.ch / 2) - y,
+    };
+}
+
+async function showOriginal() {
+    const word = wordAt(selectedRow, selectedCol, direction);
+    const box = word && wordBox(word);
+    if (!box) return;
+    if (!photo) {
+        photo = new Image();
+        photo.src = "/api/grids/" + encodeURIComponent(grid.id) + "/image";
+        try {
+            await photo.decode();
+        } catch (err) {
+            photo = null;
+            return;
+        }
+    }
+    const sx = box.x * photo.naturalWidth;
+    const sy = box.y * photo.naturalHeight;
+    const sw = box.width * photo.naturalWidth;
+    const sh = box.height * photo.naturalHeight;
+    const scale = Math.min(1, 320 / sw);
+    const canvas = $("#def-crop");
+    canvas.width = Math.round(sw * scale);
+    canvas.height = Math.round(sh * scale);
+    canvas.getContext("2d").drawImage(photo, sx, sy, sw, sh, 0, 0, canvas.width, canvas.height);
+    canvas.hidden = false;
+}
+
+$("#btn-original").addEventListener("click", showOriginal);
+
 // --- Keyboard ---
 
 document.addEventListener("keydown", (e) => {
     if (selectedRow < 0 || selectedCol < 0) return;
+    if (completed) return;
+
+    if ((e.ctrlKey || e.metaKey) && (e.key === "z" || e.key === "Z")) {
+        e.preventDefault();
+        sendUndoRedo(e.shiftKey ? "redo" : "undo");
+        return;
+    }
+    if ((e.ctrlKey || e.metaKey) && (e.key === "y" || e.key === "Y")) {
+        e.preventDefault();
+        sendUndoRedo("redo");
+        return;
+    }
+    if (e.ctrlKey || e.metaKey || e.altKey) return;
     if (joinSection && !joinSection.hidden) return;
 
     if (e.key === "ArrowRight") {
@@ -293,8 +444,12 @@ async function sendMove(row, col, value) {
     // Optimistic update.
     state[row][col] = value;
     const td = getCell(row, col);
-    if (td) td.textContent = value;
+    if (td) {
+        td.textContent = value;
+        td.classList.remove("cell-wrong");
+    }
 
+    if (sendOverSocket({ type: "move", row, col, value })) return;
     try {
         const resp = await fetch(
             "/api/games/" + encodeURIComponent(gameID) + "/move",
@@ -315,60 +470,265 @@ async function sendMove(row, col, value) {
     }
 }
 
-// --- SSE ---
+// --- Undo / redo ---
+
+$("#btn-undo").addEventListener("click", () => sendUndoRedo("undo"));
+$("#btn-redo").addEventListener("click", () => sendUndoRedo("redo"));
+
+async function sendUndoRedo(action) {
+    if (completed) return;
+    if (sendOverSocket({ type: action })) return;
+    try {
+        const resp = await fetch(
+            "/api/games/" + encodeURIComponent(gameID) + "/" + action,
+            {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify({ pseudo }),
+            }
+        );
+        if (!resp.ok) {
+            const data = await resp.json();
+            throw new Error(data.error || "Erreur");
+        }
+        // The cell is updated when the cell_update event comes back.
+    } catch (err) {
+        setCheckStatus(err.message);
+    }
+}
+
+// --- Check ---
+
+$("#btn-check").addEventListener("click", async () => {
+    try {
+        const resp = await fetch(
+            "/api/games/" + encodeURIComponent(gameID) + "/check",
+            {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify({ pseudo }),
+            }
+        );
+        if (!resp.ok) {
+            const data = await resp.json();
+            throw new Error(data.error || "Erreur");
+        }
+        // The result is shown when the check_result event comes back.
+    } catch (err) {
+        setCheckStatus(err.message);
+    }
+});
+
+function showCheckResult(data) {
+    for (const td of $("#game-grid").querySelectorAll("td.cell-wrong")) {
+        td.classList.remove("cell-wrong");
+    }
+    for (const p of data.wrong) {
+        const td = getCell(p.row, p.col);
+        if (td) td.classList.add("cell-wrong");
+    }
+
+    let msg;
+    if (data.wrong.length === 0) {
+        msg = data.filled + " lettre(s) v\u00e9rifi\u00e9e(s), aucune erreur";
+    } else {
+        msg = data.wrong.length + " erreur(s) sur " + data.filled + " lettre(s)";
+    }
+    if (data.pseudo && data.pseudo !== pseudo) {
+        msg += " (v\u00e9rification demand\u00e9e par " + data.pseudo + ")";
+    }
+    setCheckStatus(msg);
+}
+
+function setCheckStatus(msg) {
+    const el = $("#check-status");
+    el.textContent = msg;
+    el.hidden = false;
+}
+
+// --- Completion ---
+
+function showCompletion(completion) {
+    completed = true;
+    $("#btn-check").hidden = true;
+    $("#btn-undo").hidden = true;
+    $("#btn-redo").hidden = true;
+    $("#game-grid").classList.add("grid-completed");
+
+    const minutes = Math.floor(completion.elapsed_seconds / 60);
+    const seconds = completion.elapsed_seconds % 60;
+    $("#completion-time").textContent =
+        "Termin\u00e9e en " + minutes + " min " + String(seconds).padStart(2, "0") + " s";
+
+    const list = $("#completion-stats");
+    list.textContent = "";
+    for (const s of completion.stats) {
+        const li = document.createElement("li");
+        li.textContent = s.pseudo + " \u2014 " + s.letters + " lettre(s), " + s.moves + " coup(s)";
+        list.appendChild(li);
+    }
+
+    $("#completion").hidden = false;
+}
+
+// --- Grid revisions ---
+
+// A corrected grid does not change this game: players may start a new one
+// on the latest version.
+$("#btn-new-game").addEventListener("click", async () => {
+    try {
+        const resp = await fetch("/api/games", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ grid_id: grid.id }),
+        });
+        if (!resp.ok) throw new Error();
+        const game = await resp.json();
+        location.href = "/game/" + encodeURIComponent(game.id);
+    } catch {
+        setCheckStatus("Impossible de cr\u00e9er la partie");
+    }
+});
+
+// --- Real time ---
+//
+// Events come over a WebSocket, which also carries moves and undo/redo,
+// or else over SSE with moves posted over HTTP. SSE is used when the
+// browser has no WebSocket, when the socket cannot be opened (a proxy in
+// the way), or with ?transport=sse in the page URL.
 
 let reconnectDelay = 1000;
 const maxReconnectDelay = 30000;
+let lastEventId = "";  // resume point: the server replays what we missed
+let useSocket = "WebSocket" in window
+    && new URLSearchParams(location.search).get("transport") !== "sse";
 
-function connectSSE() {
-    const statusEl = $("#connection-status");
+function connect() {
+    if (useSocket) {
+        connectWS();
+    } else {
+        connectSSE();
+    }
+}
 
-    const url = "/api/games/" + encodeURIComponent(gameID) + "/events"
+function streamURL(path) {
+    let url = "/api/games/" + encodeURIComponent(gameID) + "/" + path
         + "?pseudo=" + encodeURIComponent(pseudo);
+    if (lastEventId) {
+        url += "&last_event_id=" + encodeURIComponent(lastEventId);
+    }
+    return url;
+}
 
-    eventSource = new EventSource(url);
+function connected() {
+    $("#connection-status").hidden = true;
+    reconnectDelay = 1000; // Reset on successful connect.
+}
 
-    eventSource.onopen = () => {
-        statusEl.hidden = true;
-        reconnectDelay = 1000; // Reset on successful connect.
-    };
+function reconnectLater() {
+    $("#connection-status").hidden = false;
+    // Reconnect with exponential backoff.
+    setTimeout(() => {
+        reconnectDelay = Math.min(reconnectDelay * 2, maxReconnectDelay);
+        connect();
+    }, reconnectDelay);
+}
+
+function connectSSE() {
+    eventSource = new EventSource(streamURL("events"));
+
+    eventSource.onopen = connected;
 
     eventSource.onmessage = (e) => {
-        const data = JSON.parse(e.data);
-
-        if (data.type === "cell_update") {
-            state[data.row][data.col] = data.value;
-            const td = getCell(data.row, data.col);
-            if (td) {
-                td.textContent = data.value;
-                // Flash animation for remote updates.
-                if (data.pseudo !== pseudo) {
-                    td.classList.add("cell-flash");
-                    setTimeout(() => td.classList.remove("cell-flash"), 600);
-                }
-            }
-        } else if (data.type === "player_joined") {
-            addPlayerToList(data.pseudo, data.color);
-        } else if (data.type === "player_left") {
-            removePlayerFromList(data.pseudo);
-        } else if (data.type === "game_state") {
-            state = data.state;
-            renderPlayers(data.players);
-            refreshGridState();
-        }
+        if (e.lastEventId) lastEventId = e.lastEventId;
+        handleEvent(JSON.parse(e.data));
     };
 
     eventSource.onerror = () => {
-        statusEl.hidden = false;
         eventSource.close();
-        // Reconnect with exponential backoff.
-        setTimeout(() => {
-            reconnectDelay = Math.min(reconnectDelay * 2, maxReconnectDelay);
-            connectSSE();
-        }, reconnectDelay);
+        reconnectLater();
+    };
+}
+
+function connectWS() {
+    const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(scheme + "//" + location.host + streamURL("ws"));
+    let opened = false;
+    let resync = false;
+    socket = ws;
+
+    ws.onopen = () => {
+        opened = true;
+        connected();
+    };
+
+    ws.onmessage = (e) => {
+        const msg = JSON.parse(e.data);
+        if (msg.id) lastEventId = msg.id;
+        if (msg.event.type === "error") {
+            // A refused move was already shown: start again from a
+            // snapshot of the game.
+            setCheckStatus(msg.event.error);
+            lastEventId = "";
+            resync = true;
+            ws.close();
+            return;
+        }
+        handleEvent(msg.event);
+    };
+
+    ws.onclose = () => {
+        socket = null;
+        if (!opened) {
+            useSocket = false; // never opened: fall back to SSE
+            connect();
+        } else if (resync) {
+            connect();
+        } else {
+            reconnectLater();
+        }
     };
 }
 
+// sendOverSocket sends a message over the WebSocket if it is open, and
+// tells whether it did.
+function sendOverSocket(msg) {
+    if (!socket || socket.readyState !== WebSocket.OPEN) return false;
+    socket.send(JSON.stringify(msg));
+    return true;
+}
+
+function handleEvent(data) {
+    if (data.type === "cell_update") {
+        state[data.row][data.col] = data.value;
+        const td = getCell(data.row, data.col);
+        if (td) {
+            td.textContent = data.value;
+            td.classList.remove("cell-wrong");
+            // Flash animation for remote updates.
+            if (data.pseudo !== pseudo) {
+                td.classList.add("cell-flash");
+                setTimeout(() => td.classList.remove("cell-flash"), 600);
+            }
+        }
+    } else if (data.type === "player_joined") {
+        addPlayerToList(data.pseudo, data.color);
+    } else if (data.type === "player_left") {
+        removePlayerFromList(data.pseudo);
+    } else if (data.type === "game_completed") {
+        showCompletion(data.completion);
+    } else if (data.type === "check_result") {
+        showCheckResult(data);
+    } else if (data.type === "grid_revised") {
+        $("#revision-notice").hidden = false;
+    } else if (data.type === "game_state") {
+        state = data.state;
+        renderPlayers(data.players);
+        refreshGridState();
+        if (data.completion) showCompletion(data.completion);
+    }
+}
+
 function refreshGridState() {
     for (let r = 0; r < grid.rows; r++) {
         for (let c = 0; c < grid.cols; c++) {
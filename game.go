@@ -1,10 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
+var (
+	errOutOfBounds   = errors.New("position out of bounds")
+	errGameCompleted = errors.New("game already completed")
+	errNothingToUndo = errors.New("nothing to undo")
+	errNothingToRedo = errors.New("nothing to redo")
+	errCellChanged   = errors.New("cell changed since the move")
+)
+
+// Kinds of history entries besides regular moves.
+const (
+	moveUndo = "undo"
+	moveRedo = "redo"
+)
+
 // Player represents a connected player.
 type Player struct {
 	Pseudo   string    `json:"pseudo"`
@@ -14,12 +31,44 @@ type Player struct {
 
 // GameSession represents a collaborative game on a grid.
 type GameSession struct {
-	ID        string            `json:"id"`
-	GridID    string            `json:"grid_id"`
-	Players   map[string]*Player `json:"players"`
-	State     [][]string        `json:"state"` // current letters [row][col]
-	CreatedAt time.Time         `json:"created_at"`
-	mu        sync.Mutex
+	ID          string             `json:"id"`
+	GridID      string             `json:"grid_id"`
+	GridVersion int                `json:"grid_version"` // grid revision the game is played on
+	Players     map[string]*Player `json:"players"`
+	State       [][]string         `json:"state"`             // current letters [row][col]
+	Authors     [][]string         `json:"authors,omitempty"` // pseudo who placed each letter
+	MoveCounts  map[string]int     `json:"move_counts,omitempty"`
+	Completion  *Completion        `json:"completion,omitempty"` // set once the grid is solved
+	History     []Move             `json:"history,omitempty"`    // every change, oldest first
+	CreatedAt   time.Time          `json:"created_at"`
+	mu          sync.Mutex
+}
+
+// Move is one entry of a game's history.
+type Move struct {
+	Seq    int       `json:"seq"` // 1-based position in the history
+	Pseudo string    `json:"pseudo"`
+	Row    int       `json:"row"`
+	Col    int       `json:"col"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	At     time.Time `json:"at"`
+	Kind   string    `json:"kind,omitempty"` // "" for a regular move, "undo" or "redo"
+	Ref    int       `json:"ref,omitempty"`  // seq of the move undone or redone
+}
+
+// Completion records how a game ended. Once set, the board is frozen.
+type Completion struct {
+	At             time.Time     `json:"at"`
+	ElapsedSeconds int           `json:"elapsed_seconds"`
+	Stats          []PlayerStats `json:"stats"`
+}
+
+// PlayerStats is a player's contribution to a completed game.
+type PlayerStats struct {
+	Pseudo  string `json:"pseudo"`
+	Letters int    `json:"letters"` // letters of the final grid placed by the player
+	Moves   int    `json:"moves"`   // letters placed or erased, including overwritten ones
 }
 
 // playerColors is the palette assigned to players in order.
@@ -53,16 +102,266 @@ func (g *GameSession) RemovePlayer(pseudo string) {
 	delete(g.Players, pseudo)
 }
 
-// SetCell sets a letter at a given position. Returns false if out of bounds.
+// HasPlayer reports whether pseudo is currently in the session.
+func (g *GameSession) HasPlayer(pseudo string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.Players[pseudo]
+	return ok
+}
+
+// GetPlayers returns a copy of the players map.
+func (g *GameSession) GetPlayers() map[string]*Player {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cp := make(map[string]*Player, len(g.Players))
+	for k, p := range g.Players {
+		cp[k] = p
+	}
+	return cp
+}
+
+// SetCell sets a letter at a given position without recording who placed it.
+// Returns false if out of bounds or if the game is completed.
 func (g *GameSession) SetCell(row, col int, value string) bool {
+	return g.Play("", row, col, value) == nil
+}
+
+// Play sets a letter at a given position on behalf of a player.
+func (g *GameSession) Play(pseudo string, row, col int, value string) error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	if g.Completion != nil {
+		return errGameCompleted
+	}
 	if row < 0 || row >= len(g.State) || col < 0 || col >= len(g.State[0]) {
-		return false
+		return errOutOfBounds
+	}
+	if g.State[row][col] == value {
+		return nil // nothing changes: not a move
+	}
+	g.record(Move{Pseudo: pseudo, Row: row, Col: col, New: value})
+	g.setCell(row, col, value, pseudo)
+
+	if pseudo != "" {
+		if g.MoveCounts == nil {
+			g.MoveCounts = make(map[string]int)
+		}
+		g.MoveCounts[pseudo]++
+	}
+	return nil
+}
+
+// Undo reverts the last move of pseudo that is not already undone.
+// It fails if another player changed the cell in the meantime.
+func (g *GameSession) Undo(pseudo string) (Move, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Completion != nil {
+		return Move{}, errGameCompleted
+	}
+	done, _ := g.undoStacks(pseudo)
+	if len(done) == 0 {
+		return Move{}, errNothingToUndo
+	}
+	target := g.History[done[len(done)-1]-1]
+	if g.State[target.Row][target.Col] != target.New {
+		return Move{}, errCellChanged
+	}
+
+	m := g.record(Move{Pseudo: pseudo, Row: target.Row, Col: target.Col, New: target.Old, Kind: moveUndo, Ref: target.Seq})
+	g.setCell(target.Row, target.Col, target.Old, g.authorBefore(target))
+	return m, nil
+}
+
+// Redo re-applies the last move of pseudo undone by Undo, as long as the
+// player has not made a new move since.
+func (g *GameSession) Redo(pseudo string) (Move, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Completion != nil {
+		return Move{}, errGameCompleted
+	}
+	_, undone := g.undoStacks(pseudo)
+	if len(undone) == 0 {
+		return Move{}, errNothingToRedo
+	}
+	target := g.History[undone[len(undone)-1]-1]
+	if g.State[target.Row][target.Col] != target.Old {
+		return Move{}, errCellChanged
+	}
+
+	m := g.record(Move{Pseudo: pseudo, Row: target.Row, Col: target.Col, New: target.New, Kind: moveRedo, Ref: target.Seq})
+	g.setCell(target.Row, target.Col, target.New, pseudo)
+	return m, nil
+}
+
+// GetHistory returns a copy of the moves with a sequence number above since.
+func (g *GameSession) GetHistory(since int) []Move {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if since < 0 {
+		since = 0
 	}
+	if since > len(g.History) {
+		since = len(g.History)
+	}
+	return append([]Move{}, g.History[since:]...)
+}
+
+// record appends a move to the history, filling in its sequence number,
+// previous value and timestamp. Caller must hold g.mu.
+func (g *GameSession) record(m Move) Move {
+	m.Seq = len(g.History) + 1
+	m.Old = g.State[m.Row][m.Col]
+	m.At = time.Now()
+	g.History = append(g.History, m)
+	return m
+}
+
+// setCell writes a letter and its author. Caller must hold g.mu.
+func (g *GameSession) setCell(row, col int, value, author string) {
 	g.State[row][col] = value
-	return true
+
+	if g.Authors == nil {
+		g.Authors = make([][]string, len(g.State))
+		for i, r := range g.State {
+			g.Authors[i] = make([]string, len(r))
+		}
+	}
+	if value == "" {
+		g.Authors[row][col] = ""
+	} else {
+		g.Authors[row][col] = author
+	}
+}
+
+// undoStacks replays the history of pseudo and returns the sequence numbers
+// of the moves that can be undone and redone, most recent last.
+// Caller must hold g.mu.
+func (g *GameSession) undoStacks(pseudo string) (done, undone []int) {
+	for _, m := range g.History {
+		if m.Pseudo != pseudo {
+			continue
+		}
+		switch m.Kind {
+		case moveUndo:
+			done = done[:len(done)-1]
+			undone = append(undone, m.Ref)
+		case moveRedo:
+			undone = undone[:len(undone)-1]
+			done = append(done, m.Ref)
+		default:
+			done = append(done, m.Seq)
+			undone = nil // a new move discards what could be redone
+		}
+	}
+	return done, undone
+}
+
+// authorBefore returns who wrote the value that m replaced, by looking for
+// the previous change of the same cell. Caller must hold g.mu.
+func (g *GameSession) authorBefore(m Move) string {
+	for i := m.Seq - 2; i >= 0; i-- {
+		prev := g.History[i]
+		if prev.Row != m.Row || prev.Col != m.Col {
+			continue
+		}
+		if prev.Kind == moveUndo {
+			return g.authorBefore(g.History[prev.Ref-1])
+		}
+		return prev.Pseudo
+	}
+	return ""
+}
+
+// CheckCompletion freezes the game if every letter cell of grid is filled
+// (and correct, when the grid has a solution). It returns the completion
+// only on the call that completes the game, nil otherwise.
+func (g *GameSession) CheckCompletion(grid *Grid) *Completion {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Completion != nil || len(grid.Cells) != len(g.State) {
+		return nil
+	}
+	for i, row := range grid.Cells {
+		if len(row) != len(g.State[i]) {
+			return nil
+		}
+		for j, cell := range row {
+			if cell.Black {
+				continue
+			}
+			value := g.State[i][j]
+			if value == "" || (grid.HasSolution && value != cell.Solution) {
+				return nil
+			}
+		}
+	}
+
+	now := time.Now()
+	g.Completion = &Completion{
+		At:             now,
+		ElapsedSeconds: int(now.Sub(g.CreatedAt).Seconds()),
+		Stats:          g.stats(),
+	}
+	return g.Completion
+}
+
+// Completed returns the game completion, or nil while the game is running.
+func (g *GameSession) Completed() *Completion {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.Completion
+}
+
+// MarshalSnapshot encodes a consistent JSON snapshot of the session,
+// for stores that write sessions out.
+func (g *GameSession) MarshalSnapshot() ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return json.Marshal(g)
+}
+
+// stats computes per-player contributions. Caller must hold g.mu.
+func (g *GameSession) stats() []PlayerStats {
+	byPseudo := make(map[string]*PlayerStats)
+	get := func(pseudo string) *PlayerStats {
+		ps, ok := byPseudo[pseudo]
+		if !ok {
+			ps = &PlayerStats{Pseudo: pseudo}
+			byPseudo[pseudo] = ps
+		}
+		return ps
+	}
+	for _, row := range g.Authors {
+		for _, pseudo := range row {
+			if pseudo != "" {
+				get(pseudo).Letters++
+			}
+		}
+	}
+	for pseudo, n := range g.MoveCounts {
+		get(pseudo).Moves = n
+	}
+
+	list := make([]PlayerStats, 0, len(byPseudo))
+	for _, ps := range byPseudo {
+		list = append(list, *ps)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Letters != list[j].Letters {
+			return list[i].Letters > list[j].Letters
+		}
+		return list[i].Pseudo < list[j].Pseudo
+	})
+	return list
 }
 
 // GetState returns a copy of the current game state.
@@ -77,3 +376,34 @@ func (g *GameSession) GetState() [][]string {
 	}
 	return cp
 }
+
+// Position identifies a cell in the grid.
+type Position struct {
+	Row int `json:"row"`
+	Col int `json:"col"`
+}
+
+// Check compares the filled cells against the grid solution and returns the
+// positions holding a wrong letter. Empty cells are not reported.
+func (g *GameSession) Check(grid *Grid) (wrong []Position, filled int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	wrong = []Position{}
+	for i, row := range g.State {
+		for j, value := range row {
+			if value == "" || i >= len(grid.Cells) || j >= len(grid.Cells[i]) {
+				continue
+			}
+			cell := grid.Cells[i][j]
+			if cell.Black {
+				continue
+			}
+			filled++
+			if cell.Solution != "" && cell.Solution != value {
+				wrong = append(wrong, Position{Row: i, Col: j})
+			}
+		}
+	}
+	return wrong, filled
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-
-	"google.golang.org/genai"
+	"io"
+	"reflect"
+	"strings"
 )
 
 const analyzePrompt = `Analyse cette photo de grille de mots fléchés.
@@ -14,10 +16,11 @@ Extrais la structure complète au format JSON suivant :
 {
   "rows": <nombre de lignes>,
   "cols": <nombre de colonnes>,
+  "bounds": {"x": 0.1, "y": 0.2, "width": 0.8, "height": 0.6},
   "cells": [
     [
-      {"black": true, "definitions": [{"text": "Définition", "direction": "right"}]},
-      {"black": false},
+      {"black": true, "confidence": 0.95, "definitions": [{"text": "Définition", "direction": "right", "confidence": 0.9}]},
+      {"black": false, "confidence": 0.99},
       ...
     ],
     ...
@@ -26,44 +29,191 @@ Extrais la structure complète au format JSON suivant :
 
 Règles :
 - Chaque case contenant du texte et/ou une flèche est une case définition : "black": true avec "definitions".
-- "direction" vaut "right" si la flèche pointe vers la droite, "down" si elle pointe vers le bas.
-- Une case définition peut avoir 1 ou 2 définitions (une vers la droite, une vers le bas).
+- "direction" est le sens dans lequel le mot s'écrit : "right" (vers la droite) ou "down" (vers le bas).
+- "start" est le côté de la case définition où commence le mot, quand ce n'est pas celui de "direction" (flèche coudée) :
+  - flèche qui part vers le bas puis tourne vers la droite (↳) : {"direction": "right", "start": "down"} — le mot commence dans la case en dessous et s'écrit vers la droite ;
+  - flèche qui part vers la droite puis tourne vers le bas (↴) : {"direction": "down", "start": "right"} — le mot commence dans la case à droite et s'écrit vers le bas ;
+  - pour une flèche droite, omets "start".
+- Une case définition peut avoir 1 ou 2 définitions, chacune avec sa propre flèche.
 - Les cases vides (où le joueur écrit) ont "black": false et pas de "definitions".
+- "confidence" (de 0 à 1) indique ta certitude : pour une case, qu'il s'agit bien d'une case définition ou d'une case lettre ; pour une définition, que son texte et sa flèche sont lus exactement. Baisse-la pour un texte flou, coupé, masqué par un pli ou une ombre.
+- "bounds" est le rectangle occupé par la grille sur la photo, en fractions de la largeur et de la hauteur de l'image (de 0 à 1) : "x" et "y" pour le coin supérieur gauche, "width" et "height" pour la taille.
+- Réponds UNIQUEMENT avec le JSON, sans commentaire ni markdown.`
+
+const analyzeClassicPrompt = `Analyse cette photo de grille de mots croisés : cases blanches et cases noires, lignes et colonnes numérotées, définitions imprimées à côté de la grille.
+
+Extrais la structure complète au format JSON suivant :
+{
+  "rows": <nombre de lignes>,
+  "cols": <nombre de colonnes>,
+  "bounds": {"x": 0.1, "y": 0.2, "width": 0.8, "height": 0.6},
+  "cells": [
+    [{"black": false, "confidence": 0.99}, {"black": true, "confidence": 0.95}, ...],
+    ...
+  ],
+  "clues": {
+    "horizontal": [{"number": 1, "texts": ["Définition du 1er mot de la ligne", "Définition du 2e mot"], "confidence": 0.9}, ...],
+    "vertical": [{"number": 1, "texts": ["Définition du 1er mot de la colonne"], "confidence": 0.8}, ...]
+  }
+}
+
+Règles :
+- Les cases noires ont "black": true, les cases blanches (où le joueur écrit) "black": false. Aucune case n'a de "definitions".
+- "horizontal" regroupe les définitions par ligne, "vertical" par colonne. "number" est le rang de la ligne ou de la colonne en partant de 1, que la grille les numérote en chiffres romains (I, II, III…), en chiffres arabes ou par des lettres.
+- Quand une ligne ou une colonne contient plusieurs mots, ses définitions sont séparées par un tiret ou un point : donne-les séparément dans "texts", dans l'ordre de lecture (de gauche à droite, de haut en bas), une par mot de deux lettres ou plus.
+- Recopie le texte des définitions sans leur numéro.
+- "confidence" (de 0 à 1) indique ta certitude : pour une case, qu'elle est bien noire ou blanche ; pour une ligne ou une colonne de définitions, que leurs textes sont lus exactement et attribués aux bons mots. Baisse-la pour un texte flou, coupé, masqué par un pli ou une ombre.
+- "bounds" est le rectangle occupé par la grille sur la photo, en fractions de la largeur et de la hauteur de l'image (de 0 à 1) : "x" et "y" pour le coin supérieur gauche, "width" et "height" pour la taille.
 - Réponds UNIQUEMENT avec le JSON, sans commentaire ni markdown.`
 
-// AnalyzeImage sends an image to Gemini Flash and returns the extracted grid.
-func (g *GeminiClient) AnalyzeImage(ctx context.Context, imageData []byte, mimeType string) (*Grid, error) {
-	resp, err := g.client.Models.GenerateContent(ctx, g.modelName,
-		[]*genai.Content{{
-			Role: "user",
-			Parts: []*genai.Part{
-				{Text: analyzePrompt},
-				{InlineData: &genai.Blob{MIMEType: mimeType, Data: imageData}},
-			},
-		}},
-		&genai.GenerateContentConfig{
-			Temperature:      genai.Ptr(float32(0.1)),
-			TopP:             genai.Ptr(float32(1)),
-			ResponseMIMEType: "application/json",
-		},
-	)
+// AnalyzeImage sends an image to Gemini Flash and returns the extracted grid,
+// using the prompt for the expected kind of grid.
+func (g *GeminiClient) AnalyzeImage(ctx context.Context, imageData []byte, mimeType, kind string) (*Grid, error) {
+	prompt := analyzePrompt
+	if kind == KindClassic {
+		prompt = analyzeClassicPrompt
+	}
+	var grid Grid
+	err := g.generateJSON(ctx, "analyze", prompt, gridSchema(kind), []Photo{{imageData, mimeType}}, func(text string) error {
+		grid = Grid{}
+		if err := json.Unmarshal([]byte(text), &grid); err != nil {
+			return fmt.Errorf("parse grid JSON: %w", err)
+		}
+		if grid.Rows == 0 || grid.Cols == 0 || len(grid.Cells) == 0 {
+			return fmt.Errorf("%w: %dx%d grid with %d cell rows", errInvalidAnswer, grid.Rows, grid.Cols, len(grid.Cells))
+		}
+		if kind == KindClassic {
+			grid.Kind = KindClassic
+		}
+		if _, err := grid.Clone().Validate(); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidAnswer, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("gemini generate: %w", err)
+		return nil, err
+	}
+	return &grid, nil
+}
+
+const analyzePartsPrompt = `Les %d photos jointes montrent une même grille, photographiée en plusieurs morceaux, dans l'ordre : par exemple la moitié haute puis la moitié basse, la partie gauche puis la partie droite, ou la grille puis une page séparée de définitions.
+
+Lis chaque photo séparément et réponds au format {"parts": [...]}, avec un élément par photo, dans l'ordre des photos, chacun au format décrit plus bas pour une photo :
+- Recopie toutes les lignes et colonnes visibles sur chaque photo, même celles déjà vues sur la photo précédente : les morceaux sont assemblés ensuite d'après ces recouvrements.
+- Une photo sans cases (page de définitions seule) a "rows": 0, "cols": 0 et "cells": [].
+- Les numéros de lignes et de colonnes des définitions sont ceux de la grille entière, tels qu'imprimés.
+
+Format pour une photo :
+
+%s`
+
+// AnalyzeImages sends the photos of a grid photographed in several parts
+// to Gemini in one request, and returns the grid read on each photo. The
+// answer is checked to assemble into one grid.
+func (g *GeminiClient) AnalyzeImages(ctx context.Context, photos []Photo, kind string) ([]*Grid, error) {
+	prompt := analyzePrompt
+	if kind == KindClassic {
+		prompt = analyzeClassicPrompt
 	}
+	prompt = fmt.Sprintf(analyzePartsPrompt, len(photos), prompt)
 
-	text := resp.Text()
-	if text == "" {
-		return nil, fmt.Errorf("empty gemini response")
+	var answer struct {
+		Parts []*Grid `json:"parts"`
+	}
+	err := g.generateJSON(ctx, "analyze parts", prompt, partsSchema(kind), photos, func(text string) error {
+		answer.Parts = nil
+		if err := json.Unmarshal([]byte(text), &answer); err != nil {
+			return fmt.Errorf("parse grid parts JSON: %w", err)
+		}
+		if len(answer.Parts) != len(photos) {
+			return fmt.Errorf("%w: %d grids for %d photos", errInvalidAnswer, len(answer.Parts), len(photos))
+		}
+		for _, part := range answer.Parts {
+			if part == nil {
+				return fmt.Errorf("%w: null grid", errInvalidAnswer)
+			}
+			if kind == KindClassic {
+				part.Kind = KindClassic
+			}
+		}
+		merged, _, err := mergeGrids(answer.Parts)
+		if err == nil {
+			_, err = merged.Validate()
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidAnswer, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return answer.Parts, nil
+}
 
-	var grid Grid
-	if err := json.Unmarshal([]byte(text), &grid); err != nil {
-		return nil, fmt.Errorf("parse grid JSON: %w\nraw response: %s", err, text)
+// Describe names the models asked and identifies the prompts and response
+// schemas of the grid analysis: any change to them gives another Prompt.
+func (g *GeminiClient) Describe() AnalyzerInfo {
+	h := sha256.New()
+	for _, prompt := range []string{analyzePrompt, analyzeClassicPrompt, analyzePartsPrompt, repairPrompt} {
+		io.WriteString(h, prompt)
+	}
+	for _, kind := range []string{KindArrow, KindClassic} {
+		json.NewEncoder(h).Encode(gridSchema(kind))
 	}
+	return AnalyzerInfo{
+		Name:          "gemini",
+		Model:         g.modelName,
+		FallbackModel: g.fallbackModel,
+		Prompt:        fmt.Sprintf("%x", h.Sum(nil)[:4]),
+	}
+}
 
-	if grid.Rows == 0 || grid.Cols == 0 || len(grid.Cells) == 0 {
-		return nil, fmt.Errorf("invalid grid: %dx%d with %d cell rows", grid.Rows, grid.Cols, len(grid.Cells))
+const solutionPrompt = `Voici la page des solutions d'une grille de %d lignes et %d colonnes.
+
+Structure de la grille (une chaîne par ligne, "#" = case définition ou case noire, "." = case lettre) :
+%s
+
+Lis la solution correspondant à cette grille et réponds au format JSON suivant :
+{"rows": ["#RAT...", ...]}
+
+Règles :
+- Exactement %d chaînes de %d caractères chacune.
+- Conserve "#" pour chaque case définition ou case noire.
+- Chaque case lettre contient une lettre majuscule A-Z, sans accent.
+- Réponds UNIQUEMENT avec le JSON, sans commentaire ni markdown.`
+
+// AnalyzeSolution sends a photo of the published answers to Gemini Flash and
+// returns the expected letters for grid, one string per row.
+func (g *GeminiClient) AnalyzeSolution(ctx context.Context, imageData []byte, mimeType string, grid *Grid) ([]string, error) {
+	var layout strings.Builder
+	for _, row := range grid.Cells {
+		for _, cell := range row {
+			if cell.Black {
+				layout.WriteByte('#')
+			} else {
+				layout.WriteByte('.')
+			}
+		}
+		layout.WriteByte('\n')
 	}
+	prompt := fmt.Sprintf(solutionPrompt, grid.Rows, grid.Cols, layout.String(), grid.Rows, grid.Cols)
 
-	return &grid, nil
+	var solution struct {
+		Rows []string `json:"rows"`
+	}
+	err := g.generateJSON(ctx, "solution", prompt, schemaOf(reflect.TypeOf(solution)), []Photo{{imageData, mimeType}}, func(text string) error {
+		solution.Rows = nil
+		if err := json.Unmarshal([]byte(text), &solution); err != nil {
+			return fmt.Errorf("parse solution JSON: %w", err)
+		}
+		if err := grid.Clone().SetSolution(solution.Rows); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidAnswer, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return solution.Rows, nil
 }
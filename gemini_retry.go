@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// RetryPolicy controls how a Gemini request is retried. Each model gets
+// Attempts tries, each bounded by AttemptTimeout: overloaded or timed-out
+// calls are retried after an exponential backoff, answers that cannot be
+// decoded are sent back to the model with the error so that it corrects
+// them. When the model keeps failing, the fallback model is tried with the
+// same policy.
+type RetryPolicy struct {
+	Attempts       int           // tries per model, at least 1
+	AttemptTimeout time.Duration // per call, 0 for none
+	InitialBackoff time.Duration // before the first retry, doubled after each
+	MaxBackoff     time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:       3,
+	AttemptTimeout: 45 * time.Second,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     20 * time.Second,
+}
+
+// backoff returns the delay before retry n (from 1), with up to 50% jitter
+// so that concurrent analyses do not hit the API in step.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+const repairPrompt = `Ta réponse précédente est inutilisable : %v
+
+Corrige-la et réponds de nouveau avec le JSON complet, au format demandé, sans commentaire ni markdown.`
+
+// errInvalidAnswer marks answers the model should be asked to correct.
+var errInvalidAnswer = errors.New("invalid answer")
+
+// generateJSON sends a prompt and images to the model, asking for JSON
+// that follows schema, and passes the answer to decode, following the
+// client's retry policy. decode returns an error wrapping errInvalidAnswer
+// (or a JSON syntax error) when the answer is unusable; the model is then
+// asked to correct it. task names the request in the logs.
+func (g *GeminiClient) generateJSON(ctx context.Context, task, prompt string, schema *genai.Schema, photos []Photo, decode func(text string) error) error {
+	request := &genai.Content{Role: "user", Parts: []*genai.Part{{Text: prompt}}}
+	for _, photo := range photos {
+		request.Parts = append(request.Parts, &genai.Part{InlineData: &genai.Blob{MIMEType: photo.MIMEType, Data: photo.Data}})
+	}
+	config := &genai.GenerateContentConfig{
+		Temperature:      genai.Ptr(float32(0.1)),
+		TopP:             genai.Ptr(float32(1)),
+		ResponseMIMEType: "application/json",
+		ResponseSchema:   schema,
+	}
+
+	models := []string{g.modelName}
+	if g.fallbackModel != "" && g.fallbackModel != g.modelName {
+		models = append(models, g.fallbackModel)
+	}
+	policy := g.retry
+	policy.Attempts = max(policy.Attempts, 1)
+
+	var lastErr error
+	for _, model := range models {
+		contents := []*genai.Content{request}
+		retries := 0
+	attempts:
+		for attempt := 1; attempt <= policy.Attempts; attempt++ {
+			start := time.Now()
+			text, err := g.call(ctx, policy.AttemptTimeout, model, contents, config)
+			if err == nil {
+				if err = decode(text); err == nil {
+					log.Printf("Gemini %s: attempt %d/%d with %s succeeded in %s", task, attempt, policy.Attempts, model, time.Since(start).Round(time.Millisecond))
+					return nil
+				}
+			}
+			log.Printf("Gemini %s: attempt %d/%d with %s failed in %s: %v", task, attempt, policy.Attempts, model, time.Since(start).Round(time.Millisecond), err)
+			lastErr = err
+
+			switch {
+			case ctx.Err() != nil:
+				return fmt.Errorf("gemini %s: %w", task, ctx.Err())
+			case isInvalidAnswer(err):
+				if text == "" {
+					continue // an empty answer is simply asked again
+				}
+				// Show the model its answer and what is wrong with it.
+				contents = []*genai.Content{
+					request,
+					{Role: "model", Parts: []*genai.Part{{Text: text}}},
+					{Role: "user", Parts: []*genai.Part{{Text: fmt.Sprintf(repairPrompt, err)}}},
+				}
+			case isRetryable(err):
+				if attempt == policy.Attempts {
+					continue
+				}
+				retries++
+				select {
+				case <-time.After(policy.backoff(retries)):
+				case <-ctx.Done():
+					return fmt.Errorf("gemini %s: %w", task, ctx.Err())
+				}
+			default:
+				// Retrying the same request will not help; the fallback
+				// model may still answer it.
+				break attempts
+			}
+		}
+	}
+	return fmt.Errorf("gemini %s: %w", task, lastErr)
+}
+
+// call makes one request, bounded by timeout, and returns the text of the
+// answer.
+func (g *GeminiClient) call(ctx context.Context, timeout time.Duration, model string, contents []*genai.Content, config *genai.GenerateContentConfig) (string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resp, err := g.generate(ctx, model, contents, config)
+	if err != nil {
+		return "", fmt.Errorf("generate: %w", err)
+	}
+	text := resp.Text()
+	if text == "" {
+		return "", fmt.Errorf("%w: empty response", errInvalidAnswer)
+	}
+	return text, nil
+}
+
+// isInvalidAnswer reports whether the model answered, but not with what
+// was asked.
+func isInvalidAnswer(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.Is(err, errInvalidAnswer) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// isRetryable reports whether a failed call may succeed if made again:
+// the attempt timed out, or the API is overloaded or briefly unavailable.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
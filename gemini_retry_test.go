@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// scriptedCall is one answer of a scriptedGemini: either a text or an error.
+type scriptedCall struct {
+	text string
+	err  error
+}
+
+// scriptedGemini returns a client whose calls get the scripted answers in
+// order. It records the model and the conversation of each call.
+func scriptedGemini(t *testing.T, answers ...scriptedCall) (*GeminiClient, *[]string, *[][]*genai.Content) {
+	t.Helper()
+	var models []string
+	var requests [][]*genai.Content
+	g := &GeminiClient{
+		modelName:     "primary",
+		fallbackModel: "fallback",
+		retry:         RetryPolicy{Attempts: 2, AttemptTimeout: time.Second},
+	}
+	g.generate = func(ctx context.Context, model string, contents []*genai.Content, _ *genai.GenerateContentConfig) (*genai.GenerateContentResponse, error) {
+		if len(answers) == 0 {
+			t.Fatal("unexpected call")
+		}
+		models = append(models, model)
+		requests = append(requests, contents)
+		answer := answers[0]
+		answers = answers[1:]
+		if answer.err != nil {
+			return nil, answer.err
+		}
+		return &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{{Content: genai.NewContentFromText(answer.text, genai.RoleModel)}},
+		}, nil
+	}
+	return g, &models, &requests
+}
+
+const scriptedGrid = `{"rows": 1, "cols": 2, "cells": [[{"black": true, "definitions": [{"text": "Note", "direction": "right"}]}, {"black": false}]]}`
+
+func TestGeminiRetriesOverloadedCalls(t *testing.T) {
+	g, models, _ := scriptedGemini(t,
+		scriptedCall{err: genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"}},
+		scriptedCall{text: scriptedGrid},
+	)
+	grid, err := g.AnalyzeImage(context.Background(), []byte("png"), "image/png", KindArrow)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if grid.Rows != 1 || grid.Cols != 2 {
+		t.Fatalf("unexpected grid %dx%d", grid.Rows, grid.Cols)
+	}
+	if strings.Join(*models, ",") != "primary,primary" {
+		t.Fatalf("models = %v", *models)
+	}
+}
+
+func TestGeminiRepromptsInvalidAnswers(t *testing.T) {
+	g, _, requests := scriptedGemini(t,
+		scriptedCall{text: `{"rows": 1, "cols": 2, "cells": [[{"black": tru`},
+		scriptedCall{text: scriptedGrid},
+	)
+	if _, err := g.AnalyzeImage(context.Background(), []byte("png"), "image/png", KindArrow); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	retry := (*requests)[1]
+	if len(retry) != 3 || retry[1].Role != genai.RoleModel || retry[2].Role != genai.RoleUser {
+		t.Fatalf("expected the bad answer and a correction request, got %d contents", len(retry))
+	}
+	if !strings.Contains(retry[1].Parts[0].Text, "tru") || !strings.Contains(retry[2].Parts[0].Text, "parse grid JSON") {
+		t.Fatalf("correction request should quote the answer and the error: %q", retry[2].Parts[0].Text)
+	}
+}
+
+func TestGeminiFallsBackToSecondModel(t *testing.T) {
+	g, models, _ := scriptedGemini(t,
+		scriptedCall{err: genai.APIError{Code: 503}},
+		scriptedCall{err: genai.APIError{Code: 503}},
+		scriptedCall{text: scriptedGrid},
+	)
+	if _, err := g.AnalyzeImage(context.Background(), []byte("png"), "image/png", KindArrow); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if strings.Join(*models, ",") != "primary,primary,fallback" {
+		t.Fatalf("models = %v", *models)
+	}
+
+	// A request the API rejects is not retried on the same model.
+	g, models, _ = scriptedGemini(t,
+		scriptedCall{err: genai.APIError{Code: 400}},
+		scriptedCall{err: genai.APIError{Code: 400}},
+	)
+	_, err := g.AnalyzeImage(context.Background(), []byte("png"), "image/png", KindArrow)
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 400 {
+		t.Fatalf("expected the API error, got %v", err)
+	}
+	if strings.Join(*models, ",") != "primary,fallback" {
+		t.Fatalf("models = %v", *models)
+	}
+}
+
+func TestGeminiAttemptTimeout(t *testing.T) {
+	g, _, _ := scriptedGemini(t)
+	g.fallbackModel = ""
+	g.retry.AttemptTimeout = 10 * time.Millisecond
+	calls := 0
+	g.generate = func(ctx context.Context, _ string, _ []*genai.Content, _ *genai.GenerateContentConfig) (*genai.GenerateContentResponse, error) {
+		calls++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err := g.AnalyzeSolution(context.Background(), []byte("png"), "image/png", newTestGrid(2, 2))
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 2 {
+		t.Fatalf("expected 2 timed-out attempts, got %d calls and %v", calls, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if d := p.backoff(n); d < want/2 || d > want {
+			t.Errorf("backoff(%d) = %s, want between %s and %s", n, d, want/2, want)
+		}
+	}
+}
@@ -25,7 +25,7 @@ func TestAnalyzeImage(t *testing.T) {
 		t.Fatalf("read image: %v", err)
 	}
 
-	grid, err := client.AnalyzeImage(ctx, imageData, "image/png")
+	grid, err := client.AnalyzeImage(ctx, imageData, "image/png", KindArrow)
 	if err != nil {
 		t.Fatalf("analyze image: %v", err)
 	}
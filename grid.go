@@ -1,26 +1,248 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
 
 // Definition is a clue embedded in a definition cell (mots fléchés).
+// Its word starts in the neighbouring cell on the Start side and runs in
+// Direction. Straight arrows leave Start empty; bent arrows start below the
+// definition and run right (↳), or start on its right and run down (↴).
 type Definition struct {
-	Text      string `json:"text"`
-	Direction string `json:"direction"` // "right" or "down"
+	Text       string   `json:"text"`
+	Direction  string   `json:"direction" schema:"enum=right|down"`       // "right" or "down": where the word runs
+	Start      string   `json:"start,omitempty" schema:"enum=right|down"` // "right" or "down": where it starts, if not Direction
+	Confidence *float64 `json:"confidence,omitempty"`                     // how sure the analyzer is of the text, from 0 to 1
+}
+
+// StartSide returns the side of the definition cell where the word starts.
+func (d Definition) StartSide() string {
+	if d.Start == "" {
+		return d.Direction
+	}
+	return d.Start
+}
+
+// Bent reports whether the word starts on another side than it runs.
+func (d Definition) Bent() bool {
+	return d.StartSide() != d.Direction
+}
+
+// Grid kinds. Arrow-word grids (mots fléchés) carry their clues in
+// definition cells; classic grids (mots croisés) have plain black squares
+// and numbered clue lists printed beside the grid.
+const (
+	KindArrow   = "arrow"
+	KindClassic = "classic"
+)
+
+// NumberedClue lists the clues of one row or column of a classic grid, one
+// per word of two letters or more, in reading order.
+type NumberedClue struct {
+	Number     int      `json:"number"` // row or column, from 1
+	Texts      []string `json:"texts"`
+	Confidence *float64 `json:"confidence,omitempty"` // how sure the analyzer is of the texts, from 0 to 1
+}
+
+// NumberedClues are the clue lists of a classic grid: Horizontal is keyed
+// by row number, Vertical by column number.
+type NumberedClues struct {
+	Horizontal []NumberedClue `json:"horizontal"`
+	Vertical   []NumberedClue `json:"vertical"`
 }
 
 // Cell represents a single cell in the crossword grid.
 // A cell is either a definition cell (Black=true, with Definitions)
-// or a letter cell (Black=false, where players write).
+// or a letter cell (Black=false, where players write). In classic grids,
+// black cells are plain black squares without definitions.
 type Cell struct {
 	Black       bool         `json:"black"`
 	Definitions []Definition `json:"definitions,omitempty"`
+	Solution    string       `json:"solution,omitempty" schema:"-"` // expected letter, if known
+	Box         *Box         `json:"box,omitempty" schema:"-"`      // where the cell is on the source photo
+	Confidence  *float64     `json:"confidence,omitempty"`          // how sure the analyzer is of the cell type, from 0 to 1
+}
+
+// Box is a region of the source photo of a grid, in fractions of the width
+// and height of the photo.
+type Box struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// valid reports whether the box is not empty and lies within the photo.
+func (b *Box) valid() bool {
+	return b.Width > 0 && b.Height > 0 && b.X >= 0 && b.Y >= 0 && b.X+b.Width <= 1.001 && b.Y+b.Height <= 1.001
 }
 
 // Grid represents a crossword grid extracted from an image.
 type Grid struct {
-	ID        string     `json:"id"`
-	Rows      int        `json:"rows"`
-	Cols      int        `json:"cols"`
-	Cells     [][]Cell   `json:"cells"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID          string         `json:"id" schema:"-"`
+	Rows        int            `json:"rows"`
+	Cols        int            `json:"cols"`
+	Cells       [][]Cell       `json:"cells"`
+	Kind        string         `json:"kind,omitempty" schema:"-"`       // KindArrow (default when empty) or KindClassic
+	Clues       *NumberedClues `json:"clues,omitempty"`                 // classic grids only
+	ImageHash   string         `json:"image_hash,omitempty" schema:"-"` // SourceImage the grid was extracted from
+	Images      []string       `json:"images,omitempty" schema:"-"`     // all the photos, in order, for grids assembled from several
+	Bounds      *Box           `json:"bounds,omitempty"`                // the grid area on the photo
+	Preprocess  []string       `json:"preprocess,omitempty" schema:"-"` // steps applied to the photo before analysis
+	HasSolution bool           `json:"has_solution,omitempty" schema:"-"`
+	Version     int            `json:"version" schema:"-"` // starts at 1, incremented by each revision
+	CreatedAt   time.Time      `json:"created_at" schema:"-"`
+}
+
+// Clone returns a deep copy of the grid.
+func (g *Grid) Clone() *Grid {
+	cp := *g
+	cp.Cells = make([][]Cell, len(g.Cells))
+	for i, row := range g.Cells {
+		cp.Cells[i] = make([]Cell, len(row))
+		for j, cell := range row {
+			if cell.Definitions != nil {
+				cell.Definitions = append([]Definition(nil), cell.Definitions...)
+			}
+			cp.Cells[i][j] = cell
+		}
+	}
+	if g.Clues != nil {
+		cp.Clues = &NumberedClues{
+			Horizontal: cloneNumberedClues(g.Clues.Horizontal),
+			Vertical:   cloneNumberedClues(g.Clues.Vertical),
+		}
+	}
+	return &cp
+}
+
+func cloneNumberedClues(clues []NumberedClue) []NumberedClue {
+	if clues == nil {
+		return nil
+	}
+	cp := make([]NumberedClue, len(clues))
+	for i, c := range clues {
+		cp[i] = NumberedClue{Number: c.Number, Texts: append([]string(nil), c.Texts...), Confidence: c.Confidence}
+	}
+	return cp
+}
+
+// MapBoxes replaces the bounds of the grid and the boxes of its cells with
+// their image by fn, dropping those fn returns nil for.
+func (g *Grid) MapBoxes(fn func(*Box) *Box) {
+	if g.Bounds != nil {
+		g.Bounds = fn(g.Bounds)
+	}
+	for i := range g.Cells {
+		for j := range g.Cells[i] {
+			if cell := &g.Cells[i][j]; cell.Box != nil {
+				cell.Box = fn(cell.Box)
+			}
+		}
+	}
+}
+
+// FillCellBoxes locates on the photo the cells the analyzer did not place,
+// by dividing the grid area in equal rows and columns. Invalid boxes are
+// dropped.
+func (g *Grid) FillCellBoxes() {
+	if g.Bounds != nil && !g.Bounds.valid() {
+		g.Bounds = nil
+	}
+	for i := range g.Cells {
+		for j := range g.Cells[i] {
+			cell := &g.Cells[i][j]
+			if cell.Box != nil && !cell.Box.valid() {
+				cell.Box = nil
+			}
+			if cell.Box != nil || g.Bounds == nil || g.Rows == 0 || g.Cols == 0 {
+				continue
+			}
+			w, h := g.Bounds.Width/float64(g.Cols), g.Bounds.Height/float64(g.Rows)
+			cell.Box = &Box{X: g.Bounds.X + float64(j)*w, Y: g.Bounds.Y + float64(i)*h, Width: w, Height: h}
+		}
+	}
+}
+
+// Classic reports whether the grid is a classic numbered crossword.
+func (g *Grid) Classic() bool {
+	return g.Kind == KindClassic
+}
+
+// WithoutSolution returns the grid as shown to players: a copy with the
+// expected letters removed. Grids without a solution are returned as is.
+func (g *Grid) WithoutSolution() *Grid {
+	if !g.HasSolution {
+		return g
+	}
+	cp := g.Clone()
+	for i := range cp.Cells {
+		for j := range cp.Cells[i] {
+			cp.Cells[i][j].Solution = ""
+		}
+	}
+	return cp
+}
+
+// SetSolution fills the expected letters from one string per row.
+// Characters at definition cells are ignored (use '#' or '.' by convention);
+// every letter cell must receive a letter A-Z.
+func (g *Grid) SetSolution(rows []string) error {
+	if len(rows) != g.Rows {
+		return fmt.Errorf("solution has %d rows, grid has %d", len(rows), g.Rows)
+	}
+	letters := make([][]rune, len(rows))
+	for i, row := range rows {
+		letters[i] = []rune(row)
+		if len(letters[i]) != g.Cols {
+			return fmt.Errorf("solution row %d has %d letters, grid has %d columns", i+1, len(letters[i]), g.Cols)
+		}
+		for j, r := range letters[i] {
+			if j >= len(g.Cells[i]) || g.Cells[i][j].Black {
+				continue
+			}
+			if r >= 'a' && r <= 'z' {
+				r -= 'a' - 'A'
+				letters[i][j] = r
+			}
+			if r < 'A' || r > 'Z' {
+				return fmt.Errorf("invalid letter %q at row %d, column %d", r, i+1, j+1)
+			}
+		}
+	}
+
+	for i := range g.Cells {
+		for j := range g.Cells[i] {
+			if g.Cells[i][j].Black {
+				g.Cells[i][j].Solution = ""
+			} else {
+				g.Cells[i][j].Solution = string(letters[i][j])
+			}
+		}
+	}
+	g.HasSolution = true
+	return nil
+}
+
+// SolutionRows returns the expected letters as one string per row, with '#'
+// for definition cells and '.' for unknown letters.
+func (g *Grid) SolutionRows() []string {
+	rows := make([]string, len(g.Cells))
+	for i, row := range g.Cells {
+		buf := make([]byte, 0, len(row))
+		for _, cell := range row {
+			switch {
+			case cell.Black:
+				buf = append(buf, '#')
+			case utf8.RuneCountInString(cell.Solution) == 1:
+				buf = append(buf, cell.Solution...)
+			default:
+				buf = append(buf, '.')
+			}
+		}
+		rows[i] = string(buf)
+	}
+	return rows
 }
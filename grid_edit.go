@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Editing operations of PATCH /api/grids/{id}.
+const (
+	editToggleCell       = "toggle_cell"       // letter cell <-> definition cell
+	editAddDefinition    = "add_definition"    // append a definition to a definition cell
+	editEditDefinition   = "edit_definition"   // change the text and/or direction of a definition
+	editDeleteDefinition = "delete_definition" // remove a definition
+	editInsertRow        = "insert_row"        // insert a row of letter cells before Index
+	editDeleteRow        = "delete_row"        // remove the row Index
+	editInsertCol        = "insert_col"        // insert a column of letter cells before Index
+	editDeleteCol        = "delete_col"        // remove the column Index
+	editConfirm          = "confirm"           // mark a cell and its definitions as checked
+	editConfirmClue      = "confirm_clue"      // mark the clues of row or column Index as checked
+)
+
+// GridEdit is one correction to a grid. Row and Col address a cell; Index
+// is the definition index within the cell, or the row or column to insert
+// or delete, or whose clues are confirmed (Direction "right" for a row,
+// "down" for a column). Edited and confirmed items lose their confidence:
+// they are no longer listed for review.
+type GridEdit struct {
+	Op        string  `json:"op"`
+	Row       int     `json:"row"`
+	Col       int     `json:"col"`
+	Index     int     `json:"index"`
+	Text      *string `json:"text,omitempty"`
+	Direction *string `json:"direction,omitempty"`
+	Start     *string `json:"start,omitempty"` // "" for a straight arrow
+}
+
+// ApplyEdits applies the edits in order, then validates the result. The
+// solution is dropped if the edits leave letter cells without an expected
+// letter, since the game could no longer be checked against it.
+func (g *Grid) ApplyEdits(edits []GridEdit) ([]Problem, error) {
+	for i, e := range edits {
+		if err := g.applyEdit(e); err != nil {
+			return nil, fmt.Errorf("edit %d (%s): %w", i+1, e.Op, err)
+		}
+	}
+
+	problems, err := g.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if g.HasSolution && slices.ContainsFunc(g.SolutionRows(), func(row string) bool { return strings.Contains(row, ".") }) {
+		for i := range g.Cells {
+			for j := range g.Cells[i] {
+				g.Cells[i][j].Solution = ""
+			}
+		}
+		g.HasSolution = false
+		problems = append(problems, Problem{
+			Code:     problemSolutionDropped,
+			Message:  "La solution ne couvre plus toutes les cases, elle a été retirée",
+			Repaired: true,
+		})
+	}
+	return problems, nil
+}
+
+func (g *Grid) applyEdit(e GridEdit) error {
+	switch e.Op {
+	case editInsertRow:
+		if e.Index < 0 || e.Index > g.Rows {
+			return fmt.Errorf("row %d out of range", e.Index)
+		}
+		g.Cells = slices.Insert(g.Cells, e.Index, make([]Cell, g.Cols))
+		g.Rows++
+		return nil
+	case editDeleteRow:
+		if e.Index < 0 || e.Index >= g.Rows {
+			return fmt.Errorf("row %d out of range", e.Index)
+		}
+		if g.Rows == 1 {
+			return fmt.Errorf("cannot delete the last row")
+		}
+		g.Cells = slices.Delete(g.Cells, e.Index, e.Index+1)
+		g.Rows--
+		return nil
+	case editInsertCol:
+		if e.Index < 0 || e.Index > g.Cols {
+			return fmt.Errorf("column %d out of range", e.Index)
+		}
+		for i := range g.Cells {
+			g.Cells[i] = slices.Insert(g.Cells[i], e.Index, Cell{})
+		}
+		g.Cols++
+		return nil
+	case editDeleteCol:
+		if e.Index < 0 || e.Index >= g.Cols {
+			return fmt.Errorf("column %d out of range", e.Index)
+		}
+		if g.Cols == 1 {
+			return fmt.Errorf("cannot delete the last column")
+		}
+		for i := range g.Cells {
+			g.Cells[i] = slices.Delete(g.Cells[i], e.Index, e.Index+1)
+		}
+		g.Cols--
+		return nil
+	case editConfirmClue:
+		if g.Clues == nil || e.Direction == nil {
+			return fmt.Errorf("direction required on a classic grid")
+		}
+		clues := g.Clues.Horizontal
+		if *e.Direction == "down" {
+			clues = g.Clues.Vertical
+		} else if *e.Direction != "right" {
+			return fmt.Errorf("invalid direction %q (expected right or down)", *e.Direction)
+		}
+		for k := range clues {
+			if clues[k].Number == e.Index {
+				clues[k].Confidence = nil
+				return nil
+			}
+		}
+		return fmt.Errorf("no clues for %s %d", *e.Direction, e.Index)
+	}
+
+	if e.Row < 0 || e.Row >= g.Rows || e.Col < 0 || e.Col >= g.Cols {
+		return errOutOfBounds
+	}
+	cell := &g.Cells[e.Row][e.Col]
+
+	switch e.Op {
+	case editConfirm:
+		cell.Confidence = nil
+		for k := range cell.Definitions {
+			cell.Definitions[k].Confidence = nil
+		}
+		return nil
+	case editToggleCell:
+		if cell.Black {
+			*cell = Cell{}
+		} else {
+			*cell = Cell{Black: true}
+		}
+		return nil
+	case editAddDefinition:
+		if g.Classic() {
+			return fmt.Errorf("classic grids have no definition cells")
+		}
+		if !cell.Black {
+			return fmt.Errorf("not a definition cell")
+		}
+		if e.Text == nil || e.Direction == nil {
+			return fmt.Errorf("text and direction required")
+		}
+		def := Definition{Text: *e.Text, Direction: *e.Direction}
+		if e.Start != nil {
+			def.Start = *e.Start
+		}
+		if err := checkDefinition(def); err != nil {
+			return err
+		}
+		cell.Definitions = append(cell.Definitions, def)
+		return nil
+	case editEditDefinition, editDeleteDefinition:
+		if e.Index < 0 || e.Index >= len(cell.Definitions) {
+			return fmt.Errorf("no definition %d in this cell", e.Index)
+		}
+		if e.Op == editDeleteDefinition {
+			cell.Definitions = slices.Delete(cell.Definitions, e.Index, e.Index+1)
+			return nil
+		}
+		def := cell.Definitions[e.Index]
+		if e.Text != nil {
+			def.Text = *e.Text
+		}
+		if e.Direction != nil {
+			def.Direction = *e.Direction
+		}
+		if e.Start != nil {
+			def.Start = *e.Start
+		}
+		if err := checkDefinition(def); err != nil {
+			return err
+		}
+		def.Confidence = nil
+		cell.Definitions[e.Index] = def
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", e.Op)
+	}
+}
+
+func checkDefinition(def Definition) error {
+	if !validDirection(def.Direction) {
+		return fmt.Errorf("invalid direction %q (expected right or down)", def.Direction)
+	}
+	if def.Start != "" && !validDirection(def.Start) {
+		return fmt.Errorf("invalid start %q (expected right, down or empty)", def.Start)
+	}
+	if def.Text == "" {
+		return fmt.Errorf("empty definition text")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func ptr(s string) *string { return &s }
+
+func TestApplyEdits(t *testing.T) {
+	g := loadFixtureGrid(t)
+
+	problems, err := g.ApplyEdits([]GridEdit{
+		{Op: editEditDefinition, Row: 1, Col: 0, Index: 0, Text: ptr("Petit rongeur")},
+		{Op: editEditDefinition, Row: 0, Col: 1, Index: 0, Direction: ptr("right")},
+		{Op: editInsertCol, Index: 4},
+		{Op: editInsertRow, Index: 4},
+		{Op: editToggleCell, Row: 4, Col: 0},
+		{Op: editAddDefinition, Row: 4, Col: 0, Text: ptr("Nouveau"), Direction: ptr("right")},
+		{Op: editEditDefinition, Row: 0, Col: 3, Index: 0, Start: ptr("right")},
+		{Op: editDeleteDefinition, Row: 3, Col: 0, Index: 0},
+	})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	if g.Rows != 5 || g.Cols != 5 || len(g.Cells) != 5 || len(g.Cells[4]) != 5 {
+		t.Fatalf("expected 5x5 grid, got %dx%d", g.Rows, g.Cols)
+	}
+	if got := g.Cells[1][0].Definitions[0].Text; got != "Petit rongeur" {
+		t.Errorf("text not edited: %q", got)
+	}
+	// (0,1) now points right to another definition cell: Validate drops it.
+	if len(g.Cells[0][1].Definitions) != 0 {
+		t.Errorf("expected the impossible arrow to be dropped, got %+v", g.Cells[0][1].Definitions)
+	}
+	if len(g.Cells[4][0].Definitions) != 1 {
+		t.Errorf("definition not added: %+v", g.Cells[4][0].Definitions)
+	}
+	// (0,3) now starts on its right, in the inserted column, and runs down.
+	if defs := g.Cells[0][3].Definitions; len(defs) != 1 || defs[0].Start != "right" || defs[0].Direction != "down" {
+		t.Errorf("start not edited: %+v", defs)
+	}
+	if !g.Cells[4][0].Black || g.Cells[0][4].Black {
+		t.Error("unexpected cell types after insert/toggle")
+	}
+	if len(g.Cells[3][0].Definitions) != 0 {
+		t.Error("definition not deleted")
+	}
+
+	// New letter cells have no expected letter: the solution is dropped.
+	if g.HasSolution || g.Cells[1][1].Solution != "" {
+		t.Error("expected the incomplete solution to be removed")
+	}
+	codes := problemCodes(problems)
+	if codes[problemArrowOffGrid] != 1 || codes[problemSolutionDropped] != 1 {
+		t.Errorf("unexpected problems: %+v", problems)
+	}
+}
+
+func TestApplyEditsDelete(t *testing.T) {
+	g := loadFixtureGrid(t)
+	if _, err := g.ApplyEdits([]GridEdit{{Op: editDeleteRow, Index: 3}, {Op: editDeleteCol, Index: 3}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if g.Rows != 3 || g.Cols != 3 || len(g.Cells[0]) != 3 {
+		t.Fatalf("expected 3x3 grid, got %dx%d", g.Rows, g.Cols)
+	}
+	if !g.HasSolution || g.SolutionRows()[1] != "#RA" {
+		t.Fatalf("solution of the remaining cells should be kept: %v", g.SolutionRows())
+	}
+}
+
+func TestApplyEditsErrors(t *testing.T) {
+	for name, e := range map[string]GridEdit{
+		"unknown op":        {Op: "paint"},
+		"out of bounds":     {Op: editToggleCell, Row: 9, Col: 0},
+		"letter cell":       {Op: editAddDefinition, Row: 1, Col: 1, Text: ptr("X"), Direction: ptr("down")},
+		"bad direction":     {Op: editEditDefinition, Row: 1, Col: 0, Direction: ptr("up")},
+		"empty text":        {Op: editEditDefinition, Row: 1, Col: 0, Text: ptr("")},
+		"no definition":     {Op: editDeleteDefinition, Row: 1, Col: 0, Index: 3},
+		"insert row range":  {Op: editInsertRow, Index: 5},
+		"delete col range":  {Op: editDeleteCol, Index: -1},
+		"missing direction": {Op: editAddDefinition, Row: 0, Col: 0, Text: ptr("X")},
+		"bad start":         {Op: editEditDefinition, Row: 1, Col: 0, Start: ptr("left")},
+	} {
+		g := loadFixtureGrid(t)
+		if _, err := g.ApplyEdits([]GridEdit{e}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	g := newTestGrid(1, 1)
+	if _, err := g.ApplyEdits([]GridEdit{{Op: editDeleteRow}}); err == nil || !strings.Contains(err.Error(), "last row") {
+		t.Errorf("expected an error when deleting the last row, got %v", err)
+	}
+}
+
+func TestEditGridEndpoint(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+	game, _ := srv.store.CreateGame(grid.ID)
+	c := srv.sse.Register(game.ID)
+	defer srv.sse.Unregister(c)
+	unwatched, _ := srv.store.CreateGame(grid.ID)
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/api/grids/"+grid.ID, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	// Turn (0,1) into a definition cell.
+	w := patch(`{"version": 1, "edits": [{"op": "toggle_cell", "row": 0, "col": 1}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Grid
+		Warnings []Problem `json:"warnings"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Version != 2 || !resp.Cells[0][1].Black {
+		t.Fatalf("unexpected revision: %+v", resp.Grid)
+	}
+	// The definition at (0,0) now points to a definition cell.
+	if len(resp.Warnings) == 0 {
+		t.Fatal("expected warnings about the dropped arrow")
+	}
+
+	select {
+	case evt := <-c.ch:
+		if !strings.Contains(evt.Data, `"grid_revised"`) || !strings.Contains(evt.Data, `"version":2`) {
+			t.Fatalf("unexpected event: %s", evt.Data)
+		}
+	default:
+		t.Fatal("expected a grid_revised event for the game")
+	}
+	if _, ok := srv.sse.logs[unwatched.ID]; ok {
+		t.Fatal("games without clients should not be notified")
+	}
+
+	// The game still plays version 1, where (0,1) is a letter cell.
+	if apiErr := srv.playMove(game, "Alice", 0, 1, "A"); apiErr != nil {
+		t.Fatalf("move on the original grid rejected: %s", apiErr.msg)
+	}
+	if apiErr := srv.playMove(game, "Alice", 0, 0, "A"); apiErr == nil {
+		t.Fatal("definition cells of the original grid should stay read-only")
+	}
+	newGame, _ := srv.store.CreateGame(grid.ID)
+	if apiErr := srv.playMove(newGame, "Alice", 0, 1, "A"); apiErr == nil {
+		t.Fatal("new games should use the revised grid")
+	}
+
+	if w := patch(`{"version": 1, "edits": [{"op": "toggle_cell", "row": 0, "col": 2}]}`); w.Code != http.StatusConflict {
+		t.Fatalf("stale version: expected 409, got %d", w.Code)
+	}
+	if w := patch(`{"edits": [{"op": "delete_row", "index": 7}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid edit: expected 400, got %d", w.Code)
+	}
+	if w := patch(`{"edits": []}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("no edits: expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetSolution(t *testing.T) {
+	g := newTestGrid(2, 3)
+	g.Cells[0][0].Black = true
+
+	if err := g.SetSolution([]string{"#ab", "CDE"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !g.HasSolution {
+		t.Fatal("expected HasSolution after SetSolution")
+	}
+	if g.Cells[0][1].Solution != "A" || g.Cells[1][2].Solution != "E" {
+		t.Fatalf("letters not stored in uppercase: %q %q", g.Cells[0][1].Solution, g.Cells[1][2].Solution)
+	}
+	if g.Cells[0][0].Solution != "" {
+		t.Fatal("definition cells should not get a letter")
+	}
+	if got := g.SolutionRows(); got[0] != "#AB" || got[1] != "CDE" {
+		t.Fatalf("unexpected solution rows: %v", got)
+	}
+}
+
+func TestSetSolutionErrors(t *testing.T) {
+	g := newTestGrid(2, 2)
+
+	cases := map[string][]string{
+		"missing row":  {"AB"},
+		"short row":    {"AB", "C"},
+		"digit":        {"AB", "C1"},
+		"black letter": {"AB", "#D"},
+	}
+	for name, rows := range cases {
+		if err := g.SetSolution(rows); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if g.HasSolution {
+		t.Fatal("failed SetSolution should leave the grid unchanged")
+	}
+}
+
+func TestWithoutSolution(t *testing.T) {
+	g := newTestGrid(1, 2)
+	if g.WithoutSolution() != g {
+		t.Fatal("grid without solution should be returned as is")
+	}
+
+	g.SetSolution([]string{"OK"})
+	public := g.WithoutSolution()
+	if public.Cells[0][0].Solution != "" {
+		t.Fatal("public grid should not expose the solution")
+	}
+	if g.Cells[0][0].Solution != "O" {
+		t.Fatal("WithoutSolution should not modify the original grid")
+	}
+}
+
+func TestFillCellBoxes(t *testing.T) {
+	g := newTestGrid(2, 4)
+	g.Bounds = &Box{X: 0.1, Y: 0.2, Width: 0.8, Height: 0.6}
+	g.Cells[0][0].Box = &Box{X: 0.5, Y: 0.5, Width: 0.1, Height: 0.1} // placed by the analyzer
+	g.Cells[0][1].Box = &Box{X: 0.9, Y: 0.5, Width: 0.5, Height: 0.1} // off the photo
+	g.FillCellBoxes()
+
+	if *g.Cells[0][0].Box != (Box{X: 0.5, Y: 0.5, Width: 0.1, Height: 0.1}) {
+		t.Fatalf("analyzer box should be kept, got %+v", g.Cells[0][0].Box)
+	}
+	if got, want := g.Cells[1][2].Box, (Box{X: 0.5, Y: 0.5, Width: 0.2, Height: 0.3}); !boxNear(got, want) {
+		t.Fatalf("cell (1, 2) box = %+v, want %+v", got, want)
+	}
+	if got, want := g.Cells[0][1].Box, (Box{X: 0.3, Y: 0.2, Width: 0.2, Height: 0.3}); !boxNear(got, want) {
+		t.Fatalf("invalid box should be replaced by the computed one, got %+v", got)
+	}
+
+	// Without bounds, only the analyzer boxes are kept.
+	g = newTestGrid(1, 2)
+	g.Cells[0][0].Box = &Box{X: 0.1, Y: 0.1, Width: 0.1, Height: 0.1}
+	g.FillCellBoxes()
+	if g.Cells[0][0].Box == nil || g.Cells[0][1].Box != nil {
+		t.Fatal("expected boxes left as given without bounds")
+	}
+}
+
+func boxNear(got *Box, want Box) bool {
+	const eps = 1e-9
+	return got != nil && math.Abs(got.X-want.X) < eps && math.Abs(got.Y-want.Y) < eps &&
+		math.Abs(got.Width-want.Width) < eps && math.Abs(got.Height-want.Height) < eps
+}
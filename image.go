@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"maps"
+	"math/bits"
+	"time"
+)
+
+// SourceImage is an uploaded photo, stored under the SHA-256 of its bytes.
+// The same photo is analyzed once per kind of grid: Grids records the grid
+// extracted from it for each kind, and the photo is kept so that the
+// extraction can be run again later and players can look at the paper.
+type SourceImage struct {
+	Hash      string            `json:"hash"`            // hex SHA-256 of Data
+	PHash     uint64            `json:"phash,omitempty"` // perceptual hash, 0 if the image could not be decoded
+	MIMEType  string            `json:"mime_type"`
+	Size      int               `json:"size"`
+	Width     int               `json:"width,omitempty"`
+	Height    int               `json:"height,omitempty"`
+	Grids     map[string]string `json:"grids,omitempty"` // grid ID by kind
+	CreatedAt time.Time         `json:"created_at"`
+	Data      []byte            `json:"-"` // without metadata, upright
+	Preview   []byte            `json:"-"` // downscaled JPEG, nil if the image could not be decoded
+}
+
+// NewSourceImage cleans an uploaded image (see cleanUpload), hashes it and
+// computes its downscaled variant.
+func NewSourceImage(data []byte, mimeType string) *SourceImage {
+	data, img := cleanUpload(data)
+	sum := sha256.Sum256(data)
+	src := &SourceImage{
+		Hash:      hex.EncodeToString(sum[:]),
+		MIMEType:  mimeType,
+		Size:      len(data),
+		CreatedAt: time.Now(),
+		Data:      data,
+	}
+	if img != nil {
+		small := resizeImage(img, previewMaxSize)
+		src.Width, src.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		src.PHash = perceptualHash(small)
+		src.Preview = encodePreview(small)
+	}
+	return src
+}
+
+// clone returns a copy of the image that shares its (immutable) data.
+func (img *SourceImage) clone() *SourceImage {
+	cp := *img
+	cp.Grids = maps.Clone(img.Grids)
+	return &cp
+}
+
+// perceptualHash computes the difference hash (dHash) of an image: the
+// image is reduced to 9x8 gray levels and each bit tells whether a pixel is
+// brighter than its right neighbour. Photos of the same page, recompressed
+// or resized, differ by a few bits at most. Images too small to be reduced
+// get 0.
+func perceptualHash(img image.Image) uint64 {
+	b := img.Bounds()
+	if b.Dx() < 9 || b.Dy() < 8 {
+		return 0
+	}
+
+	// Average the gray level of each of the 9x8 areas.
+	var sums [8][9]uint64
+	var counts [8][9]uint64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := (y - b.Min.Y) * 8 / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			col := (x - b.Min.X) * 9 / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sums[row][col] += (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+			counts[row][col]++
+		}
+	}
+
+	var hash uint64
+	for row := range 8 {
+		for col := range 8 {
+			left := sums[row][col] / counts[row][col]
+			right := sums[row][col+1] / counts[row][col+1]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hammingDistance counts the bits that differ between two hashes.
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
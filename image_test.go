@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testPhoto draws a page-like image: a grid of dark squares on white,
+// shifted by offset so that two offsets give different pictures.
+func testPhoto(w, h, offset int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := color.Gray{Y: 240}
+			if ((x*7/w)+(y*5/h)+offset)%3 == 0 {
+				c = color.Gray{Y: uint8(40 + 100*x/w)}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 60}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPerceptualHash(t *testing.T) {
+	original := NewSourceImage(encodePNG(t, testPhoto(360, 300, 0)), "image/png")
+	if original.PHash == 0 || original.Width != 360 || original.Height != 300 {
+		t.Fatalf("expected a hash and the size of a PNG image, got %+v", original)
+	}
+	// Same page, resized and recompressed.
+	copied := NewSourceImage(encodeJPEG(t, testPhoto(180, 150, 0)), "image/jpeg")
+	if d := hammingDistance(original.PHash, copied.PHash); d > 4 {
+		t.Fatalf("near-identical images differ by %d bits", d)
+	}
+
+	other := NewSourceImage(encodePNG(t, testPhoto(360, 300, 1)), "image/png")
+	if d := hammingDistance(original.PHash, other.PHash); d < 10 {
+		t.Fatalf("different images differ by only %d bits", d)
+	}
+
+	if img := NewSourceImage([]byte("not an image"), "image/png"); img.PHash != 0 || img.Preview != nil {
+		t.Fatal("expected no hash nor preview for undecodable data")
+	}
+}
+
+func TestUploadReusesAnalyzedImage(t *testing.T) {
+	srv := newFixtureServer(t)
+	photo := encodePNG(t, testPhoto(360, 300, 0))
+
+	first := analyzeUpload(t, srv, newUploadRequest(t, "image/png", photo))
+	grid := srv.store.GetGrid(first.GridID)
+	if grid == nil || grid.ImageHash == "" {
+		t.Fatalf("expected the grid to refer to its image, got %+v", grid)
+	}
+	if img := srv.store.GetImage(grid.ImageHash); img == nil || !bytes.Equal(img.Data, photo) {
+		t.Fatal("the original image should be stored")
+	}
+
+	// The same bytes: the existing grid, without analysis.
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newUploadRequest(t, "image/png", photo))
+	if w.Code != http.StatusOK {
+		t.Fatalf("second upload: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	if job.State != jobDone || !job.Cached || job.GridID != grid.ID {
+		t.Fatalf("expected a cached job for grid %s, got %+v", grid.ID, job)
+	}
+
+	// A recompressed copy is a new image unless near-identical images are
+	// matched.
+	resized := encodeJPEG(t, testPhoto(180, 150, 0))
+	if other := analyzeUpload(t, srv, newUploadRequest(t, "image/jpeg", resized)); other.GridID == grid.ID {
+		t.Fatal("near-identical images should not be matched by default")
+	}
+	srv.imageMatchDistance = 4
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, newUploadRequest(t, "image/jpeg", encodeJPEG(t, testPhoto(200, 170, 0))))
+	json.NewDecoder(w.Body).Decode(&job)
+	if w.Code != http.StatusOK || !job.Cached {
+		t.Fatalf("expected a near-identical image to reuse a grid, got %d: %+v", w.Code, job)
+	}
+
+	if n := len(srv.store.ListGrids()); n != 2 {
+		t.Fatalf("expected 2 grids, got %d", n)
+	}
+}
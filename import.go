@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxImportSize bounds the width and height of imported grids.
+const maxImportSize = 100
+
+var errUnknownFormat = errors.New("unrecognized file format (expected ipuz, .puz or XD)")
+
+// numberedClue is a clue of a classic crossword, attached to the word
+// starting at the cell numbered Number.
+type numberedClue struct {
+	Direction string // "right" (across) or "down"
+	Number    int
+	Text      string
+	Start     *Position // explicit start cell, when the file gives one
+}
+
+// numberedPuzzle is the common form of the classic crossword formats we
+// import: a grid of blocks and letters with numbered across/down clues.
+type numberedPuzzle struct {
+	Rows, Cols int
+	Black      [][]bool
+	Solution   [][]string // expected letters, "" when unknown
+	Numbers    [][]int    // cell numbers, 0 for none; computed if nil
+	Clues      []numberedClue
+}
+
+// ImportGrid converts a crossword file to a Grid. The format is detected
+// from the content: .puz files start with a binary header, ipuz documents
+// are JSON and anything else is parsed as XD.
+func ImportGrid(data []byte) (*Grid, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case isPuz(data):
+		return importPuz(data)
+	case bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("ipuz(")):
+		return ImportIPUZ(trimmed)
+	case len(trimmed) > 0 && isText(trimmed):
+		p, err := parseXD(string(trimmed))
+		if err != nil {
+			return nil, err
+		}
+		return p.toGrid()
+	default:
+		return nil, errUnknownFormat
+	}
+}
+
+// isText reports whether data looks like UTF-8 text rather than a binary file.
+func isText(data []byte) bool {
+	return !bytes.ContainsRune(data, 0) && strings.ToValidUTF8(string(data), "�") == string(data)
+}
+
+func checkImportSize(rows, cols int) error {
+	if rows < 1 || cols < 1 || rows > maxImportSize || cols > maxImportSize {
+		return fmt.Errorf("invalid grid size %dx%d (max %d)", rows, cols, maxImportSize)
+	}
+	return nil
+}
+
+// standardNumbers numbers the cells starting an across or down word of at
+// least two letters, in reading order, as in a classic crossword.
+func standardNumbers(black [][]bool) [][]int {
+	numbers := make([][]int, len(black))
+	n := 0
+	for i, row := range black {
+		numbers[i] = make([]int, len(row))
+		for j, b := range row {
+			if b {
+				continue
+			}
+			if across, down := startsWord(black, i, j); across || down {
+				n++
+				numbers[i][j] = n
+			}
+		}
+	}
+	return numbers
+}
+
+// startsWord reports whether the letter cell (i, j) starts an across or a
+// down word of at least two letters.
+func startsWord(black [][]bool, i, j int) (across, down bool) {
+	row := black[i]
+	across = (j == 0 || row[j-1]) && j+1 < len(row) && !row[j+1]
+	down = (i == 0 || black[i-1][j]) && i+1 < len(black) && !black[i+1][j]
+	return across, down
+}
+
+// toGrid maps the numbered clues onto definition cells: each clue goes to
+// the block just before its word. Words starting on the top or left edge
+// have no such block, so a row of definition cells is added above the grid
+// and a column on its left when needed.
+func (p *numberedPuzzle) toGrid() (*Grid, error) {
+	if p.Numbers == nil {
+		p.Numbers = standardNumbers(p.Black)
+	}
+	starts := make(map[int]Position)
+	for i, row := range p.Numbers {
+		for j, n := range row {
+			if n > 0 {
+				starts[n] = Position{Row: i, Col: j}
+			}
+		}
+	}
+
+	type placed struct {
+		clue  numberedClue
+		start Position
+	}
+	var clues []placed
+	padTop, padLeft := 0, 0
+	for _, c := range p.Clues {
+		start, ok := starts[c.Number]
+		if c.Start != nil {
+			start, ok = *c.Start, true
+		}
+		if !ok || start.Row < 0 || start.Row >= p.Rows || start.Col < 0 || start.Col >= p.Cols || p.Black[start.Row][start.Col] {
+			return nil, fmt.Errorf("clue %d %s does not match the grid", c.Number, c.Direction)
+		}
+		switch {
+		case c.Direction == "right" && start.Col == 0, c.Direction == "down" && start.Row == 0:
+			if c.Direction == "right" {
+				padLeft = 1
+			} else {
+				padTop = 1
+			}
+		case c.Direction == "right" && !p.Black[start.Row][start.Col-1],
+			c.Direction == "down" && !p.Black[start.Row-1][start.Col]:
+			return nil, fmt.Errorf("clue %d %s does not start a word", c.Number, c.Direction)
+		}
+		clues = append(clues, placed{c, start})
+	}
+
+	g := &Grid{Rows: p.Rows + padTop, Cols: p.Cols + padLeft}
+	g.Cells = make([][]Cell, g.Rows)
+	for i := range g.Cells {
+		g.Cells[i] = make([]Cell, g.Cols)
+		for j := range g.Cells[i] {
+			si, sj := i-padTop, j-padLeft
+			g.Cells[i][j].Black = si < 0 || sj < 0 || p.Black[si][sj]
+		}
+	}
+	for _, c := range clues {
+		i, j := c.start.Row+padTop, c.start.Col+padLeft
+		if c.clue.Direction == "right" {
+			j--
+		} else {
+			i--
+		}
+		cell := &g.Cells[i][j]
+		cell.Definitions = append(cell.Definitions, Definition{Text: c.clue.Text, Direction: c.clue.Direction})
+	}
+
+	p.setSolution(g, padTop, padLeft)
+	return g, nil
+}
+
+// withDefinitions builds an arrow-word grid from the puzzle blocks and the
+// given definition cells, as exported by ExportIPUZ.
+func (p *numberedPuzzle) withDefinitions(defs []IPUZDefinitionCell) (*Grid, error) {
+	g := &Grid{Rows: p.Rows, Cols: p.Cols, Cells: make([][]Cell, p.Rows)}
+	for i := range g.Cells {
+		g.Cells[i] = make([]Cell, p.Cols)
+		for j := range g.Cells[i] {
+			g.Cells[i][j].Black = p.Black[i][j]
+		}
+	}
+	for _, d := range defs {
+		i, j := d.Cell[1]-1, d.Cell[0]-1
+		if i < 0 || i >= p.Rows || j < 0 || j >= p.Cols || !p.Black[i][j] {
+			return nil, fmt.Errorf("definition cell %v is not a block", d.Cell)
+		}
+		g.Cells[i][j].Definitions = d.Definitions
+	}
+	p.setSolution(g, 0, 0)
+	return g, nil
+}
+
+// setSolution copies the puzzle solution to g, whose cell (i, j) is the
+// puzzle cell (i-padTop, j-padLeft). The solution is kept only if every
+// letter is known, since Grid.SetSolution expects a complete one.
+func (p *numberedPuzzle) setSolution(g *Grid, padTop, padLeft int) {
+	if p.Solution == nil {
+		return
+	}
+	rows := make([]string, g.Rows)
+	for i := range g.Rows {
+		var b strings.Builder
+		for j := range g.Cols {
+			si, sj := i-padTop, j-padLeft
+			switch {
+			case g.Cells[i][j].Black:
+				b.WriteByte('#')
+			case len(p.Solution[si][sj]) == 1:
+				b.WriteString(p.Solution[si][sj])
+			default:
+				return
+			}
+		}
+		rows[i] = b.String()
+	}
+	g.SetSolution(rows) // on error, the grid is imported without solution
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testXD = `Title: Test
+Author: Someone
+
+
+CAT
+A#O
+BED
+
+
+A1. Feline ~ CAT
+A3. Place to sleep ~ BED
+D1. Taxi ~ CAB
+D2. Very young child ~ TOD
+`
+
+// checkImported checks testXD converted to an arrow word: a row and a column of
+// definition cells are added for the words starting on the edges.
+func checkImported(t *testing.T, g *Grid) {
+	t.Helper()
+	if g.Rows != 4 || g.Cols != 4 {
+		t.Fatalf("expected 4x4 grid, got %dx%d", g.Rows, g.Cols)
+	}
+	defs := map[[2]int][]Definition{
+		{1, 0}: {{Text: "Feline", Direction: "right"}},
+		{3, 0}: {{Text: "Place to sleep", Direction: "right"}},
+		{0, 1}: {{Text: "Taxi", Direction: "down"}},
+		{0, 3}: {{Text: "Very young child", Direction: "down"}},
+	}
+	for i, row := range g.Cells {
+		for j, cell := range row {
+			if !reflect.DeepEqual(cell.Definitions, defs[[2]int{i, j}]) {
+				t.Errorf("cell (%d,%d) definitions = %v, want %v", i, j, cell.Definitions, defs[[2]int{i, j}])
+			}
+		}
+	}
+	if !g.Cells[2][2].Black || g.Cells[1][1].Black {
+		t.Error("blocks not preserved")
+	}
+	want := []string{"####", "#CAT", "#A#O", "#BED"}
+	if !g.HasSolution || !reflect.DeepEqual(g.SolutionRows(), want) {
+		t.Errorf("solution = %v, want %v", g.SolutionRows(), want)
+	}
+}
+
+func TestImportXD(t *testing.T) {
+	g, err := ImportGrid([]byte(testXD))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	checkImported(t, g)
+}
+
+// buildPuz encodes a minimal Across Lite file.
+func buildPuz(rows []string, clues []string) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, puzHeaderSize)
+	copy(header[0x02:], puzMagic)
+	copy(header[0x18:], "1.3\x00")
+	header[0x2C] = byte(len(rows[0]))
+	header[0x2D] = byte(len(rows))
+	binary.LittleEndian.PutUint16(header[0x2E:], uint16(len(clues)))
+	buf.Write(header)
+	for _, row := range rows {
+		buf.WriteString(strings.ReplaceAll(row, "#", "."))
+	}
+	for _, row := range rows {
+		for _, c := range row {
+			if c == '#' {
+				buf.WriteByte('.')
+			} else {
+				buf.WriteByte('-')
+			}
+		}
+	}
+	for _, s := range append([]string{"Title", "Author", "Copyright"}, clues...) {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(0) // notes
+	return buf.Bytes()
+}
+
+func TestImportPuz(t *testing.T) {
+	// Clues in reading order, across before down: 1A, 1D, 2D, 3A.
+	data := buildPuz([]string{"CAT", "A#O", "BED"}, []string{"Feline", "Taxi", "Very young child", "Place to sleep"})
+	g, err := ImportGrid(data)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	checkImported(t, g)
+
+	latin1 := buildPuz([]string{"CAT", "A#O", "BED"}, []string{"F\xe9lin", "Taxi", "Enfant", "Lit"})
+	g, err = ImportGrid(latin1)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if got := g.Cells[1][0].Definitions[0].Text; got != "Félin" {
+		t.Fatalf("expected ISO-8859-1 clue decoded, got %q", got)
+	}
+
+	if _, err := ImportGrid(buildPuz([]string{"CAT", "A#O", "BED"}, []string{"Feline"})); err == nil {
+		t.Fatal("expected an error when clues are missing")
+	}
+}
+
+func TestImportIPUZ(t *testing.T) {
+	doc := `{
+		"version": "http://ipuz.org/v2",
+		"kind": ["http://ipuz.org/crossword#1"],
+		"dimensions": {"width": 3, "height": 3},
+		"puzzle": [[1, 0, 2], [0, "#", 0], [3, 0, 0]],
+		"solution": [["C", "A", "T"], ["A", "#", "O"], ["B", "E", {"value": "D"}]],
+		"clues": {
+			"Across": [[1, "Feline"], {"number": 3, "clue": "Place to sleep"}],
+			"Down:Vertical": [[1, "Taxi"], ["2", "Very young child"]]
+		}
+	}`
+	g, err := ImportGrid([]byte(doc))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	checkImported(t, g)
+}
+
+func TestIPUZRoundTrip(t *testing.T) {
+	grid := loadFixtureGrid(t)
+	data, err := json.Marshal(ExportIPUZ(grid, nil, true))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got, err := ImportGrid(data)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if !reflect.DeepEqual(got.Cells, grid.Cells) {
+		t.Fatalf("cells differ after round trip:\ngot  %+v\nwant %+v", got.Cells, grid.Cells)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":       "",
+		"binary":      "\x00\x01\x02",
+		"not a grid":  "hello\n",
+		"bad clue":    "AB\nCD\n\nA9. Nowhere ~ XX\n",
+		"ipuz sudoku": `{"kind": ["http://ipuz.org/sudoku#1"], "dimensions": {"width": 9, "height": 9}}`,
+		"too large":   `{"kind": ["http://ipuz.org/crossword#1"], "dimensions": {"width": 1000, "height": 1000}}`,
+	} {
+		if _, err := ImportGrid([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestImportEndpoint(t *testing.T) {
+	srv := newTestServer()
+
+	req := httptest.NewRequest("POST", "/api/grids/import", strings.NewReader(testXD))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var grid Grid
+	json.NewDecoder(w.Body).Decode(&grid)
+	if grid.HasSolution != true || grid.Cells[1][1].Solution != "" {
+		t.Fatal("solution should be stored but not returned")
+	}
+	if stored := srv.store.GetGrid(grid.ID); stored == nil || !stored.HasSolution {
+		t.Fatal("imported grid should be stored with its solution")
+	}
+
+	req = httptest.NewRequest("POST", "/api/grids/import", strings.NewReader("not a crossword"))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "big.xd")
+	part.Write(bytes.Repeat([]byte("A"), maxUploadSize+1))
+	mw.Close()
+	req = httptest.NewRequest("POST", "/api/grids/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("multipart too large: expected 413, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ipuz (http://ipuz.org) is an open JSON format for puzzles, read by most
+// crossword tools. Arrow words are exported as regular crosswords: the
+// definition cells become blocks, each definition becomes a numbered clue
+// on the word it points to, and the definition cells themselves are kept
+// in an extension field so that nothing is lost on a round trip.
+
+const (
+	ipuzVersion       = "http://ipuz.org/v2"
+	ipuzKindCrossword = "http://ipuz.org/crossword#1"
+	ipuzBlock         = "#"
+)
+
+// IPUZ is the subset of an ipuz crossword document we read and write.
+type IPUZ struct {
+	Version    string                `json:"version"`
+	Kind       []string              `json:"kind"`
+	Title      string                `json:"title,omitempty"`
+	Dimensions IPUZDimensions        `json:"dimensions"`
+	Block      string                `json:"block"`
+	Empty      any                   `json:"empty"`
+	Puzzle     [][]any               `json:"puzzle"`
+	Solution   [][]any               `json:"solution,omitempty"`
+	Saved      [][]any               `json:"saved,omitempty"`
+	Clues      map[string][]IPUZClue `json:"clues"`
+	// Definitions lists the arrow-word definition cells with their clues.
+	Definitions []IPUZDefinitionCell `json:"com.github.bodul.crossword:definitions,omitempty"`
+}
+
+// IPUZDimensions is the size of an ipuz puzzle.
+type IPUZDimensions struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// IPUZClue is a clue in its object form. Cells are [column, row] pairs,
+// counted from 1 as in the ipuz specification.
+type IPUZClue struct {
+	Number int      `json:"number"`
+	Clue   string   `json:"clue"`
+	Cells  [][2]int `json:"cells,omitempty"`
+}
+
+// IPUZDefinitionCell is a definition cell of an arrow word, at Cell
+// ([column, row] counted from 1).
+type IPUZDefinitionCell struct {
+	Cell        [2]int       `json:"cell"`
+	Definitions []Definition `json:"definitions"`
+}
+
+// ipuzDirections maps definition directions to ipuz clue lists.
+var ipuzDirections = map[string]string{
+	"right": "Across",
+	"down":  "Down",
+}
+
+// ExportIPUZ converts a grid to an ipuz document. The solution is included
+// only if withSolution is set; state, if not nil, is saved as the player's
+// progress (one string per cell, as in GameSession.State).
+func ExportIPUZ(g *Grid, state [][]string, withSolution bool) *IPUZ {
+	doc := &IPUZ{
+		Version:    ipuzVersion,
+		Kind:       []string{ipuzKindCrossword},
+		Dimensions: IPUZDimensions{Width: g.Cols, Height: g.Rows},
+		Block:      ipuzBlock,
+		Empty:      0,
+		Clues:      map[string][]IPUZClue{"Across": {}, "Down": {}},
+	}
+
+	for i, row := range g.Cells {
+		for j, cell := range row {
+			if cell.Black && len(cell.Definitions) > 0 {
+				doc.Definitions = append(doc.Definitions, IPUZDefinitionCell{
+					Cell:        [2]int{j + 1, i + 1},
+					Definitions: cell.Definitions,
+				})
+			}
+		}
+	}
+
+	words := g.Words()
+	numbers := make(map[Position]int)
+	for _, w := range words {
+		if w.Definition != nil {
+			numbers[w.Start] = 0
+		}
+	}
+
+	// Number the word starts in reading order, as in a regular crossword.
+	n := 0
+	doc.Puzzle = make([][]any, g.Rows)
+	for i := range g.Rows {
+		doc.Puzzle[i] = make([]any, g.Cols)
+		for j := range g.Cols {
+			pos := Position{Row: i, Col: j}
+			switch _, start := numbers[pos]; {
+			case g.Cells[i][j].Black:
+				doc.Puzzle[i][j] = ipuzBlock
+			case start:
+				n++
+				numbers[pos] = n
+				doc.Puzzle[i][j] = n
+			default:
+				doc.Puzzle[i][j] = 0
+			}
+		}
+	}
+	for _, w := range words {
+		if w.Definition == nil {
+			continue
+		}
+		cells := make([][2]int, len(w.Cells))
+		for k, p := range w.Cells {
+			cells[k] = [2]int{p.Col + 1, p.Row + 1}
+		}
+		dir := ipuzDirections[w.Direction]
+		doc.Clues[dir] = append(doc.Clues[dir], IPUZClue{
+			Number: numbers[w.Start],
+			Clue:   w.Definition.Text,
+			Cells:  cells,
+		})
+	}
+
+	if withSolution && g.HasSolution {
+		doc.Solution = ipuzLetters(g, func(i, j int) string { return g.Cells[i][j].Solution })
+	}
+	if state != nil {
+		doc.Saved = ipuzLetters(g, func(i, j int) string {
+			if i < len(state) && j < len(state[i]) {
+				return state[i][j]
+			}
+			return ""
+		})
+	}
+	return doc
+}
+
+// ipuzLetters builds a solution or saved grid: blocks for definition
+// cells, the letter given by value elsewhere, null when there is none.
+func ipuzLetters(g *Grid, value func(i, j int) string) [][]any {
+	out := make([][]any, g.Rows)
+	for i := range g.Rows {
+		out[i] = make([]any, g.Cols)
+		for j := range g.Cols {
+			switch v := value(i, j); {
+			case g.Cells[i][j].Black:
+				out[i][j] = ipuzBlock
+			case v != "":
+				out[i][j] = v
+			}
+		}
+	}
+	return out
+}
+
+// ImportIPUZ converts an ipuz crossword to a Grid. Documents exported by
+// ExportIPUZ keep their definition cells; other crosswords have their
+// numbered clues mapped onto definition cells (see numberedPuzzle.toGrid).
+func ImportIPUZ(data []byte) (*Grid, error) {
+	// Early ipuz files wrap the document in "ipuz(...)".
+	if rest, ok := bytes.CutPrefix(data, []byte("ipuz(")); ok {
+		data = bytes.TrimSuffix(bytes.TrimSpace(rest), []byte(")"))
+	}
+
+	var doc struct {
+		Kind        []string                     `json:"kind"`
+		Dimensions  IPUZDimensions               `json:"dimensions"`
+		Block       string                       `json:"block"`
+		Puzzle      [][]any                      `json:"puzzle"`
+		Solution    [][]any                      `json:"solution"`
+		Clues       map[string][]json.RawMessage `json:"clues"`
+		Definitions []IPUZDefinitionCell         `json:"com.github.bodul.crossword:definitions"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse ipuz: %w", err)
+	}
+	if !slices.ContainsFunc(doc.Kind, func(k string) bool { return strings.HasPrefix(k, "http://ipuz.org/crossword") }) {
+		return nil, fmt.Errorf("ipuz document is not a crossword")
+	}
+	rows, cols := doc.Dimensions.Height, doc.Dimensions.Width
+	if err := checkImportSize(rows, cols); err != nil {
+		return nil, err
+	}
+	if len(doc.Puzzle) != rows {
+		return nil, fmt.Errorf("ipuz puzzle has %d rows, expected %d", len(doc.Puzzle), rows)
+	}
+	if doc.Block == "" {
+		doc.Block = ipuzBlock
+	}
+
+	p := &numberedPuzzle{Rows: rows, Cols: cols, Black: make([][]bool, rows), Numbers: make([][]int, rows)}
+	for i, row := range doc.Puzzle {
+		if len(row) != cols {
+			return nil, fmt.Errorf("ipuz puzzle row %d has %d cells, expected %d", i+1, len(row), cols)
+		}
+		p.Black[i] = make([]bool, cols)
+		p.Numbers[i] = make([]int, cols)
+		for j, v := range row {
+			switch v := ipuzCellValue(v, "cell").(type) {
+			case nil: // omitted cell
+				p.Black[i][j] = true
+			case string:
+				p.Black[i][j] = v == doc.Block
+				p.Numbers[i][j], _ = strconv.Atoi(v)
+			case float64:
+				p.Numbers[i][j] = int(v)
+			}
+		}
+	}
+	if len(doc.Solution) == rows {
+		p.Solution = make([][]string, rows)
+		for i, row := range doc.Solution {
+			p.Solution[i] = make([]string, cols)
+			for j := 0; j < cols && j < len(row); j++ {
+				if v, ok := ipuzCellValue(row[j], "value").(string); ok && v != doc.Block {
+					p.Solution[i][j] = v
+				}
+			}
+		}
+	}
+
+	if doc.Definitions != nil {
+		return p.withDefinitions(doc.Definitions)
+	}
+
+	for key, list := range doc.Clues {
+		// Clue lists are named "Across" or "Down", optionally followed by
+		// ":" and a display label.
+		name, _, _ := strings.Cut(key, ":")
+		dir, ok := map[string]string{"Across": "right", "Down": "down"}[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported ipuz clue direction %q", key)
+		}
+		for _, raw := range list {
+			c, err := parseIPUZClue(raw)
+			if err != nil {
+				return nil, err
+			}
+			c.Direction = dir
+			p.Clues = append(p.Clues, c)
+		}
+	}
+	return p.toGrid()
+}
+
+// ipuzCellValue returns the value of a puzzle or solution cell, which is
+// either given directly or as the field key of a cell object.
+func ipuzCellValue(v any, key string) any {
+	if obj, ok := v.(map[string]any); ok {
+		return obj[key]
+	}
+	return v
+}
+
+// parseIPUZClue reads a clue given as [number, text] or as an object.
+func parseIPUZClue(raw json.RawMessage) (numberedClue, error) {
+	var c numberedClue
+	var number any
+	var pair []any
+	var obj struct {
+		Number any      `json:"number"`
+		Clue   string   `json:"clue"`
+		Cells  [][2]int `json:"cells"`
+	}
+	switch {
+	case json.Unmarshal(raw, &pair) == nil && len(pair) == 2:
+		number = pair[0]
+		c.Text, _ = pair[1].(string)
+	case json.Unmarshal(raw, &obj) == nil:
+		number, c.Text = obj.Number, obj.Clue
+		if len(obj.Cells) > 0 {
+			c.Start = &Position{Row: obj.Cells[0][1] - 1, Col: obj.Cells[0][0] - 1}
+		}
+	default:
+		return c, fmt.Errorf("unsupported ipuz clue: %s", raw)
+	}
+
+	switch n := number.(type) {
+	case float64:
+		c.Number = int(n)
+	case string:
+		var err error
+		if c.Number, err = strconv.Atoi(n); err != nil {
+			return c, fmt.Errorf("unsupported ipuz clue number %q", n)
+		}
+	default:
+		return c, fmt.Errorf("ipuz clue without number: %s", raw)
+	}
+	return c, nil
+}
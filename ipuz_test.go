@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func loadFixtureGrid(t *testing.T) *Grid {
+	t.Helper()
+	analyzer, err := NewFixtureAnalyzer(defaultFixture)
+	if err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+	grid, err := analyzer.load(t.Context())
+	if err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+	grid.HasSolution = true
+	return grid
+}
+
+func TestExportIPUZ(t *testing.T) {
+	grid := loadFixtureGrid(t)
+	state := [][]string{{"", "", "", ""}, {"", "R", "", ""}, {"", "", "", ""}, {"", "", "", "C"}}
+
+	doc := ExportIPUZ(grid, state, true)
+
+	if doc.Version != ipuzVersion || doc.Dimensions != (IPUZDimensions{Width: 4, Height: 4}) {
+		t.Fatalf("unexpected header: %+v", doc)
+	}
+	wantPuzzle := [][]any{
+		{"#", "#", "#", "#"},
+		{"#", 1, 2, 3},
+		{"#", 4, 0, 0},
+		{"#", 5, 0, 0},
+	}
+	if !reflect.DeepEqual(doc.Puzzle, wantPuzzle) {
+		t.Fatalf("puzzle = %v, want %v", doc.Puzzle, wantPuzzle)
+	}
+
+	across := doc.Clues["Across"]
+	if len(across) != 3 || across[0].Number != 1 || across[0].Clue != "Rongeur" || across[2].Number != 5 {
+		t.Fatalf("unexpected across clues: %+v", across)
+	}
+	if want := [][2]int{{2, 2}, {3, 2}, {4, 2}}; !reflect.DeepEqual(across[0].Cells, want) {
+		t.Fatalf("Rongeur cells = %v, want %v", across[0].Cells, want)
+	}
+	down := doc.Clues["Down"]
+	if len(down) != 3 || down[1].Number != 2 || down[1].Clue != "Siège de l'esprit" {
+		t.Fatalf("unexpected down clues: %+v", down)
+	}
+
+	if len(doc.Definitions) != 6 || doc.Definitions[0].Cell != [2]int{2, 1} {
+		t.Fatalf("unexpected definition cells: %+v", doc.Definitions)
+	}
+	if doc.Solution[1][1] != "R" || doc.Solution[0][0] != "#" {
+		t.Fatalf("unexpected solution: %v", doc.Solution)
+	}
+	if doc.Saved[1][1] != "R" || doc.Saved[3][3] != "C" || doc.Saved[2][2] != nil {
+		t.Fatalf("unexpected saved state: %v", doc.Saved)
+	}
+
+	if doc := ExportIPUZ(grid, nil, false); doc.Solution != nil || doc.Saved != nil {
+		t.Fatal("solution and saved state should be omitted unless asked for")
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+	game, _ := srv.store.CreateGame(grid.ID)
+	game.Play("Alice", 0, 1, "A")
+	other, _ := srv.store.CreateGame(seedGrid(srv).ID)
+
+	req := httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/export?format=ipuz&game="+game.ID, nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if doc["version"] != ipuzVersion {
+		t.Fatalf("unexpected version: %v", doc["version"])
+	}
+	if saved := doc["saved"].([]any); saved[0].([]any)[1] != "A" {
+		t.Fatalf("expected saved letter, got %v", saved)
+	}
+	if _, ok := doc["solution"]; ok {
+		t.Fatal("solution should not be exported by default")
+	}
+
+	// The answers are only given with a game once it is completed.
+	solved := seedGrid(srv)
+	solved.SetSolution([]string{"#AB", "#CD", "EFG"})
+	srv.store.SaveGrid(solved)
+	finished, _ := srv.store.CreateGame(solved.ID)
+	export := func(query string) map[string]any {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+solved.ID+"/export"+query, nil))
+		var doc map[string]any
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		return doc
+	}
+	for _, query := range []string{"?solution=true", "?game=" + finished.ID + "&solution=true"} {
+		if _, ok := export(query)["solution"]; ok {
+			t.Errorf("%s: solution exported before the game is completed", query)
+		}
+	}
+	for r, row := range []string{"#AB", "#CD", "EFG"} {
+		for c, letter := range row {
+			if letter != '#' {
+				finished.Play("Alice", r, c, string(letter))
+			}
+		}
+	}
+	if finished.CheckCompletion(solved) == nil {
+		t.Fatal("game should be completed")
+	}
+	if _, ok := export("?game=" + finished.ID)["solution"]; !ok {
+		t.Error("solution should be exported with a completed game")
+	}
+
+	for name, url := range map[string]string{
+		"unknown format": "/api/grids/" + grid.ID + "/export?format=pdf",
+		"foreign game":   "/api/grids/" + grid.ID + "/export?game=" + other.ID,
+		"unknown grid":   "/api/grids/nope/export",
+	} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("%s: expected an error, got 200", name)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job states, in order. A job ends in jobDone or jobFailed.
+const (
+	jobQueued     = "queued"     // waiting for a free worker
+	jobAnalyzing  = "analyzing"  // the analyzer is reading the photo
+	jobValidating = "validating" // the grid is being checked and stored
+	jobDone       = "done"
+	jobFailed     = "failed"
+)
+
+const (
+	analysisWorkers   = 2                // concurrent analyses
+	analysisQueueSize = 32               // jobs waiting for a worker
+	analysisTimeout   = 5 * time.Minute  // per analysis, retries included
+	jobRetention      = 30 * time.Minute // finished jobs are forgotten after this
+)
+
+var (
+	errQueueFull   = errors.New("analysis queue is full")
+	errQueueClosed = errors.New("analysis queue is closed")
+)
+
+// Job is the progress of the analysis of an uploaded photo. Once done, it
+// refers to the created grid and carries the problems found in it.
+type Job struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	GridID    string    `json:"grid_id,omitempty"`
+	Cached    bool      `json:"cached,omitempty"` // the photo had already been analyzed
+	Warnings  []Problem `json:"warnings,omitempty"`
+	Overlaps  []Overlap `json:"overlaps,omitempty"` // between the photos of a grid uploaded in several parts
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (j *Job) finished() bool {
+	return j.State == jobDone || j.State == jobFailed
+}
+
+// analysisTask is the input of a job.
+type analysisTask struct {
+	jobID  string
+	images []*SourceImage // photos of the grid, in order
+	kind   string
+	steps  []string // preprocessing steps
+}
+
+// JobQueue runs analysis jobs on a fixed pool of workers. Every state
+// change is broadcast to the job's SSE subscribers, keyed by job ID.
+type JobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	tasks   chan analysisTask
+	closed  bool
+	events  *Broadcaster
+	ctx     context.Context // canceled by Close
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// NewJobQueue starts workers goroutines, each running one task at a time
+// until Close. run reports progress through the queue's setState and
+// finish methods, and should give up once ctx is canceled.
+func NewJobQueue(workers int, run func(context.Context, *JobQueue, analysisTask)) *JobQueue {
+	q := &JobQueue{
+		jobs:   make(map[string]*Job),
+		tasks:  make(chan analysisTask, analysisQueueSize),
+		events: NewBroadcaster(),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for range workers {
+		q.workers.Go(func() {
+			for t := range q.tasks {
+				if q.ctx.Err() != nil {
+					q.finish(t.jobID, "", nil, "Le serveur s'est arrêté avant l'analyse")
+					continue
+				}
+				run(q.ctx, q, t)
+			}
+		})
+	}
+	return q
+}
+
+// Close stops the workers: running analyses are canceled, waiting jobs
+// fail, and Submit returns errQueueClosed. It returns once every worker
+// has stopped.
+func (q *JobQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.cancel()
+		close(q.tasks)
+	}
+	q.mu.Unlock()
+	q.workers.Wait()
+}
+
+// Submit queues a task under a new job and returns the job, or
+// errQueueFull if too many jobs are already waiting.
+func (q *JobQueue) Submit(t analysisTask) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, errQueueClosed
+	}
+	q.prune()
+	now := time.Now()
+	job := &Job{ID: generateID(), State: jobQueued, CreatedAt: now, UpdatedAt: now}
+	t.jobID = job.ID
+	select {
+	case q.tasks <- t:
+	default:
+		return nil, errQueueFull
+	}
+	q.jobs[job.ID] = job
+	cp := *job
+	return &cp, nil
+}
+
+// Cached records a job done without analysis, for a photo whose grid is
+// already known, and returns it.
+func (q *JobQueue) Cached(gridID string) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	now := time.Now()
+	job := &Job{ID: generateID(), State: jobDone, GridID: gridID, Cached: true, CreatedAt: now, UpdatedAt: now}
+	q.jobs[job.ID] = job
+	cp := *job
+	return &cp
+}
+
+// Get returns a copy of a job, or nil if it is unknown or was forgotten.
+func (q *JobQueue) Get(id string) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil
+	}
+	cp := *job
+	return &cp
+}
+
+// setState moves a job to a new state.
+func (q *JobQueue) setState(id, state string) {
+	q.update(id, func(j *Job) { j.State = state })
+}
+
+// finish ends a job, successfully with the created grid or with a
+// user-facing error message.
+func (q *JobQueue) finish(id, gridID string, warnings []Problem, errMsg string) {
+	q.update(id, func(j *Job) {
+		j.State = jobDone
+		if errMsg != "" {
+			j.State = jobFailed
+		}
+		j.GridID = gridID
+		j.Warnings = warnings
+		j.Error = errMsg
+	})
+}
+
+func (q *JobQueue) update(id string, fn func(*Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	fn(job)
+	job.UpdatedAt = time.Now()
+	q.events.Broadcast(id, jobEvent(job))
+}
+
+// prune forgets the jobs finished for longer than jobRetention.
+// Caller must hold q.mu.
+func (q *JobQueue) prune() {
+	for id, job := range q.jobs {
+		if job.finished() && time.Since(job.UpdatedAt) > jobRetention {
+			delete(q.jobs, id)
+			q.events.Forget(id)
+		}
+	}
+}
+
+// jobEvent formats a job as an SSE message.
+func jobEvent(job *Job) string {
+	data, _ := json.Marshal(struct {
+		Type string `json:"type"`
+		*Job
+	}{"job", job})
+	return string(data)
+}
+
+// runAnalysis is the work of one job: prepare and analyze the photos, then
+// validate and store the grid.
+func (s *Server) runAnalysis(ctx context.Context, q *JobQueue, t analysisTask) {
+	ctx, cancel := context.WithTimeout(ctx, analysisTimeout)
+	defer cancel()
+
+	q.setState(t.jobID, jobAnalyzing)
+	photos := make([]Photo, len(t.images))
+	var first *Preprocessed // of the photo the grid is located on
+	for k, img := range t.images {
+		photos[k] = Photo{img.Data, img.MIMEType}
+		processed := preprocess(img.Data, t.steps)
+		if processed != nil {
+			photos[k] = Photo{processed.Data, processed.MIMEType}
+			// Kept to see what the analyzer was given.
+			if err := s.store.SaveImageVariant(img.Hash, processedVariant(processed.Steps), processed.Data); err != nil {
+				log.Printf("Save processed image error (job %s): %v", t.jobID, err)
+			}
+		}
+		if k == 0 {
+			first = processed
+		}
+	}
+	grid, overlaps, err := s.analyzePhotos(ctx, photos, t.kind)
+	switch {
+	case errors.Is(err, errUnmergeable):
+		log.Printf("Merge error (job %s): %v", t.jobID, err)
+		q.finish(t.jobID, "", nil, "Les photos n'ont pas pu être assemblées en une seule grille")
+		return
+	case err != nil:
+		log.Printf("Analyze error (job %s): %v", t.jobID, err)
+		q.finish(t.jobID, "", nil, "Erreur lors de l'analyse de la grille")
+		return
+	}
+
+	q.update(t.jobID, func(j *Job) {
+		j.State = jobValidating
+		j.Overlaps = overlaps
+	})
+	hashes := make([]string, len(t.images))
+	for k, img := range t.images {
+		hashes[k] = img.Hash
+	}
+	grid.ImageHash = hashes[0]
+	if len(hashes) > 1 {
+		grid.Images = hashes
+	}
+	if first != nil {
+		grid.Preprocess = first.Steps
+	}
+	problems, err := s.storeNewGrid(grid, first.sourceBox)
+	switch {
+	case errors.Is(err, errEmptyGrid):
+		q.finish(t.jobID, "", nil, "Aucune grille n'a pu être lue")
+	case err != nil:
+		log.Printf("Save grid error (job %s): %v", t.jobID, err)
+		q.finish(t.jobID, "", nil, "Erreur lors de l'enregistrement de la grille")
+	default:
+		s.linkImage(hashes[0], analysisKey(t.kind, t.steps, hashes[1:]...), grid.ID)
+		q.finish(t.jobID, grid.ID, problems, "")
+	}
+}
+
+// analyzePhotos reads the grid on the photos of an upload. Several photos
+// are given together to analyzers that can read them so, and one by one to
+// the others; the grids read are then assembled by mergeGrids.
+func (s *Server) analyzePhotos(ctx context.Context, photos []Photo, kind string) (*Grid, []Overlap, error) {
+	if len(photos) == 1 {
+		grid, err := s.analyzer.AnalyzeImage(ctx, photos[0].Data, photos[0].MIMEType, kind)
+		return grid, nil, err
+	}
+	var parts []*Grid
+	if multi, ok := s.analyzer.(MultiImageAnalyzer); ok {
+		var err error
+		if parts, err = multi.AnalyzeImages(ctx, photos, kind); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for _, photo := range photos {
+			part, err := s.analyzer.AnalyzeImage(ctx, photo.Data, photo.MIMEType, kind)
+			if err != nil {
+				return nil, nil, err
+			}
+			parts = append(parts, part)
+		}
+	}
+	return mergeGrids(parts)
+}
+
+// linkImage records the grid extracted for kind from an uploaded image.
+func (s *Server) linkImage(hash, kind, gridID string) {
+	img := s.store.GetImage(hash)
+	if img == nil {
+		return
+	}
+	if img.Grids == nil {
+		img.Grids = make(map[string]string)
+	}
+	img.Grids[kind] = gridID
+	if err := s.store.SaveImage(img); err != nil {
+		log.Printf("Save image error: %v", err)
+	}
+}
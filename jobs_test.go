@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// analyzeUpload sends an upload request, then polls its job until it is
+// finished and returns it.
+func analyzeUpload(t *testing.T, srv *Server, req *http.Request) *Job {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	if job.ID == "" || job.State != jobQueued {
+		t.Fatalf("expected a queued job, got %+v", job)
+	}
+	if loc := w.Header().Get("Location"); loc != "/api/jobs/"+job.ID {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.finished() {
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s after 5s", job.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/jobs/"+job.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("get job: expected 200, got %d", w.Code)
+		}
+		json.NewDecoder(w.Body).Decode(&job)
+	}
+	return &job
+}
+
+// gatedAnalyzer waits for a signal before each analysis, so tests can
+// observe the intermediate job states.
+type gatedAnalyzer struct {
+	release chan struct{}
+	err     error
+}
+
+func (a *gatedAnalyzer) AnalyzeImage(ctx context.Context, _ []byte, _, _ string) (*Grid, error) {
+	select {
+	case <-a.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	return newTestGrid(2, 2), nil
+}
+
+func TestAnalysisJobEvents(t *testing.T) {
+	analyzer := &gatedAnalyzer{release: make(chan struct{})}
+	srv := newAnalyzerServer(t, analyzer)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newUploadRequest(t, "image/png", fakePNG("png")))
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+
+	resp, err := http.Get(ts.URL + "/api/jobs/" + job.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	var states []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var evt struct {
+			Type string `json:"type"`
+			Job
+		}
+		if err := json.Unmarshal([]byte(data), &evt); err != nil || evt.Type != "job" {
+			t.Fatalf("unexpected event %q", data)
+		}
+		if len(states) == 0 || states[len(states)-1] != evt.State {
+			states = append(states, evt.State)
+		}
+		if evt.State == jobAnalyzing {
+			close(analyzer.release)
+		}
+		if evt.finished() {
+			if evt.GridID == "" || srv.store.GetGrid(evt.GridID) == nil {
+				t.Fatalf("done job should refer to the stored grid: %+v", evt.Job)
+			}
+			break
+		}
+	}
+
+	// The stream may start after the worker picked the job up.
+	want := []string{jobQueued, jobAnalyzing, jobValidating, jobDone}
+	if len(states) == 0 || states[0] != jobQueued {
+		want = want[1:]
+	}
+	if strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+}
+
+func TestAnalysisJobFailed(t *testing.T) {
+	analyzer := &gatedAnalyzer{release: make(chan struct{}), err: errors.New("model unavailable")}
+	close(analyzer.release)
+	srv := newAnalyzerServer(t, analyzer)
+
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", fakePNG("png")))
+	if job.State != jobFailed || job.Error == "" || job.GridID != "" {
+		t.Fatalf("expected a failed job with an error, got %+v", job)
+	}
+	if len(srv.store.ListGrids()) != 0 {
+		t.Fatal("no grid should be stored for a failed job")
+	}
+}
+
+func TestJobQueueFull(t *testing.T) {
+	q := NewJobQueue(0, func(context.Context, *JobQueue, analysisTask) {}) // no worker: nothing leaves the queue
+	t.Cleanup(q.Close)
+	for i := range analysisQueueSize {
+		if _, err := q.Submit(analysisTask{images: []*SourceImage{{MIMEType: "image/png"}}, kind: KindArrow}); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	if _, err := q.Submit(analysisTask{images: []*SourceImage{{MIMEType: "image/png"}}, kind: KindArrow}); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+}
+
+func TestJobQueueClose(t *testing.T) {
+	started := make(chan struct{})
+	q := NewJobQueue(1, func(ctx context.Context, q *JobQueue, task analysisTask) {
+		close(started)
+		<-ctx.Done()
+		q.finish(task.jobID, "", nil, "canceled")
+	})
+	task := analysisTask{images: []*SourceImage{{MIMEType: "image/png"}}, kind: KindArrow}
+	running, _ := q.Submit(task)
+	waiting, _ := q.Submit(task)
+	<-started
+
+	q.Close() // returns once the running analysis gave up
+	if job := q.Get(running.ID); job.State != jobFailed || job.Error != "canceled" {
+		t.Fatalf("running job = %+v", job)
+	}
+	if job := q.Get(waiting.ID); job.State != jobFailed || job.Error == "" {
+		t.Fatalf("waiting job = %+v", job)
+	}
+	if _, err := q.Submit(task); !errors.Is(err, errQueueClosed) {
+		t.Fatalf("expected errQueueClosed, got %v", err)
+	}
+	q.Close()
+}
+
+func TestGetUnknownJob(t *testing.T) {
+	srv := newFixtureServer(t)
+	for _, path := range []string{"/api/jobs/nope", "/api/jobs/nope/events"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+)
+
+const (
+	localAnalysisSize = 1200 // pixels, longest side of the image searched for the grid
+	minGridCells      = 3    // rows or columns
+	maxGridCells      = 30
+
+	// lineScore is the least average coverage of the expected line
+	// positions, less that of the middle of the cells, for a division of
+	// the grid into cells to be accepted.
+	lineScore = 0.3
+	// lineTolerance is how far from its expected position a grid line is
+	// looked for, as a share of the cell size.
+	lineTolerance = 0.1
+	// lineDelta is the gray level difference from the paper from which a
+	// pixel is taken as part of a grid line: thin lines are lighter than
+	// the ink of text once photographed.
+	lineDelta = 50
+	// profileBands is the number of bands across the grid in which grid
+	// lines are looked for separately.
+	profileBands = 8
+	// cellMargin is the part of each side of a cell left out when reading
+	// its content, to keep clear of the grid lines.
+	cellMargin = 0.2
+	// paperCells is how many cells around a cell, on each side, tell the
+	// brightness of the paper near it.
+	paperCells = 3
+	// shadeDelta is the gray level difference from the paper from which a
+	// cell is half-way to being taken as shaded.
+	shadeDelta = 20
+	// textInk is the share of dark pixels from which a cell is half-way to
+	// being taken as holding text.
+	textInk = 0.08
+)
+
+var errNoGridFound = errors.New("no grid found on the image")
+
+// LocalAnalyzer reads the structure of a grid by image processing alone,
+// without any network call: it finds the grid border, divides it into
+// cells along the grid lines, and tells letter cells from definition cells
+// (shaded or holding text) or black squares. Definition texts are left
+// empty, to be typed in by hand: definition cells have no definitions, and
+// classic grids no clues. It is used when Gemini is not configured.
+type LocalAnalyzer struct{}
+
+// AnalyzeImage reads the structure of the grid on the image. Cells whose
+// type is unclear get a low confidence, so that they are listed for
+// review.
+func (LocalAnalyzer) AnalyzeImage(ctx context.Context, imageData []byte, _, kind string) (*Grid, error) {
+	src, err := decodeImage(imageData)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	// Grid lines and ink are looked for once shadows and uneven lighting
+	// are evened out, which also evens out the shading of cells: shading
+	// is read on the image itself.
+	gray := grayscale(resizeImage(src, localAnalysisSize))
+	flat := grayscale(normalizeContrast(gray))
+	quad, ok := findGridBorder(flat)
+	if !ok {
+		return nil, errNoGridFound
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Straighten the grid area into a w×h rectangle.
+	tl, tr, br, bl := quad[0], quad[1], quad[2], quad[3]
+	w := int(math.Round((dist(tl, tr) + dist(bl, br)) / 2))
+	h := int(math.Round((dist(tl, bl) + dist(tr, br)) / 2))
+	toImage, ok := solveHomography([4]point{{0, 0}, {float64(w), 0}, {float64(w), float64(h)}, {0, float64(h)}}, quad)
+	if !ok || w < minGridCells*4 || h < minGridCells*4 {
+		return nil, errNoGridFound
+	}
+	b := gray.Rect
+	straighten := func(img *image.Gray) []uint8 {
+		pix := make([]uint8, w*h)
+		for y := range h {
+			for x := range w {
+				sx, sy := toImage.apply(float64(x)+0.5, float64(y)+0.5)
+				pix[y*w+x] = uint8(bilinear(img.Pix, img.Stride, 1, 0, b.Dx(), b.Dy(), sx-0.5, sy-0.5))
+			}
+		}
+		return pix
+	}
+	rect, flatRect := straighten(gray), straighten(flat)
+
+	var hist [256]int
+	for _, v := range flatRect {
+		hist[v]++
+	}
+	// Ink is darker than shaded cells: the threshold between the two
+	// classes of gray levels may fall between shading and paper.
+	threshold := min(otsu(hist), uint8(percentile(hist, 0.9)*2/3))
+	lineThreshold := uint8(max(int(percentile(hist, 0.9))-lineDelta, int(threshold)))
+	// Share of pixels of grid lines on each line across the grid, in
+	// bands along it: on a curved page, grid lines are straighter within a
+	// band.
+	rowProfiles, colProfiles := make([][]float64, profileBands), make([][]float64, profileBands)
+	for k := range profileBands {
+		rowProfiles[k], colProfiles[k] = make([]float64, h), make([]float64, w)
+	}
+	for y := range h {
+		for x := range w {
+			if flatRect[y*w+x] < lineThreshold {
+				rowProfiles[x*profileBands/w][y]++
+				colProfiles[y*profileBands/h][x]++
+			}
+		}
+	}
+	for k := range profileBands {
+		for y := range h {
+			rowProfiles[k][y] /= float64((k+1)*w/profileBands - k*w/profileBands)
+		}
+		for x := range w {
+			colProfiles[k][x] /= float64((k+1)*h/profileBands - k*h/profileBands)
+		}
+	}
+	rows, cols := countCells(rowProfiles), countCells(colProfiles)
+	if rows == 0 || cols == 0 {
+		return nil, errNoGridFound
+	}
+
+	grid := &Grid{Rows: rows, Cols: cols, Cells: make([][]Cell, rows)}
+	if kind == KindClassic {
+		grid.Kind = KindClassic
+		grid.Clues = &NumberedClues{Horizontal: []NumberedClue{}, Vertical: []NumberedClue{}}
+	}
+	imageBox := func(x0, y0, x1, y1 float64) *Box {
+		minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+		for _, c := range [4]point{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}} {
+			x, y := toImage.apply(c.x, c.y)
+			minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+		}
+		fw, fh := float64(b.Dx()), float64(b.Dy())
+		return &Box{X: max(minX/fw, 0), Y: max(minY/fh, 0), Width: (min(maxX, fw) - max(minX, 0)) / fw, Height: (min(maxY, fh) - max(minY, 0)) / fh}
+	}
+	grid.Bounds = imageBox(0, 0, float64(w), float64(h))
+
+	// Mean gray level and share of dark pixels inside each cell.
+	type content struct{ mean, ink float64 }
+	contents := make([]content, rows*cols)
+	cw, ch := float64(w)/float64(cols), float64(h)/float64(rows)
+	for i := range rows {
+		for j := range cols {
+			x0, x1 := int(float64(j)*cw+cellMargin*cw), int(float64(j+1)*cw-cellMargin*cw)
+			y0, y1 := int(float64(i)*ch+cellMargin*ch), int(float64(i+1)*ch-cellMargin*ch)
+			sum, dark, n := 0, 0, 0
+			for y := y0; y < max(y1, y0+1); y++ {
+				for x := x0; x < max(x1, x0+1); x++ {
+					sum += int(rect[y*w+x])
+					if flatRect[y*w+x] < threshold {
+						dark++
+					}
+					n++
+				}
+			}
+			contents[i*cols+j] = content{float64(sum) / float64(n), float64(dark) / float64(n)}
+		}
+	}
+
+	// The paper is the brightness of the lighter cells around each one:
+	// letter cells are the most common in both kinds of grids, and the
+	// lighting changes across a photo.
+	paperAt := func(i, j int) float64 {
+		var means []float64
+		for ni := max(i-paperCells, 0); ni <= min(i+paperCells, rows-1); ni++ {
+			for nj := max(j-paperCells, 0); nj <= min(j+paperCells, cols-1); nj++ {
+				means = append(means, contents[ni*cols+nj].mean)
+			}
+		}
+		slices.Sort(means)
+		return means[len(means)*3/4]
+	}
+
+	for i := range rows {
+		grid.Cells[i] = make([]Cell, cols)
+		for j := range cols {
+			c := contents[i*cols+j]
+			paper := paperAt(i, j)
+			// How much the cell looks like a definition cell or a black
+			// square, from 0 to 1, 0.5 being the limit.
+			var score float64
+			if kind == KindClassic {
+				score = c.ink
+			} else {
+				score = max((paper-c.mean)/(2*shadeDelta), c.ink/(2*textInk))
+			}
+			score = min(max(score, 0), 1)
+			cell := &grid.Cells[i][j]
+			cell.Black = score >= 0.5
+			confidence := 0.5 + math.Abs(score-0.5)
+			cell.Confidence = &confidence
+			cell.Box = imageBox(float64(j)*cw, float64(i)*ch, float64(j+1)*cw, float64(i+1)*ch)
+		}
+	}
+	return grid, nil
+}
+
+// Describe names the local analyzer.
+func (LocalAnalyzer) Describe() AnalyzerInfo {
+	return AnalyzerInfo{Name: "local"}
+}
+
+// countCells finds in how many cells grid lines divide a side of the grid,
+// from the share of dark pixels on each line across it, in each band along
+// it (profiles). The right count puts a grid line at each division, and
+// none in the middle of the cells: the largest count scoring about as well
+// as the best one is taken, since fewer cells (every other line) fit as well
+// and more cells (lines in the middle of the cells) do not. Text and arrows
+// may fall on the expected lines of a wrong count by chance, but then also
+// in the middle of its cells. It returns 0 if no count fits.
+func countCells(profiles [][]float64) int {
+	n := len(profiles[0])
+	scores := make([]float64, maxGridCells+1)
+	best := 0.0
+	for cells := minGridCells; cells <= maxGridCells; cells++ {
+		pitch := float64(n) / float64(cells)
+		if pitch < 4 {
+			break
+		}
+		tolerance := max(1, int(pitch*lineTolerance))
+		// The darkest line near each division, less the darkest one near
+		// the middle of each cell.
+		peak := func(profile []float64, at float64) float64 {
+			p0 := int(math.Round(at))
+			v := 0.0
+			for p := max(p0-tolerance, 0); p <= min(p0+tolerance, n-1); p++ {
+				v = max(v, profile[p])
+			}
+			return v
+		}
+		total := 0.0
+		for _, profile := range profiles {
+			for k := 1; k < cells; k++ {
+				total += peak(profile, float64(k)*pitch)
+			}
+			for k := range cells {
+				total -= peak(profile, (float64(k)+0.5)*pitch) * float64(cells-1) / float64(cells)
+			}
+		}
+		scores[cells] = total / float64((cells-1)*len(profiles))
+		best = max(best, scores[cells])
+	}
+	if best < lineScore {
+		return 0
+	}
+	for cells := maxGridCells; cells >= minGridCells; cells-- {
+		if scores[cells] >= 0.9*best {
+			return cells
+		}
+	}
+	return 0
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"testing"
+)
+
+// drawnGrid draws a rows×cols grid of 40 pixel cells on a white page. The
+// cells listed in shaded are gray, those in text hold a few strokes of ink,
+// and those in black are filled.
+func drawnGrid(rows, cols int, shaded, text, black []Position) *image.Gray {
+	const cell, margin = 40, 30
+	img := image.NewGray(image.Rect(0, 0, cols*cell+2*margin, rows*cell+2*margin))
+	for i := range img.Pix {
+		img.Pix[i] = 240
+	}
+	fill := func(x0, y0, x1, y1 int, level uint8) {
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				img.SetGray(x, y, color.Gray{Y: level})
+			}
+		}
+	}
+	at := func(p Position) (int, int) { return margin + p.Col*cell, margin + p.Row*cell }
+	for _, p := range shaded {
+		x, y := at(p)
+		fill(x, y, x+cell, y+cell, 190)
+	}
+	for _, p := range black {
+		x, y := at(p)
+		fill(x, y, x+cell, y+cell, 15)
+	}
+	for _, p := range text {
+		x, y := at(p)
+		for _, line := range []int{12, 19, 26} {
+			fill(x+8, y+line, x+32, y+line+2, 30)
+		}
+	}
+	for k := range rows + 1 {
+		fill(margin, margin+k*cell-1, margin+cols*cell+1, margin+k*cell+1, 20)
+	}
+	for k := range cols + 1 {
+		fill(margin+k*cell-1, margin, margin+k*cell+1, margin+rows*cell+1, 20)
+	}
+	return img
+}
+
+func TestLocalAnalyzerArrowGrid(t *testing.T) {
+	shaded := []Position{{0, 0}, {2, 3}}
+	text := []Position{{0, 0}, {2, 3}, {4, 1}}
+	definitions := map[Position]bool{{0, 0}: true, {2, 3}: true, {4, 1}: true}
+	grid, err := LocalAnalyzer{}.AnalyzeImage(context.Background(), encodePNG(t, drawnGrid(7, 5, shaded, text, nil)), "image/png", KindArrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.Rows != 7 || grid.Cols != 5 {
+		t.Fatalf("grid is %dx%d, want 7x5", grid.Rows, grid.Cols)
+	}
+	for i, row := range grid.Cells {
+		for j, cell := range row {
+			pos := Position{i, j}
+			if cell.Black != definitions[pos] {
+				t.Errorf("cell %v black = %v, want %v", pos, cell.Black, definitions[pos])
+			}
+			if len(cell.Definitions) > 0 {
+				t.Errorf("cell %v has definitions %v", pos, cell.Definitions)
+			}
+			if cell.Confidence == nil || *cell.Confidence < 0.5 {
+				t.Errorf("cell %v confidence = %v", pos, cell.Confidence)
+			}
+			if cell.Box == nil {
+				t.Errorf("cell %v is not located", pos)
+			}
+		}
+	}
+	if b := grid.Bounds; b == nil || b.X < 0.05 || b.X > 0.2 || b.Width < 0.6 {
+		t.Errorf("bounds = %+v", grid.Bounds)
+	}
+}
+
+func TestLocalAnalyzerClassicGrid(t *testing.T) {
+	black := []Position{{1, 1}, {3, 4}, {5, 0}}
+	grid, err := LocalAnalyzer{}.AnalyzeImage(context.Background(), encodePNG(t, drawnGrid(6, 6, nil, nil, black)), "image/png", KindClassic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.Kind != KindClassic || grid.Clues == nil {
+		t.Errorf("kind = %q, clues = %v", grid.Kind, grid.Clues)
+	}
+	if grid.Rows != 6 || grid.Cols != 6 {
+		t.Fatalf("grid is %dx%d, want 6x6", grid.Rows, grid.Cols)
+	}
+	blacks := 0
+	for _, row := range grid.Cells {
+		for _, cell := range row {
+			if cell.Black {
+				blacks++
+			}
+		}
+	}
+	if blacks != len(black) {
+		t.Errorf("%d black cells, want %d", blacks, len(black))
+	}
+	for _, p := range black {
+		if !grid.Cells[p.Row][p.Col].Black {
+			t.Errorf("cell %v is not black", p)
+		}
+	}
+}
+
+func TestLocalAnalyzerSkewedPhoto(t *testing.T) {
+	grid, err := LocalAnalyzer{}.AnalyzeImage(context.Background(), encodePNG(t, skewedGrid(400, 300, testQuad)), "image/png", KindArrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.Rows != 5 || grid.Cols != 5 {
+		t.Fatalf("grid is %dx%d, want 5x5", grid.Rows, grid.Cols)
+	}
+	for i, row := range grid.Cells {
+		for j, cell := range row {
+			if cell.Black {
+				t.Errorf("cell (%d,%d) read as a definition", i, j)
+			}
+		}
+	}
+}
+
+// TestLocalAnalyzerPhotos reads evaluation photos: a magazine page, with
+// its shaded letter cells, uneven lighting and slightly curved paper, and a
+// drawn grid with large shaded definition cells.
+func TestLocalAnalyzerPhotos(t *testing.T) {
+	for name, expected := range map[string]string{
+		"page46_upright.jpg": "page46.json",
+		"mini.png":           "mini.json",
+	} {
+		photo, err := os.ReadFile("test_data/evaluation/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile("test_data/evaluation/" + expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want Grid
+		if err := json.Unmarshal(data, &want); err != nil {
+			t.Fatal(err)
+		}
+		grid, err := LocalAnalyzer{}.AnalyzeImage(context.Background(), photo, "", KindArrow)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if grid.Rows != want.Rows || grid.Cols != want.Cols {
+			t.Fatalf("%s: grid is %dx%d, want %dx%d", name, grid.Rows, grid.Cols, want.Rows, want.Cols)
+		}
+		for i, row := range grid.Cells {
+			for j, cell := range row {
+				if cell.Black != want.Cells[i][j].Black {
+					t.Errorf("%s: cell (%d,%d): black = %v, want %v", name, i, j, cell.Black, want.Cells[i][j].Black)
+				}
+			}
+		}
+	}
+}
+
+func TestLocalAnalyzerNoGrid(t *testing.T) {
+	blank := image.NewGray(image.Rect(0, 0, 300, 200))
+	for i := range blank.Pix {
+		blank.Pix[i] = 240
+	}
+	_, err := LocalAnalyzer{}.AnalyzeImage(context.Background(), encodePNG(t, blank), "image/png", KindArrow)
+	if !errors.Is(err, errNoGridFound) {
+		t.Errorf("err = %v, want errNoGridFound", err)
+	}
+}
+
+func TestUploadLocalAnalysis(t *testing.T) {
+	srv := newAnalyzerServer(t, LocalAnalyzer{})
+	text := []Position{{0, 0}, {3, 2}}
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", encodePNG(t, drawnGrid(5, 5, text, text, nil))))
+	if job.State != jobDone {
+		t.Fatalf("job = %+v", job)
+	}
+	grid := srv.store.GetGrid(job.GridID)
+	if grid == nil || grid.Rows != 5 || grid.Cols != 5 {
+		t.Fatalf("grid = %+v", grid)
+	}
+	if !grid.Cells[0][0].Black || !grid.Cells[3][2].Black || grid.Cells[1][1].Black {
+		t.Errorf("cells = %v", grid.Cells)
+	}
+}
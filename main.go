@@ -1,12 +1,23 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+const defaultFixture = "test_data/grid.json"
+
+// shutdownTimeout bounds the wait for pending requests, event streams
+// included, on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -15,25 +26,110 @@ func main() {
 
 	ctx := context.Background()
 
-	projectID := os.Getenv("GCP_PROJECT_ID")
-
-	var gemini *GeminiClient
-	if projectID != "" {
-		var err error
-		gemini, err = NewGeminiClient(ctx, projectID, os.Getenv("GCP_REGION"))
+	var analyzer GridAnalyzer
+	switch os.Getenv("ANALYZER") {
+	case "fixture":
+		path := os.Getenv("ANALYZER_FIXTURE")
+		if path == "" {
+			path = defaultFixture
+		}
+		fixture, err := NewFixtureAnalyzer(path)
+		if err != nil {
+			log.Fatalf("Impossible de charger la grille de démonstration : %v", err)
+		}
+		analyzer = fixture
+		log.Printf("Analyse d'image simulée (fixture: %s)", path)
+	case "local":
+		analyzer = LocalAnalyzer{}
+		log.Println("Analyse locale des grilles (structure seule, définitions à saisir)")
+	case "", "gemini":
+		projectID := os.Getenv("GCP_PROJECT_ID")
+		if projectID == "" {
+			analyzer = LocalAnalyzer{}
+			log.Println("GCP_PROJECT_ID non défini — analyse locale des grilles (structure seule, définitions à saisir)")
+			break
+		}
+		gemini, err := NewGeminiClient(ctx, projectID, os.Getenv("GCP_REGION"))
 		if err != nil {
 			log.Fatalf("Impossible d'initialiser Gemini : %v", err)
 		}
 		defer gemini.Close()
-		log.Printf("Client Gemini initialisé (projet: %s)", projectID)
+		configureGemini(gemini)
+		analyzer = gemini
+		log.Printf("Client Gemini initialisé (projet: %s, modèle: %s, secours: %s)", projectID, gemini.modelName, cmp.Or(gemini.fallbackModel, "aucun"))
+	default:
+		log.Fatalf("ANALYZER inconnu : %q (attendu : gemini, local ou fixture)", os.Getenv("ANALYZER"))
+	}
+
+	var store Store
+	if path := os.Getenv("DB_PATH"); path != "" {
+		bolt, err := OpenBoltStore(path)
+		if err != nil {
+			log.Fatalf("Impossible d'ouvrir la base %s : %v", path, err)
+		}
+		defer bolt.Close()
+		store = bolt
+		log.Printf("Stockage persistant : %s", path)
 	} else {
-		log.Println("GCP_PROJECT_ID non défini — analyse d'image désactivée")
+		store = NewMemoryStore()
+		log.Println("DB_PATH non défini — stockage en mémoire uniquement")
 	}
 
-	srv := NewServer(NewStore(), gemini)
+	srv := NewServer(store, analyzer)
+	if v := os.Getenv("IMAGE_MATCH_DISTANCE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 64 {
+			log.Fatalf("IMAGE_MATCH_DISTANCE invalide : %q (attendu : 0 à 64)", v)
+		}
+		srv.imageMatchDistance = n
+	}
+
+	// On SIGINT or SIGTERM, finish the pending requests, then stop the
+	// analysis workers before the store and Gemini client are closed.
+	stop, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	httpServer := &http.Server{Addr: ":" + port, Handler: srv}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-stop.Done()
+		shutdown, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdown); err != nil {
+			log.Printf("Arrêt du serveur : %v", err)
+		}
+	}()
 
 	log.Printf("Serveur démarré sur http://localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, srv); err != nil {
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
+	srv.Close()
+	log.Println("Serveur arrêté")
+}
+
+// configureGemini applies the GEMINI_* environment variables to the client.
+// An empty GEMINI_FALLBACK_MODEL disables the fallback model.
+func configureGemini(g *GeminiClient) {
+	if v := os.Getenv("GEMINI_MODEL"); v != "" {
+		g.modelName = v
+	}
+	if v, ok := os.LookupEnv("GEMINI_FALLBACK_MODEL"); ok {
+		g.fallbackModel = v
+	}
+	if v := os.Getenv("GEMINI_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("GEMINI_ATTEMPTS invalide : %q (attendu : 1 ou plus)", v)
+		}
+		g.retry.Attempts = n
+	}
+	if v := os.Getenv("GEMINI_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("GEMINI_TIMEOUT invalide : %q (attendu : une durée, ex. 45s)", v)
+		}
+		g.retry.AttemptTimeout = d
+	}
 }
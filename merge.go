@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxUploadImages = 4 // photos of one grid per upload
+
+	// overlapAgreement is the share of cells two photos must read alike
+	// for the rows or columns they both show to be taken as the same.
+	overlapAgreement = 0.9
+	// differencePenalty is how many cells read alike a cell read
+	// differently outweighs, when choosing between possible overlaps.
+	differencePenalty = 5
+	// conflictConfidence is the confidence given to a cell read
+	// differently on two photos when neither reading had one.
+	conflictConfidence = 0.5
+)
+
+// Directions in which a photo continues the grid of the previous ones.
+const (
+	overlapDown  = "down"  // the photo shows the rows below
+	overlapRight = "right" // the photo shows the columns on the right
+)
+
+// Overlap is the part of a grid seen on two consecutive photos, which
+// mergeGrids reconciled.
+type Overlap struct {
+	Photos    [2]int     `json:"photos"`              // indexes of the photos in the upload, from 0
+	Direction string     `json:"direction"`           // overlapDown or overlapRight
+	Size      int        `json:"size"`                // rows (down) or columns (right) seen on both photos, 0 if they only touch
+	Conflicts []Position `json:"conflicts,omitempty"` // cells of the merged grid read differently on the two photos
+	Message   string     `json:"message"`
+}
+
+var errUnmergeable = errors.New("photos do not make one grid")
+
+// mergeGrids assembles the grids read on several photos of the same grid,
+// in order, into one grid. Each photo continues the grid either below or
+// on the right of the previous ones; the rows or columns shown on both are
+// found by comparing the cells, and read only once. Cells read differently
+// keep the more confident reading, with a lowered confidence so that they
+// are listed for review. Photos without cells (a separate clue page) only
+// bring their clues.
+//
+// The cells of a grid assembled from several photos are not located: their
+// boxes are dropped, unless the grid comes from the first photo alone.
+func mergeGrids(parts []*Grid) (*Grid, []Overlap, error) {
+	var merged *Grid
+	var overlaps []Overlap
+	last := -1 // photo of the last grid part
+	for k, part := range parts {
+		part = normalizeCells(part.Clone())
+		if part.Rows == 0 {
+			if merged != nil {
+				merged.Clues = mergeClues(merged.Clues, part.Clues)
+			}
+			continue
+		}
+		if merged == nil {
+			merged = part
+			if k > 0 {
+				merged.Bounds = nil
+				merged.MapBoxes(func(*Box) *Box { return nil })
+			}
+			for _, earlier := range parts[:k] {
+				merged.Clues = mergeClues(merged.Clues, earlier.Clues)
+			}
+			last = k
+			continue
+		}
+
+		overlap, ok := bestOverlap(merged, part)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: photo %d is %dx%d, the grid so far %dx%d",
+				errUnmergeable, k+1, part.Rows, part.Cols, merged.Rows, merged.Cols)
+		}
+		overlap.Photos = [2]int{last, k}
+		merged = stitch(merged, part, &overlap)
+		merged.Bounds = nil
+		merged.MapBoxes(func(*Box) *Box { return nil })
+		overlaps = append(overlaps, overlap)
+		last = k
+	}
+	if merged == nil {
+		return nil, nil, errEmptyGrid
+	}
+	return merged, overlaps, nil
+}
+
+// normalizeCells pads the rows of a grid read on a photo to the same
+// length and sets Rows and Cols from its cells. Unlike Validate, it keeps
+// the definitions pointing out of the photo: their words may be on the next
+// one.
+func normalizeCells(g *Grid) *Grid {
+	cols := 0
+	for _, row := range g.Cells {
+		cols = max(cols, len(row))
+	}
+	for i := range g.Cells {
+		for len(g.Cells[i]) < cols {
+			g.Cells[i] = append(g.Cells[i], Cell{})
+		}
+	}
+	g.Rows, g.Cols = len(g.Cells), cols
+	if cols == 0 {
+		g.Rows, g.Cells = 0, nil
+	}
+	return g
+}
+
+// bestOverlap finds how part continues the grid g: below it if they have
+// as many columns, on its right if they have as many rows, sharing the
+// largest number of rows or columns read alike. Below is preferred when
+// both fit as well.
+func bestOverlap(g, part *Grid) (Overlap, bool) {
+	best, found := Overlap{}, false
+	for _, direction := range []string{overlapDown, overlapRight} {
+		if direction == overlapDown && part.Cols != g.Cols || direction == overlapRight && part.Rows != g.Rows {
+			continue
+		}
+		size := sharedLines(g, part, direction)
+		if !found || size > best.Size {
+			best, found = Overlap{Direction: direction, Size: size}, true
+		}
+	}
+	return best, found
+}
+
+// sharedLines returns the number of rows (down) or columns (right) at the
+// end of g that part starts with. Lines are shared when few of their cells
+// are read differently, one in ten at most (rounded up); of the candidates,
+// the one with the most cells read alike wins, each cell read differently
+// counting against differencePenalty of them.
+func sharedLines(g, part *Grid, direction string) int {
+	gLines, partLines, width := g.Rows, part.Rows, g.Cols
+	if direction == overlapRight {
+		gLines, partLines, width = g.Cols, part.Cols, g.Rows
+	}
+	best, bestScore := 0, 0
+	for size := min(gLines, partLines); size > 0; size-- {
+		differences := 0
+		for l := range size {
+			for m := range width {
+				a, b := lineCell(g, gLines-size+l, m, direction), lineCell(part, l, m, direction)
+				if !sameCell(*a, *b) {
+					differences++
+				}
+			}
+		}
+		if float64(differences) > math.Ceil((1-overlapAgreement)*float64(size*width)) {
+			continue
+		}
+		if score := size*width - differences*(1+differencePenalty); score > bestScore {
+			best, bestScore = size, score
+		}
+	}
+	return best
+}
+
+// lineCell returns the cell m of row l (down) or column l (right).
+func lineCell(g *Grid, l, m int, direction string) *Cell {
+	if direction == overlapRight {
+		return &g.Cells[m][l]
+	}
+	return &g.Cells[l][m]
+}
+
+// stitch appends part to g as found by bestOverlap, reconciling the cells
+// of the overlap and recording the conflicts in it.
+func stitch(g, part *Grid, overlap *Overlap) *Grid {
+	merged := g.Clone()
+	base := g.Rows - overlap.Size
+	if overlap.Direction == overlapRight {
+		base = g.Cols - overlap.Size
+	}
+	for i, row := range part.Cells {
+		for j, cell := range row {
+			l, m := i, j // line of part and cell in it
+			if overlap.Direction == overlapRight {
+				l, m = j, i
+			}
+			pos := Position{Row: base + l, Col: m}
+			if overlap.Direction == overlapRight {
+				pos = Position{Row: m, Col: base + l}
+			}
+			if l >= overlap.Size {
+				if overlap.Direction == overlapDown {
+					if pos.Row == len(merged.Cells) {
+						merged.Cells = append(merged.Cells, make([]Cell, 0, part.Cols))
+					}
+				}
+				merged.Cells[pos.Row] = append(merged.Cells[pos.Row], cell)
+				continue
+			}
+			reconciled, conflict := reconcile(merged.Cells[pos.Row][pos.Col], cell)
+			merged.Cells[pos.Row][pos.Col] = reconciled
+			if conflict {
+				overlap.Conflicts = append(overlap.Conflicts, pos)
+			}
+		}
+	}
+	merged.Rows, merged.Cols = len(merged.Cells), len(merged.Cells[0])
+	merged.Clues = mergeClues(merged.Clues, part.Clues)
+
+	lines := "ligne"
+	if overlap.Direction == overlapRight {
+		lines = "colonne"
+	}
+	switch {
+	case overlap.Size == 0:
+		overlap.Message = fmt.Sprintf("Photos %d et %d : aucune %s en commun, assemblées bout à bout", overlap.Photos[0]+1, overlap.Photos[1]+1, lines)
+	case len(overlap.Conflicts) == 0:
+		overlap.Message = fmt.Sprintf("Photos %d et %d : %d %s(s) en commun, lues à l'identique", overlap.Photos[0]+1, overlap.Photos[1]+1, overlap.Size, lines)
+	default:
+		overlap.Message = fmt.Sprintf("Photos %d et %d : %d %s(s) en commun, %d case(s) lue(s) différemment à vérifier", overlap.Photos[0]+1, overlap.Photos[1]+1, overlap.Size, lines, len(overlap.Conflicts))
+	}
+	return merged
+}
+
+// reconcile merges the readings of a cell seen on two photos. Alike
+// readings are merged, keeping the longer text of each definition (one
+// photo may cut it). Otherwise the more confident reading is kept, the
+// first one on a tie, and conflict is true.
+func reconcile(a, b Cell) (cell Cell, conflict bool) {
+	if sameCell(a, b) {
+		cell = a
+		if len(b.Definitions) > 0 {
+			cell.Definitions = make([]Definition, len(a.Definitions))
+			for k := range a.Definitions {
+				cell.Definitions[k] = a.Definitions[k]
+				if len(b.Definitions[k].Text) > len(a.Definitions[k].Text) {
+					cell.Definitions[k] = b.Definitions[k]
+				}
+			}
+		}
+		cell.Confidence = highestConfidence(a.Confidence, b.Confidence)
+		return cell, false
+	}
+
+	cell = a
+	if confidenceOf(b) > confidenceOf(a) {
+		cell = b
+	}
+	cell.Confidence = lowestConfidence(a.Confidence, b.Confidence)
+	if cell.Confidence == nil || *cell.Confidence > conflictConfidence {
+		c := conflictConfidence
+		cell.Confidence = &c
+	}
+	return cell, true
+}
+
+// confidenceOf returns the confidence of a cell, 1 if it has none.
+func confidenceOf(c Cell) float64 {
+	if c.Confidence == nil {
+		return 1
+	}
+	return *c.Confidence
+}
+
+// highestConfidence returns the higher of two confidences, a missing one
+// (not scored, so not doubted) winning.
+func highestConfidence(a, b *float64) *float64 {
+	if a == nil || b == nil {
+		return nil
+	}
+	if *b > *a {
+		return b
+	}
+	return a
+}
+
+// sameCell reports whether two readings of a cell agree: same type and, for
+// definition cells, the same definitions (see sameText).
+func sameCell(a, b Cell) bool {
+	if a.Black != b.Black || len(a.Definitions) != len(b.Definitions) {
+		return false
+	}
+	for k := range a.Definitions {
+		da, db := a.Definitions[k], b.Definitions[k]
+		if da.Direction != db.Direction || da.StartSide() != db.StartSide() || !sameText(da.Text, db.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameText reports whether two readings of a definition agree, ignoring
+// case, spacing and punctuation. A text cut by the edge of a photo agrees
+// with the whole text.
+func sameText(a, b string) bool {
+	a, b = foldText(a), foldText(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+func foldText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// mergeClues adds the clues read on another photo to a classic grid's.
+// A row or column read on both keeps its longer texts.
+func mergeClues(clues, more *NumberedClues) *NumberedClues {
+	if more == nil {
+		return clues
+	}
+	if clues == nil {
+		clues = &NumberedClues{}
+	}
+	merge := func(list, more []NumberedClue) []NumberedClue {
+		for _, c := range more {
+			found := false
+			for k := range list {
+				if list[k].Number == c.Number {
+					found = true
+					if len(strings.Join(c.Texts, "")) > len(strings.Join(list[k].Texts, "")) {
+						list[k] = c
+					}
+				}
+			}
+			if !found {
+				list = append(list, c)
+			}
+		}
+		return list
+	}
+	return &NumberedClues{
+		Horizontal: merge(cloneNumberedClues(clues.Horizontal), more.Horizontal),
+		Vertical:   merge(cloneNumberedClues(clues.Vertical), more.Vertical),
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tallGrid is a 6x4 arrow grid whose rows are told apart by the
+// definition in their first cell.
+func tallGrid() *Grid {
+	g := newTestGrid(6, 4)
+	for i, text := range []string{"Rongeur", "Note", "Fleuve", "Arbre", "Métal", "Oiseau"} {
+		g.Cells[i][0] = Cell{Black: true, Definitions: []Definition{{Text: text, Direction: "right"}}}
+	}
+	g.Cells[0][2] = Cell{Black: true, Definitions: []Definition{{Text: "Vers le bas", Direction: "down"}}}
+	return g
+}
+
+// subGrid returns a copy of the rows r0 to r1 and columns c0 to c1
+// (excluded) of g, as read on a photo showing only them.
+func subGrid(g *Grid, r0, r1, c0, c1 int) *Grid {
+	part := newTestGrid(r1-r0, c1-c0)
+	for i := r0; i < r1; i++ {
+		for j := c0; j < c1; j++ {
+			part.Cells[i-r0][j-c0] = g.Clone().Cells[i][j]
+		}
+	}
+	part.Kind = g.Kind
+	return part
+}
+
+func sameCells(a, b *Grid) bool {
+	if a.Rows != b.Rows || a.Cols != b.Cols {
+		return false
+	}
+	for i := range a.Cells {
+		for j := range a.Cells[i] {
+			if !sameCell(a.Cells[i][j], b.Cells[i][j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestMergeGridsDown(t *testing.T) {
+	full := tallGrid()
+	top, bottom := subGrid(full, 0, 4, 0, 4), subGrid(full, 2, 6, 0, 4)
+	bottom.Cells[0][0].Definitions[0].Text = "Fleu" // cut by the edge of the photo
+	top.Bounds = &Box{X: 0.1, Y: 0.1, Width: 0.8, Height: 0.8}
+
+	merged, overlaps, err := mergeGrids([]*Grid{top, bottom})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if !sameCells(merged, full) {
+		t.Fatalf("merged grid differs from the full grid: %dx%d", merged.Rows, merged.Cols)
+	}
+	if text := merged.Cells[2][0].Definitions[0].Text; text != "Fleuve" {
+		t.Errorf("the whole text should be kept, got %q", text)
+	}
+	if merged.Bounds != nil {
+		t.Error("a grid assembled from several photos cannot be located on one")
+	}
+	if len(overlaps) != 1 || overlaps[0].Direction != overlapDown || overlaps[0].Size != 2 || overlaps[0].Photos != [2]int{0, 1} || len(overlaps[0].Conflicts) != 0 {
+		t.Fatalf("unexpected overlaps %+v", overlaps)
+	}
+
+	// A cell read differently keeps the more confident reading, and is
+	// left for review.
+	bottom.Cells[1][1] = Cell{Black: true, Confidence: confidence(0.6)}
+	top.Cells[3][1].Confidence = confidence(0.9)
+	merged, overlaps, err = mergeGrids([]*Grid{top, bottom})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if len(overlaps) != 1 || overlaps[0].Size != 2 || !slices.Equal(overlaps[0].Conflicts, []Position{{3, 1}}) {
+		t.Fatalf("expected a conflict on (3, 1), got %+v", overlaps)
+	}
+	if cell := merged.Cells[3][1]; cell.Black || *cell.Confidence != conflictConfidence {
+		t.Fatalf("expected the letter cell with a lowered confidence, got %+v", cell)
+	}
+	if !strings.Contains(overlaps[0].Message, "1 case(s)") {
+		t.Errorf("unexpected message %q", overlaps[0].Message)
+	}
+}
+
+func TestMergeGridsRight(t *testing.T) {
+	full := tallGrid()
+	merged, overlaps, err := mergeGrids([]*Grid{subGrid(full, 0, 6, 0, 3), subGrid(full, 0, 6, 2, 4)})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if !sameCells(merged, full) {
+		t.Fatalf("merged grid differs from the full grid: %dx%d", merged.Rows, merged.Cols)
+	}
+	if len(overlaps) != 1 || overlaps[0].Direction != overlapRight || overlaps[0].Size != 1 {
+		t.Fatalf("unexpected overlaps %+v", overlaps)
+	}
+
+	// Photos that only touch are put end to end.
+	merged, overlaps, err = mergeGrids([]*Grid{subGrid(full, 0, 3, 0, 4), subGrid(full, 3, 6, 0, 4)})
+	if err != nil || !sameCells(merged, full) || overlaps[0].Size != 0 {
+		t.Fatalf("expected the halves end to end, got %+v, %v", overlaps, err)
+	}
+
+	if _, _, err := mergeGrids([]*Grid{full, newTestGrid(3, 3)}); !errors.Is(err, errUnmergeable) {
+		t.Fatalf("expected errUnmergeable, got %v", err)
+	}
+}
+
+func TestMergeGridsCluePage(t *testing.T) {
+	grid := classicTestGrid()
+	clues := grid.Clues
+	grid.Clues = nil
+	grid.Bounds = &Box{X: 0.2, Y: 0.2, Width: 0.5, Height: 0.5}
+	page := &Grid{Kind: KindClassic, Clues: clues}
+
+	merged, overlaps, err := mergeGrids([]*Grid{grid, page})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if len(overlaps) != 0 || merged.Rows != 3 || merged.Clues == nil || len(merged.Clues.Vertical) != 5 {
+		t.Fatalf("expected the grid with the clues of the page, got %+v", merged)
+	}
+	if merged.Bounds == nil {
+		t.Error("a grid read on the first photo alone keeps its bounds")
+	}
+
+	// The clue page may come first.
+	merged, _, err = mergeGrids([]*Grid{page, grid})
+	if err != nil || merged.Clues == nil || len(merged.Clues.Horizontal) != 3 || merged.Bounds != nil {
+		t.Fatalf("clue page first: got %+v, %v", merged, err)
+	}
+
+	if _, _, err := mergeGrids([]*Grid{page}); !errors.Is(err, errEmptyGrid) {
+		t.Fatalf("expected errEmptyGrid without cells, got %v", err)
+	}
+}
+
+// partsAnalyzer reads the grid registered for each photo, and counts its
+// calls.
+type partsAnalyzer struct {
+	grids map[string]*Grid // by photo content
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (a *partsAnalyzer) AnalyzeImage(_ context.Context, data []byte, _, _ string) (*Grid, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls++
+	grid, ok := a.grids[string(data)]
+	if !ok {
+		return nil, fmt.Errorf("unknown photo %q", data)
+	}
+	return grid.Clone(), nil
+}
+
+// multiPartsAnalyzer is a partsAnalyzer reading all the photos at once.
+type multiPartsAnalyzer struct{ *partsAnalyzer }
+
+func (a multiPartsAnalyzer) AnalyzeImages(_ context.Context, photos []Photo, _ string) ([]*Grid, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls++
+	var parts []*Grid
+	for _, photo := range photos {
+		parts = append(parts, a.grids[string(photo.Data)].Clone())
+	}
+	return parts, nil
+}
+
+// newMultiUploadRequest uploads several photos of a grid, in order.
+func newMultiUploadRequest(t *testing.T, photos ...[]byte) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, photo := range photos {
+		part, err := mw.CreateFormFile("image", fmt.Sprintf("part%d.png", k+1))
+		if err != nil {
+			t.Fatalf("create part: %v", err)
+		}
+		part.Write(photo)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/grids", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestUploadSeveralPhotos(t *testing.T) {
+	full := tallGrid()
+	top, bottom := fakePNG("top"), fakePNG("bottom")
+	analyzer := &partsAnalyzer{grids: map[string]*Grid{
+		string(top):    subGrid(full, 0, 4, 0, 4),
+		string(bottom): subGrid(full, 3, 6, 0, 4),
+	}}
+
+	for _, multi := range []bool{false, true} {
+		analyzer.calls = 0
+		var srv *Server
+		if multi {
+			srv = newAnalyzerServer(t, multiPartsAnalyzer{analyzer})
+		} else {
+			srv = newAnalyzerServer(t, analyzer)
+		}
+
+		job := analyzeUpload(t, srv, newMultiUploadRequest(t, top, bottom))
+		if len(job.Overlaps) != 1 || job.Overlaps[0].Size != 1 || job.Overlaps[0].Message == "" {
+			t.Fatalf("multi=%v: expected one reconciled row, got %+v", multi, job.Overlaps)
+		}
+		if want := map[bool]int{false: 2, true: 1}[multi]; analyzer.calls != want {
+			t.Errorf("multi=%v: %d analyzer calls, want %d", multi, analyzer.calls, want)
+		}
+		grid := srv.store.GetGrid(job.GridID)
+		if !sameCells(grid, full) {
+			t.Fatalf("multi=%v: stored grid is not the full grid", multi)
+		}
+		if len(grid.Images) != 2 || grid.ImageHash != grid.Images[0] {
+			t.Fatalf("multi=%v: expected both photos on the grid, got %v", multi, grid.Images)
+		}
+
+		// Each photo can be looked at.
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/image?photo=2", nil))
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), bottom) {
+			t.Fatalf("multi=%v: second photo: got %d", multi, w.Code)
+		}
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/image?photo=3", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("multi=%v: third photo: expected 404, got %d", multi, w.Code)
+		}
+
+		// The same photos are not analyzed again, unlike the first one alone.
+		calls := analyzer.calls
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, newMultiUploadRequest(t, top, bottom))
+		var again Job
+		json.NewDecoder(w.Body).Decode(&again)
+		if w.Code != http.StatusOK || !again.Cached || again.GridID != grid.ID {
+			t.Fatalf("multi=%v: expected the cached grid, got %d %+v", multi, w.Code, again)
+		}
+		if alone := analyzeUpload(t, srv, newMultiUploadRequest(t, top)); alone.Cached || len(alone.Overlaps) != 0 {
+			t.Fatalf("multi=%v: the first photo alone is another grid, got %+v", multi, alone)
+		}
+		if analyzer.calls != calls+1 {
+			t.Errorf("multi=%v: expected one more analysis, got %d", multi, analyzer.calls-calls)
+		}
+	}
+}
+
+func TestUploadSeveralPhotosErrors(t *testing.T) {
+	analyzer := &partsAnalyzer{grids: map[string]*Grid{
+		string(fakePNG("a")): newTestGrid(4, 4),
+		string(fakePNG("b")): newTestGrid(3, 3),
+	}}
+	srv := newAnalyzerServer(t, analyzer)
+
+	photos := make([][]byte, maxUploadImages+1)
+	for k := range photos {
+		photos[k] = fakePNG("a")
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newMultiUploadRequest(t, photos...))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("too many photos: expected 400, got %d", w.Code)
+	}
+
+	job := analyzeUpload(t, srv, newMultiUploadRequest(t, fakePNG("a"), fakePNG("b")))
+	if job.State != jobFailed || !strings.Contains(job.Error, "assemblées") {
+		t.Fatalf("expected a failed job for unrelated photos, got %+v", job)
+	}
+}
+
+func TestGeminiAnalyzeImages(t *testing.T) {
+	full := tallGrid()
+	parts, _ := json.Marshal(map[string]any{"parts": []*Grid{subGrid(full, 0, 4, 0, 4), subGrid(full, 2, 6, 0, 4)}})
+	g, _, requests := scriptedGemini(t,
+		scriptedCall{text: `{"parts": [` + scriptedGrid + `]}`},
+		scriptedCall{text: string(parts)},
+	)
+	photos := []Photo{{[]byte("top"), "image/png"}, {[]byte("bottom"), "image/jpeg"}}
+	grids, err := g.AnalyzeImages(context.Background(), photos, KindArrow)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if len(grids) != 2 || grids[1].Rows != 4 {
+		t.Fatalf("expected the grids of both photos, got %d", len(grids))
+	}
+	request := (*requests)[0][0]
+	if len(request.Parts) != 3 || request.Parts[2].InlineData.MIMEType != "image/jpeg" {
+		t.Fatal("expected the prompt followed by both photos")
+	}
+	// The first answer had one grid for two photos.
+	if retry := (*requests)[1]; !strings.Contains(retry[len(retry)-1].Parts[0].Text, "1 grids for 2 photos") {
+		t.Fatalf("expected a correction request, got %q", retry[len(retry)-1].Parts[0].Text)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // register the PNG decoder for image.Decode
+)
+
+const (
+	previewMaxSize = 800 // pixels, longest side of the downscaled variant
+	previewQuality = 80
+	rotatedQuality = 92 // JPEG quality of photos re-encoded upright
+
+	// maxImagePixels bounds the size of the images decoded: a small file
+	// can declare huge dimensions, and decoding it would take gigabytes.
+	maxImagePixels = 50_000_000
+)
+
+var errImageTooLarge = errors.New("image dimensions too large")
+
+// checkImageSize reads the dimensions declared in the header of an image
+// and returns errImageTooLarge if it has more than maxImagePixels. Data
+// that is not a readable image passes: decoding it fails anyway.
+func checkImageSize(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return fmt.Errorf("%dx%d: %w", cfg.Width, cfg.Height, errImageTooLarge)
+	}
+	return nil
+}
+
+// decodeImage decodes an image once checkImageSize accepted it.
+func decodeImage(data []byte) (image.Image, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// cleanUpload removes the metadata of an uploaded photo (EXIF, XMP and
+// comments in JPEG files, text and EXIF chunks in PNG files), which may
+// reveal where and with what device it was taken. JPEG photos taken
+// sideways are turned upright first, since their orientation is stored in
+// the EXIF data being removed. It also returns the decoded image, or nil
+// if the data is not a readable image; such data is returned unchanged.
+func cleanUpload(data []byte) ([]byte, image.Image) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		orientation := exifOrientation(data)
+		if stripped, ok := stripJPEGMetadata(data); ok {
+			data = stripped
+		}
+		img, err := decodeImage(data)
+		if err != nil {
+			return data, nil
+		}
+		if orientation > 1 {
+			img = orient(img, orientation)
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: rotatedQuality}); err == nil {
+				data = buf.Bytes()
+			}
+		}
+		return data, img
+	case bytes.HasPrefix(data, pngSignature):
+		if stripped, ok := stripPNGMetadata(data); ok {
+			data = stripped
+		}
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return data, nil
+	}
+	return data, img
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF, XMP), APP12, APP13 (IPTC),
+// APP15 and COM segments of a JPEG file. JFIF (APP0), ICC profiles (APP2) and Adobe
+// color information (APP14) are kept: they affect how the image looks.
+func stripJPEGMetadata(data []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...) // SOI
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, false
+		}
+		marker := data[i+1]
+		if marker == 0xDA { // start of scan: the rest is image data
+			return append(out, data[i:]...), true
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, false
+		}
+		switch {
+		case marker == 0xE1, marker >= 0xEC && marker <= 0xED, marker == 0xEF, marker == 0xFE:
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNGMetadata drops the text, time and EXIF chunks of a PNG file.
+func stripPNGMetadata(data []byte) ([]byte, bool) {
+	out := append([]byte(nil), pngSignature...)
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, false
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, false
+		}
+		switch string(data[i+4 : i+8]) {
+		case "tEXt", "zTXt", "iTXt", "tIME", "eXIf":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, true
+}
+
+// exifOrientation returns the EXIF orientation of a JPEG photo, from 1
+// (upright) to 8, or 0 if it has none.
+func exifOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+size > len(data) {
+			return 0
+		}
+		if seg := data[i+4 : i+2+size]; marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 0
+}
+
+// tiffOrientation reads the Orientation tag (0x0112) of the first IFD of
+// a TIFF structure, as found in EXIF data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) || ifd < 0 {
+		return 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for k := range n {
+		entry := ifd + 2 + 12*k
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orient applies an EXIF orientation to an image, so that it displays
+// upright without the orientation tag.
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// resizeImage scales an image down so that its longest side is at most
+// maxSize pixels, averaging the source pixels covered by each output pixel.
+// Smaller images are returned as is.
+func resizeImage(img image.Image, maxSize int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return img
+	}
+	dw, dh := maxSize, h*maxSize/w
+	if h > w {
+		dw, dh = w*maxSize/h, maxSize
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	type sum struct{ r, g, b, a, n uint64 }
+	sums := make([]sum, dw*dh)
+	for y := range h {
+		dy := y * dh / h
+		for x := range w {
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			s := &sums[dy*dw+x*dw/w]
+			s.r += uint64(r)
+			s.g += uint64(g)
+			s.b += uint64(bl)
+			s.a += uint64(a)
+			s.n++
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for i, s := range sums {
+		if s.n == 0 {
+			continue
+		}
+		dst.SetRGBA64(i%dw, i/dw, color.RGBA64{
+			R: uint16(s.r / s.n),
+			G: uint16(s.g / s.n),
+			B: uint16(s.b / s.n),
+			A: uint16(s.a / s.n),
+		})
+	}
+	return dst
+}
+
+// encodePreview encodes the downscaled variant of a photo.
+func encodePreview(small image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: previewQuality}); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
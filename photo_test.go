@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withJPEGSegment inserts a segment right after the SOI marker of a JPEG file.
+func withJPEGSegment(data []byte, marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	out := append([]byte(nil), data[:2]...)
+	out = append(out, seg...)
+	out = append(out, payload...)
+	return append(out, data[2:]...)
+}
+
+// exifWithOrientation builds a minimal big-endian EXIF block holding only
+// the Orientation tag.
+func exifWithOrientation(orientation uint16) []byte {
+	b := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	b = append(b, entry...)
+	return append(b, 0, 0, 0, 0) // no next IFD
+}
+
+// halfDark is a w×h image, dark on its left half and light on its right.
+func halfDark(w, h int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := uint8(230)
+			if x < w/2 {
+				c = 20
+			}
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+	return img
+}
+
+func gray(img image.Image, x, y int) uint32 {
+	r, _, _, _ := img.At(x, y).RGBA()
+	return r >> 8
+}
+
+func TestCleanUploadJPEG(t *testing.T) {
+	photo := encodeJPEG(t, halfDark(64, 32))
+	photo = withJPEGSegment(photo, 0xFE, []byte("Pris rue des Lilas"))
+	photo = withJPEGSegment(photo, 0xE1, exifWithOrientation(6))
+
+	if got := exifOrientation(photo); got != 6 {
+		t.Fatalf("orientation = %d, want 6", got)
+	}
+	cleaned, img := cleanUpload(photo)
+	if bytes.Contains(cleaned, []byte("Exif")) || bytes.Contains(cleaned, []byte("Lilas")) {
+		t.Fatal("metadata should be removed")
+	}
+	if img == nil {
+		t.Fatal("expected the decoded image")
+	}
+
+	// Orientation 6: the photo is turned clockwise, its left half on top.
+	decoded, err := jpeg.Decode(bytes.NewReader(cleaned))
+	if err != nil {
+		t.Fatalf("cleaned photo does not decode: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 32 || b.Dy() != 64 {
+		t.Fatalf("expected a 32x64 upright photo, got %dx%d", b.Dx(), b.Dy())
+	}
+	if top, bottom := gray(decoded, 16, 8), gray(decoded, 16, 56); top > 100 || bottom < 150 {
+		t.Fatalf("expected dark top and light bottom, got %d and %d", top, bottom)
+	}
+}
+
+func TestCleanUploadPNG(t *testing.T) {
+	photo := encodePNG(t, halfDark(16, 16))
+	// A tEXt chunk right after IHDR (8-byte signature + 25-byte IHDR).
+	text := []byte("tEXtComment\x00Pris rue des Lilas")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = append(chunk, 0, 0, 0, 0) // the CRC is not checked by the decoder
+	photo = append(append(append([]byte(nil), photo[:33]...), chunk...), photo[33:]...)
+
+	cleaned, img := cleanUpload(photo)
+	if bytes.Contains(cleaned, []byte("Lilas")) {
+		t.Fatal("text chunk should be removed")
+	}
+	if img == nil || img.Bounds().Dx() != 16 {
+		t.Fatal("cleaned PNG should still decode")
+	}
+}
+
+func TestCleanUploadUnknownData(t *testing.T) {
+	data := []byte("not an image")
+	cleaned, img := cleanUpload(data)
+	if !bytes.Equal(cleaned, data) || img != nil {
+		t.Fatal("unknown data should be returned unchanged")
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	small := resizeImage(halfDark(2000, 1000), previewMaxSize)
+	if b := small.Bounds(); b.Dx() != 800 || b.Dy() != 400 {
+		t.Fatalf("expected 800x400, got %dx%d", b.Dx(), b.Dy())
+	}
+	if left, right := gray(small, 100, 200), gray(small, 700, 200); left != 20 || right != 230 {
+		t.Fatalf("unexpected gray levels %d and %d", left, right)
+	}
+	if img := halfDark(10, 10); resizeImage(img, previewMaxSize) != img {
+		t.Fatal("small images should not be resized")
+	}
+}
+
+func TestGridImage(t *testing.T) {
+	srv := newFixtureServer(t)
+	photo := encodePNG(t, testPhoto(1200, 900, 0))
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", photo))
+
+	get := func(query string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/grids/"+job.GridID+"/image"+query, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("original: got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), srv.store.GetImage(srv.store.GetGrid(job.GridID).ImageHash).Data) {
+		t.Fatal("expected the stored photo")
+	}
+	etag := w.Header().Get("ETag")
+	if w := get("", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a known ETag, got %d", w.Code)
+	}
+
+	w = get("?size=preview", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("preview: got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	preview, err := jpeg.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("preview does not decode: %v", err)
+	}
+	if b := preview.Bounds(); b.Dx() != 800 || b.Dy() != 600 {
+		t.Fatalf("expected an 800x600 preview, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	if w := get("?size=huge", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown size: expected 400, got %d", w.Code)
+	}
+
+	// Imported grids have no photo.
+	grid := seedGrid(srv)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/image", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("grid without photo: expected 404, got %d", w.Code)
+	}
+}
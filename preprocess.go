@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Preprocessing steps applied to a photo before it is analyzed. Photos are
+// always upright: their EXIF orientation is applied when they are uploaded
+// (see cleanUpload).
+const (
+	stepResize    = "resize"    // scale down to analysisMaxSize
+	stepGrayscale = "grayscale" // drop colors
+	stepContrast  = "contrast"  // even out shadows, stretch the gray levels
+	stepDeskew    = "deskew"    // straighten the grid border into a rectangle
+)
+
+// preprocessSteps are all the steps, in the order they are applied. The
+// photo is scaled down first so that the other steps handle fewer pixels.
+var preprocessSteps = []string{stepResize, stepGrayscale, stepContrast, stepDeskew}
+
+const (
+	analysisMaxSize  = 2048 // pixels, longest side of the image sent to the analyzer
+	processedQuality = 92
+	borderScanSize   = 600 // pixels, longest side of the image searched for the grid border
+)
+
+// parseSteps reads the preprocess form value of an upload: a comma-separated
+// list of steps, "none", or empty for all of them. The steps are returned
+// in the order they are applied.
+func parseSteps(v string) ([]string, error) {
+	switch v = strings.TrimSpace(v); v {
+	case "":
+		return preprocessSteps, nil
+	case "none":
+		return []string{}, nil
+	}
+	var steps []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !slices.Contains(preprocessSteps, s) {
+			return nil, fmt.Errorf("unknown preprocessing step %q", s)
+		}
+		steps = append(steps, s)
+	}
+	return slices.DeleteFunc(slices.Clone(preprocessSteps), func(s string) bool { return !slices.Contains(steps, s) }), nil
+}
+
+// analysisKey names the analysis of a photo for a kind of grid and a set of
+// preprocessing steps, in SourceImage.Grids. The default steps leave the
+// kind alone. The analysis of a grid uploaded in several photos is recorded
+// on the first one, its key naming the others.
+func analysisKey(kind string, steps []string, others ...string) string {
+	key := kind
+	if !slices.Equal(steps, preprocessSteps) {
+		key += "/" + processedVariant(steps)
+	}
+	for _, hash := range others {
+		key += "+" + hash
+	}
+	return key
+}
+
+// processedVariant names the processed version of a photo in the store.
+func processedVariant(steps []string) string {
+	if len(steps) == 0 {
+		return "processed"
+	}
+	return "processed:" + strings.Join(steps, "+")
+}
+
+// Preprocessed is a photo prepared for the analyzer.
+type Preprocessed struct {
+	Data     []byte
+	MIMEType string
+	Steps    []string // the steps applied; deskew is skipped when no border is found
+
+	// toSource maps a point of the processed image back to the photo, in
+	// pixels of the working image, when it was deskewed.
+	toSource *homography
+	width    int
+	height   int
+}
+
+// preprocess applies steps to an uploaded photo. It returns nil if the
+// photo cannot be decoded or no step changed it: the photo is then
+// analyzed as is.
+func preprocess(data []byte, steps []string) *Preprocessed {
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil
+	}
+	p := &Preprocessed{}
+	img := src
+	for _, step := range steps {
+		switch step {
+		case stepResize:
+			b := img.Bounds()
+			if b.Dx() <= analysisMaxSize && b.Dy() <= analysisMaxSize {
+				continue
+			}
+			img = resizeImage(img, analysisMaxSize)
+		case stepGrayscale:
+			img = grayscale(img)
+		case stepContrast:
+			img = normalizeContrast(img)
+		case stepDeskew:
+			out, h, ok := deskew(img)
+			if !ok {
+				continue
+			}
+			img, p.toSource = out, h
+		}
+		p.Steps = append(p.Steps, step)
+	}
+	if len(p.Steps) == 0 {
+		return nil
+	}
+	p.width, p.height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: processedQuality}); err != nil {
+		return nil
+	}
+	p.Data, p.MIMEType = buf.Bytes(), "image/jpeg"
+	return p
+}
+
+// sourceBox maps a box of the processed image to the photo. Resizing keeps
+// the fractions of a box; deskewing moves it, and the result is the
+// smallest box holding its four corners.
+func (p *Preprocessed) sourceBox(b *Box) *Box {
+	if p == nil || p.toSource == nil || b == nil {
+		return b
+	}
+	w, h := float64(p.width), float64(p.height)
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, c := range [][2]float64{{b.X, b.Y}, {b.X + b.Width, b.Y}, {b.X, b.Y + b.Height}, {b.X + b.Width, b.Y + b.Height}} {
+		x, y := p.toSource.apply(c[0]*w, c[1]*h)
+		minX, minY = min(minX, x/w), min(minY, y/h)
+		maxX, maxY = max(maxX, x/w), max(maxY, y/h)
+	}
+	minX, minY = max(minX, 0), max(minY, 0)
+	maxX, maxY = min(maxX, 1), min(maxY, 1)
+	if maxX <= minX || maxY <= minY {
+		return nil
+	}
+	return &Box{X: minX, Y: minY, Width: maxX - minX, Height: maxY - minY}
+}
+
+// grayscale converts an image to gray levels.
+func grayscale(img image.Image) *image.Gray {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray
+}
+
+// toRGBA returns an RGBA copy of an image, with its origin at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// normalizeContrast evens out the lighting of a photo of paper: each pixel
+// is divided by the local brightness of the page, which removes shadows,
+// then the gray levels are stretched so that ink is black and paper white.
+// Gray images stay gray.
+func normalizeContrast(img image.Image) image.Image {
+	gray := grayscale(img)
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	background := boxBlur(gray.Pix, w, h, max(w, h)/16)
+
+	// Flattened luminance, and its 1st and 99th percentiles.
+	var hist [256]int
+	flat := make([]float64, len(gray.Pix))
+	for i, v := range gray.Pix {
+		flat[i] = min(float64(v)*255/max(float64(background[i]), 1), 255)
+		hist[int(flat[i])]++
+	}
+	lo, hi := percentile(hist, 0.01), percentile(hist, 0.99)
+	if hi-lo < 16 {
+		lo, hi = 0, 255 // a blank page: nothing to stretch
+	}
+	scale := 255 / float64(hi-lo)
+	level := func(v float64) uint8 {
+		return uint8(min(max((v-float64(lo))*scale, 0), 255))
+	}
+
+	if _, ok := img.(*image.Gray); ok {
+		for i, v := range flat {
+			gray.Pix[i] = level(v)
+		}
+		return gray
+	}
+	rgba := toRGBA(img)
+	for i := range gray.Pix {
+		gain := 255 / max(float64(background[i]), 1)
+		for c := range 3 {
+			rgba.Pix[4*i+c] = level(min(float64(rgba.Pix[4*i+c])*gain, 255))
+		}
+	}
+	return rgba
+}
+
+// boxBlur averages each pixel of a w×h plane with its neighbours within r
+// pixels, using a summed-area table.
+func boxBlur(pix []uint8, w, h, r int) []uint8 {
+	r = max(r, 1)
+	sum := make([]int, (w+1)*(h+1))
+	for y := range h {
+		row := 0
+		for x := range w {
+			row += int(pix[y*w+x])
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + row
+		}
+	}
+	out := make([]uint8, len(pix))
+	for y := range h {
+		y0, y1 := max(y-r, 0), min(y+r+1, h)
+		for x := range w {
+			x0, x1 := max(x-r, 0), min(x+r+1, w)
+			total := sum[y1*(w+1)+x1] - sum[y0*(w+1)+x1] - sum[y1*(w+1)+x0] + sum[y0*(w+1)+x0]
+			out[y*w+x] = uint8(total / ((y1 - y0) * (x1 - x0)))
+		}
+	}
+	return out
+}
+
+// percentile returns the level below which the fraction q of a histogram
+// lies.
+func percentile(hist [256]int, q float64) int {
+	total := 0
+	for _, n := range hist {
+		total += n
+	}
+	target, seen := int(q*float64(total)), 0
+	for level, n := range hist {
+		if seen += n; seen > target {
+			return level
+		}
+	}
+	return 255
+}
+
+// deskew finds the outer border of the grid and warps the image so that
+// the border becomes an upright rectangle of the same size, keeping what
+// surrounds it (the clues of a classic grid). It also returns the mapping
+// from the result back to the image. ok is false if no border was found,
+// or if the grid is already straight.
+func deskew(img image.Image) (image.Image, *homography, bool) {
+	quad, ok := findGridBorder(img)
+	if !ok {
+		return nil, nil, false
+	}
+	tl, tr, br, bl := quad[0], quad[1], quad[2], quad[3]
+	width := (dist(tl, tr) + dist(bl, br)) / 2
+	height := (dist(tl, bl) + dist(tr, br)) / 2
+	rect := [4]point{tl, {tl.x + width, tl.y}, {tl.x + width, tl.y + height}, {tl.x, tl.y + height}}
+
+	b := img.Bounds()
+	tolerance := 0.005 * float64(max(b.Dx(), b.Dy()))
+	straight := true
+	for i := range quad {
+		if dist(quad[i], rect[i]) > tolerance {
+			straight = false
+		}
+	}
+	if straight {
+		return nil, nil, false
+	}
+	h, ok := solveHomography(rect, quad)
+	if !ok {
+		return nil, nil, false
+	}
+	return warp(img, h), h, true
+}
+
+// findGridBorder looks for the outer border of the grid: the largest
+// connected set of dark pixels that does not touch the edges of the photo
+// (grid lines are all connected through the border). It returns its
+// corners, clockwise from the top left, in pixels of img.
+func findGridBorder(img image.Image) ([4]point, bool) {
+	small := grayscale(resizeImage(img, borderScanSize))
+	w, h := small.Rect.Dx(), small.Rect.Dy()
+	scale := float64(img.Bounds().Dx()) / float64(w)
+
+	var hist [256]int
+	for _, v := range small.Pix {
+		hist[v]++
+	}
+	threshold := otsu(hist)
+	dark := make([]bool, len(small.Pix))
+	for i, v := range small.Pix {
+		dark[i] = v < threshold
+	}
+
+	// Label the connected sets of dark pixels, keeping the one with the
+	// largest bounding box among those away from the edges.
+	seen := make([]bool, len(dark))
+	var best []int
+	bestArea := 0
+	queue := make([]int, 0, 1024)
+	for start := range dark {
+		if !dark[start] || seen[start] {
+			continue
+		}
+		queue = append(queue[:0], start)
+		seen[start] = true
+		minX, minY, maxX, maxY := w, h, 0, 0
+		for k := 0; k < len(queue); k++ {
+			i := queue[k]
+			x, y := i%w, i/w
+			minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+			for _, n := range [4]int{i - 1, i + 1, i - w, i + w} {
+				if n < 0 || n >= len(dark) || (n == i-1 && x == 0) || (n == i+1 && x == w-1) {
+					continue
+				}
+				if dark[n] && !seen[n] {
+					seen[n] = true
+					queue = append(queue, n)
+				}
+			}
+		}
+		if minX == 0 || minY == 0 || maxX == w-1 || maxY == h-1 {
+			continue
+		}
+		if area := (maxX - minX) * (maxY - minY); area > bestArea {
+			best, bestArea = slices.Clone(queue), area
+		}
+	}
+	if bestArea < w*h/5 {
+		return [4]point{}, false
+	}
+
+	quad, ok := fitBorder(best, w, h)
+	if !ok {
+		// The corners are the extreme pixels along the diagonals.
+		var scores [4]float64
+		for k, i := range best {
+			x, y := float64(i%w), float64(i/w)
+			for c, s := range [4]float64{-x - y, x - y, x + y, y - x} {
+				if k == 0 || s > scores[c] {
+					scores[c], quad[c] = s, point{x, y}
+				}
+			}
+		}
+	}
+	for c := range quad {
+		quad[c] = point{(quad[c].x + 0.5) * scale, (quad[c].y + 0.5) * scale}
+	}
+	return quad, convex(quad)
+}
+
+// fitBorder fits a straight line to each side of the border of a grid, a
+// set of pixels of a w×h image, and returns the corners where they meet.
+// The outermost pixel of each column (or row) lies on the border, except
+// where the border is too faint to be seen, then belonging to an inner grid
+// line, or where something outside the grid touches it: the line is fitted
+// to the pixels agreeing with most others.
+func fitBorder(pixels []int, w, h int) ([4]point, bool) {
+	minX, maxX := slices.Repeat([]int{-1}, h), slices.Repeat([]int{-1}, h)
+	minY, maxY := slices.Repeat([]int{-1}, w), slices.Repeat([]int{-1}, w)
+	for _, i := range pixels {
+		x, y := i%w, i/w
+		if minX[y] < 0 || x < minX[y] {
+			minX[y] = x
+		}
+		maxX[y] = max(maxX[y], x)
+		if minY[x] < 0 || y < minY[x] {
+			minY[x] = y
+		}
+		maxY[x] = max(maxY[x], y)
+	}
+	// Sides clockwise from the top.
+	var lines [4]line
+	for k, outer := range [4][]int{minY, maxX, maxY, minX} {
+		var at, pos []float64
+		for a, v := range outer {
+			if v >= 0 {
+				at, pos = append(at, float64(a)), append(pos, float64(v))
+			}
+		}
+		l, ok := fitSide(at, pos)
+		if !ok {
+			return [4]point{}, false
+		}
+		lines[k] = l
+	}
+	top, right, bottom, left := lines[0], lines[1], lines[2], lines[3]
+	return [4]point{
+		intersect(top, left), intersect(top, right),
+		intersect(bottom, right), intersect(bottom, left),
+	}, true
+}
+
+// line is pos = slope*at + offset: y as a function of x for the top and
+// bottom sides of a grid, x as a function of y for the left and right ones.
+type line struct{ slope, offset float64 }
+
+const (
+	// borderTolerance is the largest distance, in pixels, from a side of
+	// the border of the points taken as lying on it.
+	borderTolerance = 2
+	// sideSamples is the number of sample points, taken in pairs, through
+	// which candidate sides are drawn.
+	sideSamples = 32
+)
+
+// fitSide fits a line to the points (at, pos), leaving out those away from
+// most others: among the lines through pairs of sample points, the one
+// passing closest to the most points is kept, then fitted by least squares
+// to these points. It fails if they are less than a quarter of the points.
+func fitSide(at, pos []float64) (line, bool) {
+	n := len(at)
+	if n < 2 {
+		return line{}, false
+	}
+	near := func(l line) []int {
+		var in []int
+		for k := range at {
+			if math.Abs(pos[k]-(l.slope*at[k]+l.offset)) <= borderTolerance {
+				in = append(in, k)
+			}
+		}
+		return in
+	}
+	var best []int
+	step := max(n/sideSamples, 1)
+	for i := 0; i < n; i += step {
+		for j := i + step; j < n; j += step {
+			if at[j] == at[i] {
+				continue
+			}
+			slope := (pos[j] - pos[i]) / (at[j] - at[i])
+			if in := near(line{slope, pos[i] - slope*at[i]}); len(in) > len(best) {
+				best = in
+			}
+		}
+	}
+	if len(best) < max(n/4, 2) {
+		return line{}, false
+	}
+	var sa, sp, saa, sap float64
+	for _, k := range best {
+		sa, sp, saa, sap = sa+at[k], sp+pos[k], saa+at[k]*at[k], sap+at[k]*pos[k]
+	}
+	m := float64(len(best))
+	det := m*saa - sa*sa
+	if det == 0 {
+		return line{}, false
+	}
+	slope := (m*sap - sa*sp) / det
+	return line{slope, (sp - slope*sa) / m}, true
+}
+
+// intersect returns the point where a horizontal side of a grid (y as a
+// function of x) meets a vertical one (x as a function of y).
+func intersect(horizontal, vertical line) point {
+	// x = v.slope*(h.slope*x + h.offset) + v.offset
+	x := (vertical.slope*horizontal.offset + vertical.offset) / (1 - vertical.slope*horizontal.slope)
+	return point{x, horizontal.slope*x + horizontal.offset}
+}
+
+// otsu returns the threshold that best separates the two classes of gray
+// levels of a histogram (ink and paper).
+func otsu(hist [256]int) uint8 {
+	total, sum := 0, 0.0
+	for level, n := range hist {
+		total += n
+		sum += float64(level * n)
+	}
+	var best uint8
+	bestVar, countB, sumB := -1.0, 0, 0.0
+	for level, n := range hist {
+		countB += n
+		if countB == 0 || countB == total {
+			continue
+		}
+		sumB += float64(level * n)
+		meanB := sumB / float64(countB)
+		meanF := (sum - sumB) / float64(total-countB)
+		if v := float64(countB) * float64(total-countB) * (meanB - meanF) * (meanB - meanF); v > bestVar {
+			bestVar, best = v, uint8(level+1)
+		}
+	}
+	return best
+}
+
+type point struct{ x, y float64 }
+
+func dist(a, b point) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// convex reports whether the corners, in order, form a convex quadrilateral
+// turning clockwise (in image coordinates).
+func convex(q [4]point) bool {
+	for i := range q {
+		a, b, c := q[i], q[(i+1)%4], q[(i+2)%4]
+		if (b.x-a.x)*(c.y-b.y)-(b.y-a.y)*(c.x-b.x) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// homography is a projective mapping of the plane.
+type homography [9]float64
+
+func (h *homography) apply(x, y float64) (float64, float64) {
+	d := h[6]*x + h[7]*y + h[8]
+	return (h[0]*x + h[1]*y + h[2]) / d, (h[3]*x + h[4]*y + h[5]) / d
+}
+
+// solveHomography returns the homography taking the four points from to
+// the four points to.
+func solveHomography(from, to [4]point) (*homography, bool) {
+	// Two equations per point pair, for the 8 unknowns h0..h7 (h8 = 1).
+	var a [8][9]float64
+	for i := range 4 {
+		x, y, u, v := from[i].x, from[i].y, to[i].x, to[i].y
+		a[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		a[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+	// Gaussian elimination with partial pivoting.
+	for col := range 8 {
+		pivot := col
+		for r := col + 1; r < 8; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for r := range 8 {
+			if r == col {
+				continue
+			}
+			f := a[r][col] / a[col][col]
+			for c := col; c < 9; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+		}
+	}
+	var h homography
+	for i := range 8 {
+		h[i] = a[i][8] / a[i][i]
+	}
+	h[8] = 1
+	return &h, true
+}
+
+// warp builds an image of the same size as img whose pixel (x, y) is the
+// pixel h(x, y) of img, interpolated between its neighbours. Points outside
+// img are white.
+func warp(img image.Image, h *homography) image.Image {
+	b := img.Bounds()
+	w, ht := b.Dx(), b.Dy()
+	if gray, ok := img.(*image.Gray); ok {
+		out := image.NewGray(image.Rect(0, 0, w, ht))
+		for y := range ht {
+			for x := range w {
+				sx, sy := h.apply(float64(x)+0.5, float64(y)+0.5)
+				out.Pix[y*out.Stride+x] = uint8(bilinear(gray.Pix, gray.Stride, 1, 0, w, ht, sx-0.5, sy-0.5))
+			}
+		}
+		return out
+	}
+	src := toRGBA(img)
+	out := image.NewRGBA(image.Rect(0, 0, w, ht))
+	for y := range ht {
+		for x := range w {
+			sx, sy := h.apply(float64(x)+0.5, float64(y)+0.5)
+			for c := range 4 {
+				out.Pix[y*out.Stride+4*x+c] = uint8(bilinear(src.Pix, src.Stride, 4, c, w, ht, sx-0.5, sy-0.5))
+			}
+		}
+	}
+	return out
+}
+
+// bilinear samples channel c of a w×h plane of pixels of size n bytes at
+// (x, y), white outside.
+func bilinear(pix []uint8, stride, n, c, w, h int, x, y float64) float64 {
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+	at := func(px, py int) float64 {
+		if px < 0 || py < 0 || px >= w || py >= h {
+			return 255
+		}
+		return float64(pix[py*stride+px*n+c])
+	}
+	top := at(x0, y0)*(1-fx) + at(x0+1, y0)*fx
+	bottom := at(x0, y0+1)*(1-fx) + at(x0+1, y0+1)*fx
+	return top*(1-fy) + bottom*fy
+}
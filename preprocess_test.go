@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// skewedGrid draws a 5x5 grid whose border is the quadrilateral quad
+// (clockwise from the top left) on a white w×h page.
+func skewedGrid(w, h int, quad [4]point) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 235
+	}
+	at := func(u, v float64) point {
+		top := point{quad[0].x + (quad[1].x-quad[0].x)*u, quad[0].y + (quad[1].y-quad[0].y)*u}
+		bottom := point{quad[3].x + (quad[2].x-quad[3].x)*u, quad[3].y + (quad[2].y-quad[3].y)*u}
+		return point{top.x + (bottom.x-top.x)*v, top.y + (bottom.y-top.y)*v}
+	}
+	dot := func(p point) {
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				img.SetGray(int(p.x)+dx, int(p.y)+dy, color.Gray{Y: 20})
+			}
+		}
+	}
+	for k := range 6 {
+		for t := range 1001 {
+			dot(at(float64(k)/5, float64(t)/1000))
+			dot(at(float64(t)/1000, float64(k)/5))
+		}
+	}
+	return img
+}
+
+var testQuad = [4]point{{60, 50}, {340, 72}, {330, 262}, {72, 240}}
+
+func near(a, b point, tolerance float64) bool {
+	return dist(a, b) <= tolerance
+}
+
+func TestParseSteps(t *testing.T) {
+	for v, want := range map[string]string{
+		"":                  "resize,grayscale,contrast,deskew",
+		"none":              "",
+		"deskew, Grayscale": "grayscale,deskew",
+	} {
+		steps, err := parseSteps(v)
+		if err != nil || strings.Join(steps, ",") != want {
+			t.Errorf("parseSteps(%q) = %v, %v; want %s", v, steps, err, want)
+		}
+	}
+	if _, err := parseSteps("blur"); err == nil {
+		t.Error("expected an error for an unknown step")
+	}
+}
+
+func TestFindGridBorder(t *testing.T) {
+	quad, ok := findGridBorder(skewedGrid(400, 300, testQuad))
+	if !ok {
+		t.Fatal("border not found")
+	}
+	for i := range quad {
+		if !near(quad[i], testQuad[i], 4) {
+			t.Errorf("corner %d = %v, want %v", i, quad[i], testQuad[i])
+		}
+	}
+
+	blank := image.NewGray(image.Rect(0, 0, 400, 300))
+	if _, ok := findGridBorder(blank); ok {
+		t.Error("no border expected on a blank page")
+	}
+}
+
+func TestDeskew(t *testing.T) {
+	out, h, ok := deskew(skewedGrid(400, 300, testQuad))
+	if !ok {
+		t.Fatal("expected the grid to be straightened")
+	}
+	if _, isGray := out.(*image.Gray); !isGray {
+		t.Error("gray images should stay gray")
+	}
+	quad, ok := findGridBorder(out)
+	if !ok {
+		t.Fatal("border lost after deskewing")
+	}
+	tl, tr, br, bl := quad[0], quad[1], quad[2], quad[3]
+	if math.Abs(tl.y-tr.y) > 3 || math.Abs(bl.y-br.y) > 3 || math.Abs(tl.x-bl.x) > 3 || math.Abs(tr.x-br.x) > 3 {
+		t.Fatalf("border is not upright: %v", quad)
+	}
+
+	// Points of the result map back to the photo.
+	for i := range quad {
+		x, y := h.apply(quad[i].x, quad[i].y)
+		if !near(point{x, y}, testQuad[i], 5) {
+			t.Errorf("corner %d maps back to (%.0f, %.0f), want %v", i, x, y, testQuad[i])
+		}
+	}
+
+	straight := skewedGrid(400, 300, [4]point{{60, 50}, {340, 50}, {340, 250}, {60, 250}})
+	if _, _, ok := deskew(straight); ok {
+		t.Error("a straight grid should be left alone")
+	}
+}
+
+func TestNormalizeContrast(t *testing.T) {
+	// A page darkened by a shadow on its left, with ink spots.
+	img := image.NewGray(image.Rect(0, 0, 400, 200))
+	for y := range 200 {
+		for x := range 400 {
+			paper := 110 + 130*x/400
+			if x%50 < 8 && y%50 < 8 {
+				paper /= 6
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(paper)})
+		}
+	}
+	out, ok := normalizeContrast(img).(*image.Gray)
+	if !ok {
+		t.Fatal("gray images should stay gray")
+	}
+	for _, x := range []int{20, 380} {
+		if paper := out.GrayAt(x, 120).Y; paper < 220 {
+			t.Errorf("paper at x=%d is %d after normalization, want white", x, paper)
+		}
+	}
+	if ink := out.GrayAt(53, 53).Y; ink > 60 {
+		t.Errorf("ink is %d after normalization, want black", ink)
+	}
+}
+
+// recordingAnalyzer returns a 2x2 grid covering the middle of the image,
+// and records the images it is given.
+type recordingAnalyzer struct {
+	mu     sync.Mutex
+	images [][]byte
+	mimes  []string
+}
+
+func (a *recordingAnalyzer) AnalyzeImage(_ context.Context, data []byte, mimeType, _ string) (*Grid, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.images = append(a.images, data)
+	a.mimes = append(a.mimes, mimeType)
+	g := newTestGrid(2, 2)
+	g.Bounds = &Box{X: 0.25, Y: 0.25, Width: 0.5, Height: 0.5}
+	return g, nil
+}
+
+func TestUploadPreprocess(t *testing.T) {
+	analyzer := &recordingAnalyzer{}
+	srv := newAnalyzerServer(t, analyzer)
+	photo := encodePNG(t, skewedGrid(400, 300, testQuad))
+
+	upload := func(steps string) *Grid {
+		req := newUploadRequest(t, "image/png", photo)
+		req.URL.RawQuery = "preprocess=" + steps
+		return srv.store.GetGrid(analyzeUpload(t, srv, req).GridID)
+	}
+	processedImage := func(grid *Grid) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/image?size=processed", nil))
+		return w
+	}
+
+	grid := upload("")
+	if !slices.Equal(grid.Preprocess, []string{stepGrayscale, stepContrast, stepDeskew}) {
+		t.Fatalf("applied steps = %v", grid.Preprocess)
+	}
+	if analyzer.mimes[0] != "image/jpeg" {
+		t.Fatalf("analyzer got %s, want the processed JPEG", analyzer.mimes[0])
+	}
+	processed, err := jpeg.Decode(bytes.NewReader(analyzer.images[0]))
+	if err != nil {
+		t.Fatalf("processed image does not decode: %v", err)
+	}
+	if _, ok := processed.(*image.Gray); !ok {
+		t.Errorf("processed image should be gray, got %T", processed)
+	}
+	// The bounds found on the straightened image are moved back to the photo.
+	if b := grid.Bounds; b == nil || boxNear(b, Box{X: 0.25, Y: 0.25, Width: 0.5, Height: 0.5}) {
+		t.Errorf("bounds should be mapped to the photo, got %+v", b)
+	}
+	w := processedImage(grid)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), analyzer.images[0]) {
+		t.Fatalf("processed image: got %d", w.Code)
+	}
+
+	// Other steps make another analysis of the same photo.
+	grid = upload("none")
+	if len(analyzer.images) != 2 || !bytes.Equal(analyzer.images[1], srv.store.GetImage(grid.ImageHash).Data) {
+		t.Fatal("without preprocessing, the analyzer should get the photo")
+	}
+	if len(grid.Preprocess) != 0 || processedImage(grid).Code != http.StatusNotFound {
+		t.Fatal("expected no processed image")
+	}
+
+	req := newUploadRequest(t, "image/png", photo)
+	req.URL.RawQuery = "preprocess=blur"
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown step: expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Across Lite .puz files are binary: a fixed header, the solution and the
+// player state (one byte per cell, '.' for blocks), then NUL-terminated
+// strings: title, author, copyright, the clues and notes. Clues are not
+// numbered; they follow the cells in reading order, across before down.
+const (
+	puzMagic      = "ACROSS&DOWN\x00"
+	puzHeaderSize = 0x34
+)
+
+func isPuz(data []byte) bool {
+	return len(data) >= puzHeaderSize && string(data[0x02:0x0E]) == puzMagic
+}
+
+func importPuz(data []byte) (*Grid, error) {
+	if !isPuz(data) {
+		return nil, fmt.Errorf("not an Across Lite file")
+	}
+	cols, rows := int(data[0x2C]), int(data[0x2D])
+	if err := checkImportSize(rows, cols); err != nil {
+		return nil, err
+	}
+	numClues := int(binary.LittleEndian.Uint16(data[0x2E:]))
+	scrambled := binary.LittleEndian.Uint16(data[0x32:]) != 0
+	isUTF8 := data[0x18] >= '2' // before version 2.0, text is ISO-8859-1
+
+	body := data[puzHeaderSize:]
+	if len(body) < 2*rows*cols {
+		return nil, fmt.Errorf("truncated .puz file")
+	}
+	solution := body[:rows*cols]
+	strs := bytes.Split(body[2*rows*cols:], []byte{0})
+	if len(strs) < 3+numClues {
+		return nil, fmt.Errorf(".puz file has %d strings, expected %d clues", len(strs)-3, numClues)
+	}
+	clueTexts := strs[3 : 3+numClues]
+
+	p := &numberedPuzzle{Rows: rows, Cols: cols, Black: make([][]bool, rows)}
+	if !scrambled {
+		p.Solution = make([][]string, rows)
+	}
+	for i := range rows {
+		p.Black[i] = make([]bool, cols)
+		if p.Solution != nil {
+			p.Solution[i] = make([]string, cols)
+		}
+		for j := range cols {
+			b := solution[i*cols+j]
+			p.Black[i][j] = b == '.' || b == ':'
+			if p.Solution != nil && !p.Black[i][j] && b >= 'A' && b <= 'Z' {
+				p.Solution[i][j] = string(rune(b))
+			}
+		}
+	}
+
+	p.Numbers = standardNumbers(p.Black)
+	next := 0
+	for i := range rows {
+		for j := range cols {
+			if p.Numbers[i][j] == 0 {
+				continue
+			}
+			across, down := startsWord(p.Black, i, j)
+			for _, dir := range []string{"right", "down"} {
+				if dir == "right" && !across || dir == "down" && !down {
+					continue
+				}
+				if next >= len(clueTexts) {
+					return nil, fmt.Errorf(".puz file has fewer clues than words")
+				}
+				p.Clues = append(p.Clues, numberedClue{
+					Direction: dir,
+					Number:    p.Numbers[i][j],
+					Text:      puzString(clueTexts[next], isUTF8),
+				})
+				next++
+			}
+		}
+	}
+	return p.toGrid()
+}
+
+// puzString decodes a .puz string, either UTF-8 or ISO-8859-1.
+func puzString(b []byte, isUTF8 bool) string {
+	if isUTF8 {
+		return strings.TrimSpace(string(b))
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return strings.TrimSpace(string(runes))
+}
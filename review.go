@@ -0,0 +1,120 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Review item types.
+const (
+	reviewCell       = "cell"       // letter or definition cell
+	reviewDefinition = "definition" // text of a definition in a cell
+	reviewClue       = "clue"       // clue texts of a row or column (classic grids)
+)
+
+// defaultReviewThreshold is the confidence below which an extracted item
+// is listed for review.
+const defaultReviewThreshold = 0.8
+
+// ReviewItem is a part of an extracted grid the analyzer is unsure about.
+// Cell addresses cells and definitions, Index being the definition within
+// the cell; Direction and Number address the clues of a row ("right") or
+// column ("down").
+type ReviewItem struct {
+	Type       string    `json:"type"`
+	Cell       *Position `json:"cell,omitempty"`
+	Index      int       `json:"index,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	Number     int       `json:"number,omitempty"`
+	Text       string    `json:"text,omitempty"`
+	Confidence float64   `json:"confidence"`
+	Message    string    `json:"message"`
+}
+
+// Review lists the cells, definitions and clues whose confidence is below
+// threshold, least confident first. Items without a confidence (imported,
+// confirmed or corrected by hand) are never listed.
+func (g *Grid) Review(threshold float64) []ReviewItem {
+	items := []ReviewItem{}
+	low := func(c *float64) bool { return c != nil && *c < threshold }
+
+	for i, row := range g.Cells {
+		for j, cell := range row {
+			if low(cell.Confidence) {
+				kind := "lettre"
+				switch {
+				case cell.Black && g.Classic():
+					kind = "noire"
+				case cell.Black:
+					kind = "définition"
+				}
+				items = append(items, ReviewItem{
+					Type:       reviewCell,
+					Cell:       &Position{Row: i, Col: j},
+					Confidence: *cell.Confidence,
+					Message:    fmt.Sprintf("Case (%d, %d) : case %s à vérifier", i+1, j+1, kind),
+				})
+			}
+			for k, def := range cell.Definitions {
+				if low(def.Confidence) {
+					items = append(items, ReviewItem{
+						Type:       reviewDefinition,
+						Cell:       &Position{Row: i, Col: j},
+						Index:      k,
+						Text:       def.Text,
+						Confidence: *def.Confidence,
+						Message:    fmt.Sprintf("Case (%d, %d) : définition « %s » à vérifier", i+1, j+1, def.Text),
+					})
+				}
+			}
+		}
+	}
+
+	if g.Clues != nil {
+		lists := []struct {
+			clues     []NumberedClue
+			direction string
+			line      string
+		}{
+			{g.Clues.Horizontal, "right", "ligne"},
+			{g.Clues.Vertical, "down", "colonne"},
+		}
+		for _, list := range lists {
+			for _, c := range list.clues {
+				if low(c.Confidence) {
+					items = append(items, ReviewItem{
+						Type:       reviewClue,
+						Direction:  list.direction,
+						Number:     c.Number,
+						Text:       strings.Join(c.Texts, " – "),
+						Confidence: *c.Confidence,
+						Message:    fmt.Sprintf("Définitions de la %s %d à vérifier", list.line, c.Number),
+					})
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(items, func(a, b ReviewItem) int { return cmp.Compare(a.Confidence, b.Confidence) })
+	return items
+}
+
+// clampConfidence brings a confidence back between 0 and 1.
+func clampConfidence(c *float64) *float64 {
+	if c == nil || *c >= 0 && *c <= 1 {
+		return c
+	}
+	v := min(max(*c, 0), 1)
+	return &v
+}
+
+// lowestConfidence returns the lower of two confidences, ignoring missing
+// ones.
+func lowestConfidence(a, b *float64) *float64 {
+	if a == nil || b != nil && *b < *a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func confidence(c float64) *float64 { return &c }
+
+func TestReview(t *testing.T) {
+	g := loadFixtureGrid(t)
+	g.Cells[1][1].Confidence = confidence(0.6)
+	g.Cells[1][2].Confidence = confidence(0.95)
+	g.Cells[1][0].Definitions[0].Confidence = confidence(0.3)
+	g.Cells[2][0].Definitions[0].Confidence = confidence(0.85)
+
+	items := g.Review(defaultReviewThreshold)
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %+v", items)
+	}
+	if def := items[0]; def.Type != reviewDefinition || *def.Cell != (Position{1, 0}) || def.Text != "Rongeur" || def.Confidence != 0.3 {
+		t.Errorf("least confident item should be the definition, got %+v", def)
+	}
+	if cell := items[1]; cell.Type != reviewCell || *cell.Cell != (Position{1, 1}) || !strings.Contains(cell.Message, "lettre") {
+		t.Errorf("unexpected cell item %+v", cell)
+	}
+	if n := len(g.Review(0.9)); n != 3 {
+		t.Errorf("threshold 0.9: expected 3 items, got %d", n)
+	}
+
+	classic := classicTestGrid()
+	classic.Clues.Vertical[1].Confidence = confidence(0.5)
+	items = classic.Review(defaultReviewThreshold)
+	if len(items) != 1 || items[0].Type != reviewClue || items[0].Direction != "down" || items[0].Number != 2 || items[0].Text != "v2" {
+		t.Fatalf("expected the vertical clue 2, got %+v", items)
+	}
+}
+
+func TestValidateConfidence(t *testing.T) {
+	g := loadFixtureGrid(t)
+	g.Cells[1][1].Confidence = confidence(1.4)
+	g.Cells[1][0].Definitions[0].Confidence = confidence(-0.2)
+	if _, err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if *g.Cells[1][1].Confidence != 1 || *g.Cells[1][0].Definitions[0].Confidence != 0 {
+		t.Fatal("confidences should be brought back between 0 and 1")
+	}
+
+	// Clues of a line given twice keep their lowest confidence.
+	c := classicTestGrid()
+	c.Clues.Horizontal = append(c.Clues.Horizontal, NumberedClue{Number: 2, Texts: []string{"h2b"}, Confidence: confidence(0.4)})
+	c.Clues.Horizontal[1].Confidence = confidence(0.9)
+	if _, err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Clues.Horizontal[1].Confidence; got == nil || *got != 0.4 {
+		t.Fatalf("merged clues: expected confidence 0.4, got %v", got)
+	}
+}
+
+func TestGridReviewEndpoint(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+	revised := grid.Clone()
+	revised.Cells[0][0].Definitions[0].Confidence = confidence(0.4)
+	revised.Cells[0][1].Confidence = confidence(0.5)
+	if err := srv.store.UpdateGrid(revised); err != nil {
+		t.Fatal(err)
+	}
+
+	review := func(query string) (int, []ReviewItem) {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/review"+query, nil))
+		var resp struct {
+			Items []ReviewItem `json:"items"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Items
+	}
+
+	if code, items := review(""); code != http.StatusOK || len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d %+v", code, items)
+	}
+	if _, items := review("?threshold=0.45"); len(items) != 1 {
+		t.Fatalf("threshold 0.45: expected 1 item, got %+v", items)
+	}
+	if code, _ := review("?threshold=2"); code != http.StatusBadRequest {
+		t.Fatalf("invalid threshold: expected 400, got %d", code)
+	}
+
+	// Confirming the cell and fixing the definition empty the review.
+	body := `{"edits": [{"op": "confirm", "row": 0, "col": 1}, {"op": "edit_definition", "row": 0, "col": 0, "index": 0, "text": "Rat"}]}`
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("PATCH", "/api/grids/"+grid.ID, strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, items := review(""); len(items) != 0 {
+		t.Fatalf("expected an empty review, got %+v", items)
+	}
+	// Earlier versions keep their scores.
+	if _, items := review("?version=1"); len(items) != 2 {
+		t.Fatalf("version 1: expected 2 items, got %+v", items)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/nope/review", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown grid: expected 404, got %d", w.Code)
+	}
+}
+
+func TestConfirmClue(t *testing.T) {
+	g := classicTestGrid()
+	g.Clues.Horizontal[0].Confidence = confidence(0.2)
+	if _, err := g.ApplyEdits([]GridEdit{{Op: editConfirmClue, Direction: ptr("right"), Index: 1}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(g.Review(defaultReviewThreshold)) != 0 {
+		t.Fatal("confirmed clues should leave the review")
+	}
+	if _, err := g.ApplyEdits([]GridEdit{{Op: editConfirmClue, Direction: ptr("down"), Index: 9}}); err == nil {
+		t.Fatal("expected an error for a missing column")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// The answers of the model are constrained by response schemas derived
+// from the Go types they are decoded into, so that the two cannot drift
+// apart. Each JSON field becomes a property, required unless it is
+// omitempty. Two struct tags refine the schema:
+//
+//	schema:"-"                 the field is filled in by the server, not the model
+//	schema:"enum=right|down"   the allowed values of a string field
+
+// schemaOf returns the response schema of a Go type.
+func schemaOf(t reflect.Type) *genai.Schema {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return &genai.Schema{Type: genai.TypeBoolean}
+	case reflect.Int, reflect.Int64:
+		return &genai.Schema{Type: genai.TypeInteger}
+	case reflect.Float64:
+		return &genai.Schema{Type: genai.TypeNumber}
+	case reflect.String:
+		return &genai.Schema{Type: genai.TypeString}
+	case reflect.Slice:
+		return &genai.Schema{Type: genai.TypeArray, Items: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &genai.Schema{Type: genai.TypeObject, Properties: make(map[string]*genai.Schema)}
+		for f := range fieldsOf(t) {
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			tag := f.Tag.Get("schema")
+			if tag == "-" {
+				continue
+			}
+			prop := schemaOf(f.Type)
+			if values, ok := strings.CutPrefix(tag, "enum="); ok {
+				prop.Enum = strings.Split(values, "|")
+			}
+			s.Properties[name] = prop
+			s.PropertyOrdering = append(s.PropertyOrdering, name)
+			if !slices.Contains(strings.Split(opts, ","), "omitempty") {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	}
+	panic(fmt.Sprintf("no response schema for %s", t))
+}
+
+// fieldsOf yields the exported fields of a struct that have a JSON name.
+func fieldsOf(t reflect.Type) func(yield func(reflect.StructField) bool) {
+	return func(yield func(reflect.StructField) bool) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if !yield(f) {
+				return
+			}
+		}
+	}
+}
+
+// withoutProperty removes a property from an object schema.
+func withoutProperty(s *genai.Schema, name string) {
+	delete(s.Properties, name)
+	s.Required = slices.DeleteFunc(s.Required, func(n string) bool { return n == name })
+	s.PropertyOrdering = slices.DeleteFunc(s.PropertyOrdering, func(n string) bool { return n == name })
+}
+
+// gridSchema returns the schema of the grid extracted from a photo: arrow
+// grids have definitions in their cells, classic grids have clue lists
+// instead.
+func gridSchema(kind string) *genai.Schema {
+	s := schemaOf(reflect.TypeFor[Grid]())
+	if kind == KindClassic {
+		withoutProperty(s.Properties["cells"].Items.Items, "definitions")
+		s.Required = append(s.Required, "clues")
+	} else {
+		withoutProperty(s, "clues")
+	}
+	return s
+}
+
+// partsSchema is the schema of the grids read on several photos of the
+// same grid, one per photo.
+func partsSchema(kind string) *genai.Schema {
+	return &genai.Schema{
+		Type:             genai.TypeObject,
+		Properties:       map[string]*genai.Schema{"parts": {Type: genai.TypeArray, Items: gridSchema(kind)}},
+		PropertyOrdering: []string{"parts"},
+		Required:         []string{"parts"},
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/genai"
+)
+
+// sampleOf builds a value that follows a response schema, with every
+// property set.
+func sampleOf(s *genai.Schema) any {
+	switch s.Type {
+	case genai.TypeObject:
+		obj := make(map[string]any)
+		for name, prop := range s.Properties {
+			obj[name] = sampleOf(prop)
+		}
+		return obj
+	case genai.TypeArray:
+		return []any{sampleOf(s.Items)}
+	case genai.TypeString:
+		if len(s.Enum) > 0 {
+			return s.Enum[0]
+		}
+		return "A"
+	case genai.TypeInteger:
+		return 1
+	case genai.TypeNumber:
+		return 0.5
+	case genai.TypeBoolean:
+		return true
+	}
+	return nil
+}
+
+func TestGridSchema(t *testing.T) {
+	props := func(s *genai.Schema) string {
+		if !slices.Equal(slices.Sorted(maps.Keys(s.Properties)), slices.Sorted(slices.Values(s.PropertyOrdering))) {
+			t.Fatalf("ordering %v does not match the properties", s.PropertyOrdering)
+		}
+		return strings.Join(s.PropertyOrdering, ",") + " required:" + strings.Join(s.Required, ",")
+	}
+
+	// Adding a field to these types changes what the model is asked for:
+	// tag it schema:"-" if the server fills it in.
+	arrow := gridSchema(KindArrow)
+	cell := arrow.Properties["cells"].Items.Items
+	def := cell.Properties["definitions"].Items
+	for _, tc := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"grid", props(arrow), "rows,cols,cells,bounds required:rows,cols,cells"},
+		{"cell", props(cell), "black,definitions,confidence required:black"},
+		{"definition", props(def), "text,direction,start,confidence required:text,direction"},
+		{"bounds", props(arrow.Properties["bounds"]), "x,y,width,height required:x,y,width,height"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, tc.got, tc.want)
+		}
+	}
+	for _, name := range []string{"direction", "start"} {
+		if enum := def.Properties[name].Enum; !slices.Equal(enum, []string{"right", "down"}) {
+			t.Errorf("%s: enum = %v", name, enum)
+		}
+	}
+
+	classic := gridSchema(KindClassic)
+	cell = classic.Properties["cells"].Items.Items
+	clue := classic.Properties["clues"].Properties["horizontal"].Items
+	if got := props(classic); got != "rows,cols,cells,clues,bounds required:rows,cols,cells,clues" {
+		t.Errorf("classic grid: got %s", got)
+	}
+	if got := props(cell); got != "black,confidence required:black" {
+		t.Errorf("classic cell: got %s", got)
+	}
+	if got := props(clue); got != "number,texts,confidence required:number,texts" {
+		t.Errorf("clue: got %s", got)
+	}
+}
+
+// Every answer that follows the schemas must decode into the Go types, and
+// set their fields.
+func TestSchemaDecodes(t *testing.T) {
+	for _, kind := range []string{KindArrow, KindClassic} {
+		data, _ := json.Marshal(sampleOf(gridSchema(kind)))
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		var grid Grid
+		if err := dec.Decode(&grid); err != nil {
+			t.Fatalf("%s: sample answer does not decode: %v\n%s", kind, err, data)
+		}
+		if grid.Rows != 1 || len(grid.Cells) != 1 || grid.Bounds == nil || grid.Bounds.Width != 0.5 {
+			t.Fatalf("%s: fields not decoded: %+v", kind, grid)
+		}
+		if kind == KindClassic && (grid.Clues == nil || grid.Clues.Vertical[0].Texts[0] != "A") {
+			t.Fatalf("classic: clues not decoded: %+v", grid.Clues)
+		}
+		if kind == KindArrow && grid.Cells[0][0].Definitions[0].Direction != "right" {
+			t.Fatalf("arrow: definitions not decoded: %+v", grid.Cells[0][0])
+		}
+	}
+}
+
+func TestSchemaSkipsServerFields(t *testing.T) {
+	type record struct {
+		Name    string `json:"name"`
+		ID      string `json:"id" schema:"-"`
+		Comment string `json:"comment,omitempty"`
+		Ignored string `json:"-"`
+		hidden  string
+	}
+	s := schemaOf(reflect.TypeFor[record]())
+	if got := strings.Join(s.PropertyOrdering, ","); got != "name,comment" {
+		t.Fatalf("properties = %s", got)
+	}
+	if !slices.Equal(s.Required, []string{"name"}) {
+		t.Fatalf("required = %v", s.Required)
+	}
+}
+
+func TestAnalyzeImageSendsSchema(t *testing.T) {
+	g, _, _ := scriptedGemini(t)
+	var schema *genai.Schema
+	g.generate = func(_ context.Context, _ string, _ []*genai.Content, config *genai.GenerateContentConfig) (*genai.GenerateContentResponse, error) {
+		schema = config.ResponseSchema
+		return &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{{Content: genai.NewContentFromText(`{"rows": 1, "cols": 2, "cells": [[{"black": false}, {"black": false}]], "clues": {"horizontal": [], "vertical": []}}`, genai.RoleModel)}},
+		}, nil
+	}
+	if _, err := g.AnalyzeImage(context.Background(), []byte("png"), "image/png", KindClassic); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if schema == nil || schema.Properties["clues"] == nil {
+		t.Fatal("expected the classic grid schema in the request")
+	}
+}
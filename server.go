@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,11 +23,6 @@ var frontendFS embed.FS
 
 const maxUploadSize = 10 << 20 // 10 Mo
 
-var allowedMIME = map[string]bool{
-	"image/jpeg": true,
-	"image/png":  true,
-}
-
 // rateLimiter is a simple per-IP token bucket rate limiter.
 type rateLimiter struct {
 	mu       sync.Mutex
@@ -88,40 +88,74 @@ func (rl *rateLimiter) allow(ip string) bool {
 
 // Server is the main HTTP server.
 type Server struct {
-	mux        *http.ServeMux
-	store      *Store
-	gemini     *GeminiClient
-	sse        *Broadcaster
-	uploadRL   *rateLimiter
-	moveRL     *rateLimiter
+	mux      *http.ServeMux
+	store    Store
+	analyzer GridAnalyzer
+	sse      *Broadcaster
+	jobs     *JobQueue // nil without analyzer
+
+	// imageMatchDistance is the largest perceptual hash distance at which
+	// an upload reuses the grid of another photo; 0 reuses exact copies only.
+	imageMatchDistance int
+
+	uploadRL *rateLimiter
+	moveRL   *rateLimiter
 }
 
 // NewServer creates a configured HTTP server.
-func NewServer(store *Store, gemini *GeminiClient) *Server {
+// A nil analyzer disables grid uploads.
+func NewServer(store Store, analyzer GridAnalyzer) *Server {
 	s := &Server{
 		mux:      http.NewServeMux(),
 		store:    store,
-		gemini:   gemini,
+		analyzer: analyzer,
 		sse:      NewBroadcaster(),
-		uploadRL: newRateLimiter(5, time.Minute),   // 5 uploads/min per IP
-		moveRL:   newRateLimiter(60, time.Second),   // 60 moves/sec per IP
+		uploadRL: newRateLimiter(5, time.Minute),  // 5 uploads/min per IP
+		moveRL:   newRateLimiter(60, time.Second), // 60 moves/sec per IP
+	}
+	if analyzer != nil {
+		s.jobs = NewJobQueue(analysisWorkers, s.runAnalysis)
 	}
 	s.routes()
 	return s
 }
 
+// Close stops the analysis workers, canceling the running analyses.
+func (s *Server) Close() {
+	if s.jobs != nil {
+		s.jobs.Close()
+	}
+}
+
 func (s *Server) routes() {
 	// Grid API
 	s.mux.HandleFunc("POST /api/grids", s.handleCreateGrid)
+	s.mux.HandleFunc("POST /api/grids/import", s.handleImportGrid)
 	s.mux.HandleFunc("GET /api/grids", s.handleListGrids)
 	s.mux.HandleFunc("GET /api/grids/{id}", s.handleGetGrid)
+	s.mux.HandleFunc("PATCH /api/grids/{id}", s.handleEditGrid)
+	s.mux.HandleFunc("GET /api/grids/{id}/words", s.handleGridWords)
+	s.mux.HandleFunc("GET /api/grids/{id}/review", s.handleGridReview)
+	s.mux.HandleFunc("PUT /api/grids/{id}/solution", s.handleSetSolution)
+	s.mux.HandleFunc("GET /api/grids/{id}/export", s.handleExportGrid)
+	s.mux.HandleFunc("GET /api/grids/{id}/image", s.handleGridImage)
+
+	// Analysis jobs
+	s.mux.HandleFunc("GET /api/analyzer", s.handleGetAnalyzer)
+	s.mux.HandleFunc("GET /api/jobs/{id}", s.handleGetJob)
+	s.mux.HandleFunc("GET /api/jobs/{id}/events", s.handleJobEvents)
 
 	// Game API
 	s.mux.HandleFunc("POST /api/games", s.handleCreateGame)
 	s.mux.HandleFunc("GET /api/games/{id}", s.handleGetGame)
 	s.mux.HandleFunc("POST /api/games/{id}/join", s.handleJoinGame)
 	s.mux.HandleFunc("POST /api/games/{id}/move", s.handleMove)
+	s.mux.HandleFunc("POST /api/games/{id}/check", s.handleCheck)
+	s.mux.HandleFunc("GET /api/games/{id}/history", s.handleHistory)
+	s.mux.HandleFunc("POST /api/games/{id}/undo", s.handleUndo)
+	s.mux.HandleFunc("POST /api/games/{id}/redo", s.handleRedo)
 	s.mux.HandleFunc("GET /api/games/{id}/events", s.handleGameEvents)
+	s.mux.HandleFunc("GET /api/games/{id}/ws", s.handleGameWS)
 
 	// Frontend static files
 	frontendDir, _ := fs.Sub(frontendFS, "frontend")
@@ -140,73 +174,551 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // --- Grid handlers ---
 
-// POST /api/grids — upload image, analyze with Gemini, save grid.
+// POST /api/grids — upload an image and queue its analysis. The reply is
+// the job (202 Accepted): follow it with GET /api/jobs/{id} or its event
+// stream until the grid is saved. The optional form field "kind" selects
+// arrow words (default) or a classic crossword. A photo already analyzed
+// for that kind is not analyzed again: the reply is then a job already done
+// (200 OK), referring to the existing grid. A grid too large for one photo
+// is uploaded as several "image" fields, in order: the grids read on them
+// are assembled into one, and the job reports the overlaps reconciled.
 func (s *Server) handleCreateGrid(w http.ResponseWriter, r *http.Request) {
 	if !s.uploadRL.allow(r.RemoteAddr) {
 		jsonError(w, "Trop de requêtes, réessayez plus tard", http.StatusTooManyRequests)
 		return
 	}
 
-	if s.gemini == nil {
+	if s.analyzer == nil {
 		jsonError(w, "Analyse d'image non configurée", http.StatusServiceUnavailable)
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		jsonError(w, "Image trop volumineuse (max 10 Mo)", http.StatusRequestEntityTooLarge)
+	photos, ok := readImageUploads(w, r, maxUploadImages)
+	if !ok {
+		return
+	}
+	kind := r.FormValue("kind")
+	switch kind {
+	case "":
+		kind = KindArrow
+	case KindArrow, KindClassic:
+	default:
+		jsonError(w, "Type de grille inconnu (arrow ou classic)", http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile("image")
+	steps, err := parseSteps(r.FormValue("preprocess"))
 	if err != nil {
-		jsonError(w, "Champ 'image' requis", http.StatusBadRequest)
+		jsonError(w, "Étape de prétraitement inconnue (resize, grayscale, contrast, deskew ou none)", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	mimeType := header.Header.Get("Content-Type")
-	if !allowedMIME[mimeType] {
-		jsonError(w, "Format accepté : JPEG ou PNG", http.StatusBadRequest)
+	images := make([]*SourceImage, len(photos))
+	others := make([]string, 0, len(photos)-1)
+	for k, photo := range photos {
+		img := NewSourceImage(photo.Data, photo.MIMEType)
+		if stored := s.store.GetImage(img.Hash); stored != nil {
+			img = stored
+		} else if err := s.store.SaveImage(img); err != nil {
+			log.Printf("Save image error: %v", err)
+		}
+		images[k] = img
+		if k > 0 {
+			others = append(others, img.Hash)
+		}
+	}
+	if grid := s.cachedGrid(images[0], analysisKey(kind, steps, others...)); grid != nil {
+		job := s.jobs.Cached(grid.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		json.NewEncoder(w).Encode(job)
 		return
 	}
 
-	imageData, err := io.ReadAll(file)
+	job, err := s.jobs.Submit(analysisTask{images: images, kind: kind, steps: steps})
 	if err != nil {
-		jsonError(w, "Erreur de lecture de l'image", http.StatusInternalServerError)
+		jsonError(w, "Trop d'analyses en cours, réessayez plus tard", http.StatusServiceUnavailable)
 		return
 	}
 
-	grid, err := s.gemini.AnalyzeImage(r.Context(), imageData, mimeType)
-	if err != nil {
-		log.Printf("Gemini analyze error: %v", err)
-		jsonError(w, "Erreur lors de l'analyse de la grille", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// cachedGrid returns the grid already extracted from img by the analysis
+// named key (see analysisKey), or from the closest near-identical image
+// when imageMatchDistance is set.
+func (s *Server) cachedGrid(img *SourceImage, key string) *Grid {
+	if id := img.Grids[key]; id != "" {
+		if grid := s.store.GetGrid(id); grid != nil {
+			return grid
+		}
+	}
+	if s.imageMatchDistance == 0 || img.PHash == 0 {
+		return nil
+	}
+	var best *Grid
+	bestDistance := s.imageMatchDistance + 1
+	for _, other := range s.store.ListImages() {
+		id := other.Grids[key]
+		if other.Hash == img.Hash || other.PHash == 0 || id == "" {
+			continue
+		}
+		if d := hammingDistance(img.PHash, other.PHash); d < bestDistance {
+			if grid := s.store.GetGrid(id); grid != nil {
+				best, bestDistance = grid, d
+			}
+		}
+	}
+	return best
+}
+
+// GET /api/analyzer — the analyzer the grids are extracted with. Analyzers
+// that cannot describe themselves are reported with an empty name.
+func (s *Server) handleGetAnalyzer(w http.ResponseWriter, r *http.Request) {
+	if s.analyzer == nil {
+		jsonError(w, "Analyse d'image non configurée", http.StatusServiceUnavailable)
+		return
+	}
+	var info AnalyzerInfo
+	if d, ok := s.analyzer.(DescribedAnalyzer); ok {
+		info = d.Describe()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// GET /api/jobs/{id} — state of an analysis job.
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job := s.job(r)
+	if job == nil {
+		jsonError(w, "Analyse introuvable", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// GET /api/jobs/{id}/events — SSE stream of the job states, starting with
+// the current one.
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	job := s.job(r)
+	if job == nil {
+		jsonError(w, "Analyse introuvable", http.StatusNotFound)
+		return
+	}
+	s.jobs.events.ServeSSE(w, r, job.ID, func() string {
+		if current := s.jobs.Get(job.ID); current != nil {
+			job = current
+		}
+		return jobEvent(job)
+	}, nil)
+}
+
+func (s *Server) job(r *http.Request) *Job {
+	if s.jobs == nil {
+		return nil
+	}
+	return s.jobs.Get(r.PathValue("id"))
+}
+
+// GET /api/grids/{id}/image — the photo the grid was extracted from,
+// without its metadata; ?size=preview for the downscaled variant. For grids
+// assembled from several photos, ?photo=n selects one, from 1 (the first
+// by default).
+func (s *Server) handleGridImage(w http.ResponseWriter, r *http.Request) {
+	grid := s.store.GetGrid(r.PathValue("id"))
+	if grid == nil {
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+	hash := grid.ImageHash
+	if v := r.URL.Query().Get("photo"); v != "" {
+		photos := grid.Images
+		if len(photos) == 0 && hash != "" {
+			photos = []string{hash}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > len(photos) {
+			jsonError(w, "Pas de photo "+v+" pour cette grille", http.StatusNotFound)
+			return
+		}
+		hash = photos[n-1]
+	}
+	var img *SourceImage
+	if hash != "" {
+		img = s.store.GetImage(hash)
+	}
+	if img == nil {
+		jsonError(w, "Pas de photo pour cette grille", http.StatusNotFound)
+		return
+	}
+
+	data, mimeType, etag := img.Data, img.MIMEType, img.Hash
+	switch r.URL.Query().Get("size") {
+	case "", "original":
+	case "preview":
+		if img.Preview != nil {
+			data, mimeType, etag = img.Preview, "image/jpeg", img.Hash+"-preview"
+		}
+	case "processed":
+		// The image the analyzer was given, when the photo was prepared.
+		variant := processedVariant(grid.Preprocess)
+		if len(grid.Preprocess) > 0 {
+			data = s.store.GetImageVariant(img.Hash, variant)
+		}
+		if len(grid.Preprocess) == 0 || data == nil {
+			jsonError(w, "Pas d'image prétraitée pour cette grille", http.StatusNotFound)
+			return
+		}
+		mimeType, etag = "image/jpeg", img.Hash+"-"+strings.Join(grid.Preprocess, "-")
+	default:
+		jsonError(w, "Taille inconnue (original, preview ou processed)", http.StatusBadRequest)
 		return
 	}
 
-	s.store.SaveGrid(grid)
+	// The photo of a grid never changes: it is identified by its hash.
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", img.CreatedAt, bytes.NewReader(data))
+}
+
+// storeNewGrid validates and stores a grid created by upload or import, and
+// returns the problems found in it. The error is errEmptyGrid if there is
+// no grid to store. sourceBox, if not nil, maps the boxes of the grid to
+// the photo, for grids read from a processed version of it.
+func (s *Server) storeNewGrid(grid *Grid, sourceBox func(*Box) *Box) ([]Problem, error) {
+	problems, err := grid.Validate()
+	if err != nil {
+		return nil, err
+	}
+	grid.FillCellBoxes()
+	if sourceBox != nil {
+		grid.MapBoxes(sourceBox)
+	}
+	if _, err := s.store.SaveGrid(grid); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// saveNewGrid stores a grid like storeNewGrid and replies with the grid and
+// the problems found in it.
+func (s *Server) saveNewGrid(w http.ResponseWriter, grid *Grid) {
+	problems, err := s.storeNewGrid(grid, nil)
+	if errors.Is(err, errEmptyGrid) {
+		jsonError(w, "Aucune grille n'a pu être lue", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("Save grid error: %v", err)
+		jsonError(w, "Erreur lors de l'enregistrement de la grille", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(grid)
+	json.NewEncoder(w).Encode(gridWithWarnings{grid.WithoutSolution(), problems})
+}
+
+// gridWithWarnings is the reply to requests creating or revising a grid.
+type gridWithWarnings struct {
+	*Grid
+	Warnings []Problem `json:"warnings,omitempty"`
+}
+
+// POST /api/grids/import — create a grid from an ipuz, .puz or XD file,
+// sent as the multipart field "file" or as the raw request body.
+func (s *Server) handleImportGrid(w http.ResponseWriter, r *http.Request) {
+	if !s.uploadRL.allow(r.RemoteAddr) {
+		jsonError(w, "Trop de requêtes, réessayez plus tard", http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, ferr := r.FormFile("file")
+		var tooLarge *http.MaxBytesError
+		if errors.As(ferr, &tooLarge) {
+			jsonError(w, "Fichier trop volumineux (max 10 Mo)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if ferr != nil {
+			jsonError(w, "Champ 'file' requis", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err = io.ReadAll(file)
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		jsonError(w, "Fichier trop volumineux (max 10 Mo)", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	grid, err := ImportGrid(data)
+	if err != nil {
+		jsonError(w, "Fichier invalide : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.saveNewGrid(w, grid)
 }
 
 // GET /api/grids — list all grids.
 func (s *Server) handleListGrids(w http.ResponseWriter, _ *http.Request) {
 	grids := s.store.ListGrids()
+	for i, g := range grids {
+		grids[i] = g.WithoutSolution()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(grids)
 }
 
-// GET /api/grids/{id} — get a single grid.
+// GET /api/grids/{id} — get a single grid, in its latest version unless
+// ?version= is given.
 func (s *Server) handleGetGrid(w http.ResponseWriter, r *http.Request) {
+	grid := s.requestedGrid(r)
+	if grid == nil {
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grid.WithoutSolution())
+}
+
+// GET /api/grids/{id}/words — list the entries of a grid (?version= as for
+// GET /api/grids/{id}).
+func (s *Server) handleGridWords(w http.ResponseWriter, r *http.Request) {
+	grid := s.requestedGrid(r)
+	if grid == nil {
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grid.Words())
+}
+
+// GET /api/grids/{id}/review — the parts of the grid the analyzer is
+// unsure about, least confident first. ?threshold= (0 to 1) sets the
+// confidence below which they are listed. They can be confirmed or fixed
+// with PATCH /api/grids/{id} before starting a game.
+func (s *Server) handleGridReview(w http.ResponseWriter, r *http.Request) {
+	grid := s.requestedGrid(r)
+	if grid == nil {
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+	threshold := defaultReviewThreshold
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 || t > 1 {
+			jsonError(w, "Seuil invalide (attendu : 0 à 1)", http.StatusBadRequest)
+			return
+		}
+		threshold = t
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"grid_id":   grid.ID,
+		"version":   grid.Version,
+		"threshold": threshold,
+		"items":     grid.Review(threshold),
+	})
+}
+
+// requestedGrid returns the grid named in the path, in the version given
+// by ?version= or the latest one.
+func (s *Server) requestedGrid(r *http.Request) *Grid {
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, _ := strconv.Atoi(v)
+		return s.store.GetGridVersion(r.PathValue("id"), version)
+	}
+	return s.store.GetGrid(r.PathValue("id"))
+}
+
+// PATCH /api/grids/{id} — correct a grid with a list of edits
+// {version, edits}. The result is stored as a new version: games created
+// on earlier versions keep playing them and are sent a grid_revised event.
+func (s *Server) handleEditGrid(w http.ResponseWriter, r *http.Request) {
 	grid := s.store.GetGrid(r.PathValue("id"))
 	if grid == nil {
 		jsonError(w, "Grille introuvable", http.StatusNotFound)
 		return
 	}
+
+	var req struct {
+		Version int        `json:"version"` // optional: version the edits were made on
+		Edits   []GridEdit `json:"edits"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Edits) == 0 {
+		jsonError(w, "Champ 'edits' requis", http.StatusBadRequest)
+		return
+	}
+	if req.Version != 0 && req.Version != grid.Version {
+		jsonError(w, "La grille a été modifiée depuis", http.StatusConflict)
+		return
+	}
+
+	revised := grid.Clone()
+	problems, err := revised.ApplyEdits(req.Edits)
+	if err != nil {
+		jsonError(w, "Modification invalide : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.ReviseGrid(revised); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			jsonError(w, "La grille a été modifiée depuis", http.StatusConflict)
+			return
+		}
+		log.Printf("Revise grid error: %v", err)
+		jsonError(w, "Erreur lors de l'enregistrement de la grille", http.StatusInternalServerError)
+		return
+	}
+
+	msg, _ := json.Marshal(map[string]any{
+		"type":    "grid_revised",
+		"grid_id": revised.ID,
+		"version": revised.Version,
+	})
+	// Only games followed, or just left, by some client need to know.
+	for _, id := range s.sse.Active() {
+		if game := s.store.GetGame(id); game != nil && game.GridID == revised.ID {
+			s.sse.Broadcast(game.ID, string(msg))
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(grid)
+	json.NewEncoder(w).Encode(gridWithWarnings{revised.WithoutSolution(), problems})
+}
+
+// PUT /api/grids/{id}/solution — attach the expected letters to a grid,
+// either typed in as JSON {rows} or read from a photo of the answers page.
+// The optional version (JSON field or form field) is the version of the
+// grid the solution is for. Like edits, the solution is refused with 409
+// if the grid was revised in the meantime, which reading a photo leaves
+// time for.
+func (s *Server) handleSetSolution(w http.ResponseWriter, r *http.Request) {
+	grid := s.store.GetGrid(r.PathValue("id"))
+	if grid == nil {
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+
+	var rows []string
+	version := 0
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if !s.uploadRL.allow(r.RemoteAddr) {
+			jsonError(w, "Trop de requêtes, réessayez plus tard", http.StatusTooManyRequests)
+			return
+		}
+
+		analyzer, ok := s.analyzer.(SolutionAnalyzer)
+		if !ok {
+			jsonError(w, "Lecture des solutions non configurée", http.StatusServiceUnavailable)
+			return
+		}
+
+		imageData, mimeType, ok := readImageUpload(w, r)
+		if !ok {
+			return
+		}
+		if v := r.FormValue("version"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				jsonError(w, "Version invalide", http.StatusBadRequest)
+				return
+			}
+			version = n
+		}
+		if version != 0 && version != grid.Version {
+			jsonError(w, "La grille a été modifiée depuis", http.StatusConflict)
+			return
+		}
+
+		var err error
+		rows, err = analyzer.AnalyzeSolution(r.Context(), imageData, mimeType, grid)
+		if err != nil {
+			log.Printf("Analyze solution error: %v", err)
+			jsonError(w, "Erreur lors de la lecture des solutions", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		var req struct {
+			Rows    []string `json:"rows"`
+			Version int      `json:"version"` // optional: version the solution is for
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Rows) == 0 {
+			jsonError(w, "Champ 'rows' requis", http.StatusBadRequest)
+			return
+		}
+		rows, version = req.Rows, req.Version
+	}
+	if version != 0 && version != grid.Version {
+		jsonError(w, "La grille a été modifiée depuis", http.StatusConflict)
+		return
+	}
+
+	updated := grid.Clone()
+	if err := updated.SetSolution(rows); err != nil {
+		jsonError(w, "Solution invalide : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.UpdateGrid(updated); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			jsonError(w, "La grille a été modifiée depuis", http.StatusConflict)
+			return
+		}
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated.WithoutSolution())
+}
+
+// GET /api/grids/{id}/export?format=ipuz — download the grid in an open
+// format. ?game= adds the letters filled in that game, and the expected
+// letters once the game is completed: they are not given away before.
+func (s *Server) handleExportGrid(w http.ResponseWriter, r *http.Request) {
+	grid := s.store.GetGrid(r.PathValue("id"))
+	if grid == nil {
+		jsonError(w, "Grille introuvable", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "ipuz" {
+		jsonError(w, "Format d'export non supporté (attendu : ipuz)", http.StatusBadRequest)
+		return
+	}
+
+	var state [][]string
+	withSolution := false
+	if gameID := q.Get("game"); gameID != "" {
+		game := s.store.GetGame(gameID)
+		if game == nil || game.GridID != grid.ID {
+			jsonError(w, "Partie introuvable pour cette grille", http.StatusNotFound)
+			return
+		}
+		// The game may be on an earlier version of the grid.
+		if grid = s.gameGrid(game); grid == nil {
+			jsonError(w, "Grille introuvable", http.StatusNotFound)
+			return
+		}
+		state = game.GetState()
+		withSolution = game.Completed() != nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", grid.ID+".ipuz"))
+	json.NewEncoder(w).Encode(ExportIPUZ(grid, state, withSolution))
 }
 
 // --- Game handlers ---
@@ -240,12 +752,23 @@ func (s *Server) handleGetGame(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// History is served separately by /history.
 	resp := struct {
 		*GameSession
-		Grid *Grid `json:"grid"`
+		History       []Move `json:"history,omitempty"`
+		Grid          *Grid  `json:"grid"`
+		Words         []Word `json:"words"`
+		LatestVersion int    `json:"latest_grid_version,omitempty"`
 	}{
 		GameSession: game,
-		Grid:        s.store.GetGrid(game.GridID),
+		Grid:        s.gameGrid(game),
+	}
+	if resp.Grid != nil {
+		resp.Words = resp.Grid.Words()
+		resp.Grid = resp.Grid.WithoutSolution()
+	}
+	if latest := s.store.GetGrid(game.GridID); latest != nil {
+		resp.LatestVersion = latest.Version
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -275,6 +798,7 @@ func (s *Server) handleJoinGame(w http.ResponseWriter, r *http.Request) {
 	}
 
 	player := game.AddPlayer(pseudo)
+	s.saveGame(game)
 
 	// Broadcast player_joined event.
 	evt, _ := json.Marshal(map[string]string{
@@ -312,38 +836,158 @@ func (s *Server) handleMove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.playMove(game, sanitizePseudo(req.Pseudo), req.Row, req.Col, req.Value); err != nil {
+		jsonError(w, err.msg, err.status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// playMove validates and applies a move, then notifies the players.
+// It is shared by every transport that accepts moves.
+func (s *Server) playMove(game *GameSession, pseudo string, row, col int, rawValue string) *apiError {
 	// Validate: value must be empty (erase) or a single uppercase letter.
-	value := strings.ToUpper(strings.TrimSpace(req.Value))
+	value := strings.ToUpper(strings.TrimSpace(rawValue))
 	if value != "" && (utf8.RuneCountInString(value) != 1 || value < "A" || value > "Z") {
-		jsonError(w, "Valeur invalide : une lettre A-Z ou vide", http.StatusBadRequest)
-		return
+		return &apiError{http.StatusBadRequest, "Valeur invalide : une lettre A-Z ou vide"}
 	}
 
 	// Check the cell is not a definition cell.
-	grid := s.store.GetGrid(game.GridID)
-	if grid != nil && req.Row >= 0 && req.Row < grid.Rows && req.Col >= 0 && req.Col < grid.Cols {
-		if grid.Cells[req.Row][req.Col].Black {
-			jsonError(w, "Case de définition", http.StatusBadRequest)
+	grid := s.gameGrid(game)
+	if grid != nil && row >= 0 && row < grid.Rows && col >= 0 && col < grid.Cols {
+		if grid.Cells[row][col].Black {
+			return &apiError{http.StatusBadRequest, "Case de définition"}
+		}
+	}
+
+	if err := game.Play(pseudo, row, col, value); err != nil {
+		if errors.Is(err, errGameCompleted) {
+			return &apiError{http.StatusConflict, "Partie terminée"}
+		}
+		return &apiError{http.StatusBadRequest, "Position hors limites"}
+	}
+
+	s.cellChanged(game, grid, row, col, value, pseudo)
+	return nil
+}
+
+// GET /api/games/{id}/history — list moves, optionally after ?since=seq.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	game := s.store.GetGame(r.PathValue("id"))
+	if game == nil {
+		jsonError(w, "Partie introuvable", http.StatusNotFound)
+		return
+	}
+
+	since := 0
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			jsonError(w, "Paramètre 'since' invalide", http.StatusBadRequest)
 			return
 		}
+		since = n
 	}
 
-	if !game.SetCell(req.Row, req.Col, value) {
-		jsonError(w, "Position hors limites", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"moves": game.GetHistory(since)})
+}
+
+// POST /api/games/{id}/undo — revert the player's own last move.
+func (s *Server) handleUndo(w http.ResponseWriter, r *http.Request) {
+	s.handleUndoRedo(w, r, (*GameSession).Undo)
+}
+
+// POST /api/games/{id}/redo — re-apply the player's last undone move.
+func (s *Server) handleRedo(w http.ResponseWriter, r *http.Request) {
+	s.handleUndoRedo(w, r, (*GameSession).Redo)
+}
+
+func (s *Server) handleUndoRedo(w http.ResponseWriter, r *http.Request, apply func(*GameSession, string) (Move, error)) {
+	if !s.moveRL.allow(r.RemoteAddr) {
+		jsonError(w, "Trop de requêtes, réessayez plus tard", http.StatusTooManyRequests)
 		return
 	}
 
-	// Broadcast cell_update event.
-	evt, _ := json.Marshal(map[string]any{
-		"type":   "cell_update",
-		"row":    req.Row,
-		"col":    req.Col,
-		"value":  value,
-		"pseudo": req.Pseudo,
-	})
+	game := s.store.GetGame(r.PathValue("id"))
+	if game == nil {
+		jsonError(w, "Partie introuvable", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Pseudo string `json:"pseudo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || sanitizePseudo(req.Pseudo) == "" {
+		jsonError(w, "Champ 'pseudo' requis", http.StatusBadRequest)
+		return
+	}
+	pseudo := sanitizePseudo(req.Pseudo)
+
+	m, err := s.playUndoRedo(game, pseudo, apply)
+	if err != nil {
+		jsonError(w, err.msg, err.status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// playUndoRedo applies Undo or Redo for a player, then notifies the players.
+func (s *Server) playUndoRedo(game *GameSession, pseudo string, apply func(*GameSession, string) (Move, error)) (Move, *apiError) {
+	m, err := apply(game, pseudo)
+	switch {
+	case errors.Is(err, errGameCompleted):
+		return m, &apiError{http.StatusConflict, "Partie terminée"}
+	case errors.Is(err, errNothingToUndo):
+		return m, &apiError{http.StatusConflict, "Rien à annuler"}
+	case errors.Is(err, errNothingToRedo):
+		return m, &apiError{http.StatusConflict, "Rien à rétablir"}
+	case errors.Is(err, errCellChanged):
+		return m, &apiError{http.StatusConflict, "La case a été modifiée depuis"}
+	case err != nil:
+		return m, &apiError{http.StatusBadRequest, "Requête invalide"}
+	}
+
+	s.cellChanged(game, s.gameGrid(game), m.Row, m.Col, m.New, pseudo)
+	return m, nil
+}
+
+// POST /api/games/{id}/check — report the filled cells that are wrong.
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	game := s.store.GetGame(r.PathValue("id"))
+	if game == nil {
+		jsonError(w, "Partie introuvable", http.StatusNotFound)
+		return
+	}
+
+	grid := s.gameGrid(game)
+	if grid == nil || !grid.HasSolution {
+		jsonError(w, "Aucune solution pour cette grille", http.StatusConflict)
+		return
+	}
+
+	// The body is optional: it only tells the other players who asked.
+	var req struct {
+		Pseudo string `json:"pseudo"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	wrong, filled := game.Check(grid)
+
+	result := map[string]any{
+		"type":   "check_result",
+		"wrong":  wrong,
+		"filled": filled,
+		"pseudo": sanitizePseudo(req.Pseudo),
+	}
+	evt, _ := json.Marshal(result)
 	s.sse.Broadcast(game.ID, string(evt))
 
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 // GET /api/games/{id}/events — SSE stream.
@@ -355,26 +999,55 @@ func (s *Server) handleGameEvents(w http.ResponseWriter, r *http.Request) {
 	}
 
 	playerPseudo := sanitizePseudo(r.URL.Query().Get("pseudo"))
+	s.playerConnected(game, playerPseudo)
 
-	s.sse.ServeSSE(w, r, game.ID, func(c *client) {
-		// Send initial game state on connect.
-		evt, _ := json.Marshal(map[string]any{
-			"type":    "game_state",
-			"state":   game.GetState(),
-			"players": game.Players,
-		})
-		c.ch <- string(evt)
+	s.sse.ServeSSE(w, r, game.ID, func() string {
+		return s.gameSnapshot(game)
 	}, func() {
-		// On disconnect: broadcast player_left if pseudo was provided.
-		if playerPseudo != "" {
-			game.RemovePlayer(playerPseudo)
-			evt, _ := json.Marshal(map[string]string{
-				"type":   "player_left",
-				"pseudo": playerPseudo,
-			})
-			s.sse.Broadcast(game.ID, string(evt))
-		}
+		s.playerDisconnected(game, playerPseudo)
+	})
+}
+
+// gameSnapshot is the full game state, sent to new clients and to those too
+// far behind to replay the events they missed.
+func (s *Server) gameSnapshot(game *GameSession) string {
+	evt, _ := json.Marshal(map[string]any{
+		"type":       "game_state",
+		"state":      game.GetState(),
+		"players":    game.GetPlayers(),
+		"completion": game.Completed(),
 	})
+	return string(evt)
+}
+
+// playerConnected re-adds a player who opens an event stream after the
+// previous one dropped (which removed the player).
+func (s *Server) playerConnected(game *GameSession, pseudo string) {
+	if pseudo == "" || game.HasPlayer(pseudo) {
+		return
+	}
+	player := game.AddPlayer(pseudo)
+	s.saveGame(game)
+	evt, _ := json.Marshal(map[string]string{
+		"type":   "player_joined",
+		"pseudo": player.Pseudo,
+		"color":  player.Color,
+	})
+	s.sse.Broadcast(game.ID, string(evt))
+}
+
+// playerDisconnected broadcasts player_left when a player's stream closes.
+func (s *Server) playerDisconnected(game *GameSession, pseudo string) {
+	if pseudo == "" {
+		return
+	}
+	game.RemovePlayer(pseudo)
+	s.saveGame(game)
+	evt, _ := json.Marshal(map[string]string{
+		"type":   "player_left",
+		"pseudo": pseudo,
+	})
+	s.sse.Broadcast(game.ID, string(evt))
 }
 
 // --- Frontend page handlers ---
@@ -388,6 +1061,148 @@ func (s *Server) handleGamePage(w http.ResponseWriter, _ *http.Request) {
 
 // --- Helpers ---
 
+// apiError is a failure to report to the client, with its HTTP status.
+type apiError struct {
+	status int
+	msg    string
+}
+
+// cellChanged broadcasts a cell_update, then detects completion and
+// persists the game.
+func (s *Server) cellChanged(game *GameSession, grid *Grid, row, col int, value, pseudo string) {
+	evt, _ := json.Marshal(map[string]any{
+		"type":   "cell_update",
+		"row":    row,
+		"col":    col,
+		"value":  value,
+		"pseudo": pseudo,
+	})
+	s.sse.Broadcast(game.ID, string(evt))
+
+	var completion *Completion
+	if grid != nil {
+		completion = game.CheckCompletion(grid)
+	}
+	s.saveGame(game)
+
+	if completion != nil {
+		evt, _ := json.Marshal(map[string]any{
+			"type":       "game_completed",
+			"completion": completion,
+		})
+		s.sse.Broadcast(game.ID, string(evt))
+	}
+}
+
+// gameGrid returns the version of the grid a game is played on.
+func (s *Server) gameGrid(game *GameSession) *Grid {
+	return s.store.GetGridVersion(game.GridID, game.GridVersion)
+}
+
+// saveGame persists a game session after a mutation. Failures are logged:
+// the live session stays authoritative until the next successful write.
+func (s *Server) saveGame(game *GameSession) {
+	if err := s.store.SaveGame(game); err != nil {
+		log.Printf("Save game %s error: %v", game.ID, err)
+	}
+}
+
+// readImageUpload reads the "image" field of a multipart upload (see
+// readImageUploads).
+// On failure it writes the error response and returns ok=false.
+func readImageUpload(w http.ResponseWriter, r *http.Request) (data []byte, mimeType string, ok bool) {
+	photos, ok := readImageUploads(w, r, 1)
+	if !ok {
+		return nil, "", false
+	}
+	return photos[0].Data, photos[0].MIMEType, true
+}
+
+// readImageUploads reads the "image" fields of a multipart upload, at most
+// max of them, in order. Their format is sniffed from the content, whatever
+// the part's Content-Type says, and WebP, HEIC and PDF files are converted
+// to JPEG. The "page" field selects the page of PDF files (1 by default):
+// given once, it applies to all of them, or else once per image.
+// On failure it writes the error response and returns ok=false.
+func readImageUploads(w http.ResponseWriter, r *http.Request, max int) (photos []Photo, ok bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(max)*maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		jsonError(w, "Image trop volumineuse (max 10 Mo)", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	headers := r.MultipartForm.File["image"]
+	switch {
+	case len(headers) == 0:
+		jsonError(w, "Champ 'image' requis", http.StatusBadRequest)
+		return nil, false
+	case len(headers) > max:
+		jsonError(w, fmt.Sprintf("Trop d'images (max %d)", max), http.StatusBadRequest)
+		return nil, false
+	}
+	pages := r.Form["page"]
+	if len(pages) > 1 && len(pages) != len(headers) {
+		jsonError(w, "Donnez un numéro de page, ou un par image", http.StatusBadRequest)
+		return nil, false
+	}
+
+	for k, header := range headers {
+		if header.Size > maxUploadSize {
+			jsonError(w, "Image trop volumineuse (max 10 Mo)", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		data, err := readFormFile(header)
+		if err != nil {
+			jsonError(w, "Erreur de lecture de l'image", http.StatusInternalServerError)
+			return nil, false
+		}
+
+		format := sniffFormat(data)
+		if format == "" {
+			jsonError(w, "Format accepté : JPEG, PNG, WebP, HEIC ou PDF", http.StatusBadRequest)
+			return nil, false
+		}
+		page := 1
+		if len(pages) > 0 {
+			if page, err = strconv.Atoi(pages[min(k, len(pages)-1)]); err != nil || page < 1 {
+				jsonError(w, "Numéro de page invalide", http.StatusBadRequest)
+				return nil, false
+			}
+		}
+
+		data, mimeType, err := convertUpload(r.Context(), data, format, page)
+		switch {
+		case errors.Is(err, errImageTooLarge):
+			jsonError(w, "Image trop grande (max 50 millions de pixels)", http.StatusRequestEntityTooLarge)
+			return nil, false
+		case errors.Is(err, errConverterMissing):
+			log.Printf("Convert upload error: %v", err)
+			jsonError(w, "Conversion des fichiers "+formatName(format)+" indisponible sur ce serveur", http.StatusUnsupportedMediaType)
+			return nil, false
+		case err != nil:
+			log.Printf("Convert upload error: %v", err)
+			if format == formatPDF {
+				jsonError(w, fmt.Sprintf("Impossible de lire la page %d du PDF", page), http.StatusBadRequest)
+			} else {
+				jsonError(w, "Impossible de lire l'image "+formatName(format), http.StatusBadRequest)
+			}
+			return nil, false
+		}
+		photos = append(photos, Photo{data, mimeType})
+	}
+	return photos, true
+}
+
+// readFormFile reads an uploaded file.
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
 func jsonError(w http.ResponseWriter, msg string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -1,19 +1,68 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"strings"
 	"testing"
 	"time"
 )
 
 func newTestServer() *Server {
-	store := NewStore()
+	store := NewMemoryStore()
 	return NewServer(store, nil)
 }
 
+func newFixtureServer(t *testing.T) *Server {
+	t.Helper()
+	analyzer, err := NewFixtureAnalyzer(defaultFixture)
+	if err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+	return newAnalyzerServer(t, analyzer)
+}
+
+// newAnalyzerServer returns a server analyzing uploads with analyzer,
+// whose workers stop at the end of the test.
+func newAnalyzerServer(t *testing.T, analyzer GridAnalyzer) *Server {
+	t.Helper()
+	srv := NewServer(NewMemoryStore(), analyzer)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newUploadRequest builds a multipart POST /api/grids request with one image.
+func newUploadRequest(t *testing.T, mimeType string, data []byte) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="image"; filename="grid"`)
+	h.Set("Content-Type", mimeType)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatalf("create part: %v", err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/grids", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// fakePNG returns content behind a PNG signature: it passes for a PNG
+// upload but does not decode.
+func fakePNG(content string) []byte {
+	return append(append([]byte(nil), pngSignature...), content...)
+}
+
 func seedGrid(s *Server) *Grid {
 	g := &Grid{
 		Rows: 3,
@@ -129,6 +178,347 @@ func TestFullGameFlow(t *testing.T) {
 	}
 }
 
+func TestCreateGridWithFixtureAnalyzer(t *testing.T) {
+	srv := newFixtureServer(t)
+
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", fakePNG("not really a png")))
+	if job.State != jobDone {
+		t.Fatalf("expected a done job, got %+v", job)
+	}
+	grid := srv.store.GetGrid(job.GridID)
+	if grid == nil {
+		t.Fatal("uploaded grid should be stored")
+	}
+	if grid.Rows != 4 || grid.Cols != 4 {
+		t.Fatalf("unexpected grid: %dx%d", grid.Rows, grid.Cols)
+	}
+
+	// Unsupported format is rejected before analysis.
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newUploadRequest(t, "image/gif", []byte("GIF89a")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("gif upload: expected 400, got %d", w.Code)
+	}
+}
+
+func TestCreateGridWithoutAnalyzer(t *testing.T) {
+	srv := newTestServer()
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newUploadRequest(t, "image/png", fakePNG("png")))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestGetAnalyzer(t *testing.T) {
+	g, _, _ := scriptedGemini(t)
+	other, _, _ := scriptedGemini(t)
+	other.retry.Attempts = 5
+
+	for _, tc := range []struct {
+		analyzer GridAnalyzer
+		want     AnalyzerInfo
+	}{
+		{LocalAnalyzer{}, AnalyzerInfo{Name: "local"}},
+		{&kindAnalyzer{}, AnalyzerInfo{}},
+		{g, other.Describe()},
+	} {
+		w := httptest.NewRecorder()
+		newAnalyzerServer(t, tc.analyzer).ServeHTTP(w, httptest.NewRequest("GET", "/api/analyzer", nil))
+		var info AnalyzerInfo
+		json.NewDecoder(w.Body).Decode(&info)
+		if w.Code != http.StatusOK || info != tc.want {
+			t.Errorf("%T: got %d %+v, want %+v", tc.analyzer, w.Code, info, tc.want)
+		}
+	}
+	if info := g.Describe(); info.Model != "primary" || info.FallbackModel != "fallback" || len(info.Prompt) != 8 {
+		t.Errorf("gemini = %+v", info)
+	}
+
+	w := httptest.NewRecorder()
+	newTestServer().ServeHTTP(w, httptest.NewRequest("GET", "/api/analyzer", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without analyzer: expected 503, got %d", w.Code)
+	}
+}
+
+// kindAnalyzer returns the classic test grid when asked for one, and
+// records the requested kind.
+type kindAnalyzer struct{ kind string }
+
+func (a *kindAnalyzer) AnalyzeImage(_ context.Context, _ []byte, _, kind string) (*Grid, error) {
+	a.kind = kind
+	if kind == KindClassic {
+		return classicTestGrid(), nil
+	}
+	return newTestGrid(2, 2), nil
+}
+
+func TestCreateGridKind(t *testing.T) {
+	analyzer := &kindAnalyzer{}
+	srv := newAnalyzerServer(t, analyzer)
+
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", fakePNG("png")))
+	if job.State != jobDone || analyzer.kind != KindArrow {
+		t.Fatalf("default upload: job %s with kind %q", job.State, analyzer.kind)
+	}
+
+	req := newUploadRequest(t, "image/png", fakePNG("png"))
+	req.URL.RawQuery = "kind=classic"
+	job = analyzeUpload(t, srv, req)
+	grid := srv.store.GetGrid(job.GridID)
+	if grid == nil || grid.Kind != KindClassic || grid.Clues == nil || len(grid.Clues.Horizontal) != 3 {
+		t.Fatalf("expected a classic grid with its clues, got %+v", grid)
+	}
+
+	req = newUploadRequest(t, "image/png", fakePNG("png"))
+	req.URL.RawQuery = "kind=sudoku"
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown kind: expected 400, got %d", w.Code)
+	}
+}
+
+func TestFixtureAnalyzerReturnsCopies(t *testing.T) {
+	analyzer, err := NewFixtureAnalyzer(defaultFixture)
+	if err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+
+	g1, err := analyzer.AnalyzeImage(context.Background(), nil, "image/png", KindArrow)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	g1.Cells[0][0].Black = false
+
+	g2, _ := analyzer.AnalyzeImage(context.Background(), nil, "image/png", KindArrow)
+	if !g2.Cells[0][0].Black {
+		t.Fatal("each analysis should return an independent grid")
+	}
+
+	if _, err := NewFixtureAnalyzer("test_data/missing.json"); err == nil {
+		t.Fatal("expected error for missing fixture")
+	}
+}
+
+func TestSolutionAndCheck(t *testing.T) {
+	srv := newFixtureServer(t)
+	grid := seedGrid(srv)
+
+	// Checking before a solution is known fails.
+	game, _ := srv.store.CreateGame(grid.ID)
+	req := httptest.NewRequest("POST", "/api/games/"+game.ID+"/check", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("check without solution: expected 409, got %d", w.Code)
+	}
+
+	// Invalid solution: wrong row count.
+	body := `{"rows":["#AB"]}`
+	req = httptest.NewRequest("PUT", "/api/grids/"+grid.ID+"/solution", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid solution: expected 400, got %d", w.Code)
+	}
+
+	body = `{"rows":["#AB","#CD","EFG"]}`
+	req = httptest.NewRequest("PUT", "/api/grids/"+grid.ID+"/solution", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set solution: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The solution is never sent to players.
+	req = httptest.NewRequest("GET", "/api/grids/"+grid.ID, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), `"solution"`) {
+		t.Fatalf("grid response leaks the solution: %s", w.Body.String())
+	}
+
+	game.SetCell(0, 1, "A")
+	game.SetCell(2, 0, "Z")
+
+	req = httptest.NewRequest("POST", "/api/games/"+game.ID+"/check", strings.NewReader(`{"pseudo":"Alice"}`))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("check: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result struct {
+		Wrong  []Position `json:"wrong"`
+		Filled int        `json:"filled"`
+	}
+	json.NewDecoder(w.Body).Decode(&result)
+	if result.Filled != 2 || len(result.Wrong) != 1 || result.Wrong[0] != (Position{Row: 2, Col: 0}) {
+		t.Fatalf("unexpected check result: %+v", result)
+	}
+}
+
+func TestSolutionFromPhoto(t *testing.T) {
+	srv := newFixtureServer(t)
+
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", fakePNG("grid")))
+	grid := srv.store.GetGrid(job.GridID)
+	if grid == nil || grid.HasSolution {
+		t.Fatal("analyzed grid should be stored without a solution")
+	}
+
+	req := newUploadRequest(t, "image/png", fakePNG("answers"))
+	req.Method = "PUT"
+	req.URL.Path = "/api/grids/" + grid.ID + "/solution"
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("solution photo: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	stored := srv.store.GetGrid(grid.ID)
+	if !stored.HasSolution || stored.Cells[1][1].Solution != "R" {
+		t.Fatal("solution from photo should be stored on the grid")
+	}
+}
+
+// revisingAnalyzer reads the fixture solution, while the grid is revised
+// by someone else.
+type revisingAnalyzer struct {
+	*FixtureAnalyzer
+	store Store
+}
+
+func (a revisingAnalyzer) AnalyzeSolution(ctx context.Context, data []byte, mimeType string, grid *Grid) ([]string, error) {
+	revised := a.store.GetGrid(grid.ID).Clone()
+	revised.Cells[1][1].Confidence = confidence(1)
+	if err := a.store.ReviseGrid(revised); err != nil {
+		return nil, err
+	}
+	return a.FixtureAnalyzer.AnalyzeSolution(ctx, data, mimeType, grid)
+}
+
+func TestSolutionVersionConflict(t *testing.T) {
+	srv := newFixtureServer(t)
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", fakePNG("grid")))
+	grid := srv.store.GetGrid(job.GridID)
+
+	put := func(req *http.Request) int {
+		req.Method = "PUT"
+		req.URL.Path = "/api/grids/" + grid.ID + "/solution"
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+	answers := `{"rows":["####","#RAT","#AMI","#SEC"],"version":2}`
+	if code := put(httptest.NewRequest("PUT", "/", strings.NewReader(answers))); code != http.StatusConflict {
+		t.Fatalf("version ahead: expected 409, got %d", code)
+	}
+
+	// A revision made while the photo of the answers is read wins.
+	srv.analyzer = revisingAnalyzer{srv.analyzer.(*FixtureAnalyzer), srv.store}
+	if code := put(newUploadRequest(t, "image/png", fakePNG("answers"))); code != http.StatusConflict {
+		t.Fatalf("revised during analysis: expected 409, got %d", code)
+	}
+	if latest := srv.store.GetGrid(grid.ID); latest.Version != 2 || latest.HasSolution {
+		t.Fatalf("revision should be kept without the solution: %+v", latest)
+	}
+
+	srv.analyzer = srv.analyzer.(revisingAnalyzer).FixtureAnalyzer
+	if code := put(httptest.NewRequest("PUT", "/", strings.NewReader(answers))); code != http.StatusOK {
+		t.Fatalf("current version: expected 200, got %d", code)
+	}
+}
+
+func TestGameCompletedFreezesBoard(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+	game, _ := srv.store.CreateGame(grid.ID)
+
+	move := func(row, col int, value string) int {
+		body := fmt.Sprintf(`{"pseudo":"Alice","row":%d,"col":%d,"value":%q}`, row, col, value)
+		req := httptest.NewRequest("POST", "/api/games/"+game.ID+"/move", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for r := range 3 {
+		for c := range 3 {
+			if grid.Cells[r][c].Black {
+				continue
+			}
+			if code := move(r, c, "A"); code != http.StatusNoContent {
+				t.Fatalf("move (%d,%d): expected 204, got %d", r, c, code)
+			}
+		}
+	}
+
+	if game.Completed() == nil {
+		t.Fatal("filling every letter cell should complete the game")
+	}
+	if code := move(2, 2, "B"); code != http.StatusConflict {
+		t.Fatalf("move after completion: expected 409, got %d", code)
+	}
+}
+
+func TestHistoryUndoRedoEndpoints(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+	game, _ := srv.store.CreateGame(grid.ID)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/games/"+game.ID+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	post("/move", `{"pseudo":"Alice","row":0,"col":1,"value":"A"}`)
+	post("/move", `{"pseudo":"Alice","row":0,"col":2,"value":"B"}`)
+
+	w := post("/undo", `{"pseudo":"Alice"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("undo: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if game.GetState()[0][2] != "" {
+		t.Fatal("undo should clear the last letter")
+	}
+
+	if w := post("/undo", `{"pseudo":"Bob"}`); w.Code != http.StatusConflict {
+		t.Fatalf("undo without moves: expected 409, got %d", w.Code)
+	}
+	if w := post("/undo", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("undo without pseudo: expected 400, got %d", w.Code)
+	}
+
+	if w := post("/redo", `{"pseudo":"Alice"}`); w.Code != http.StatusOK {
+		t.Fatalf("redo: expected 200, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/games/"+game.ID+"/history?since=1", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("history: expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Moves []Move `json:"moves"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Moves) != 3 || resp.Moves[0].Seq != 2 || resp.Moves[2].Kind != moveRedo {
+		t.Fatalf("unexpected history: %+v", resp.Moves)
+	}
+}
+
 func TestCreateGameInvalidGrid(t *testing.T) {
 	srv := newTestServer()
 
@@ -200,8 +590,8 @@ func TestSecurityHeaders(t *testing.T) {
 
 	headers := map[string]string{
 		"X-Content-Type-Options": "nosniff",
-		"X-Frame-Options":       "DENY",
-		"Referrer-Policy":       "strict-origin-when-cross-origin",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
 	}
 
 	for key, expected := range headers {
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,69 +12,165 @@ import (
 const (
 	sseChannelBuffer = 16
 	sseHeartbeat     = 30 * time.Second
+	sseReplayBuffer  = 256              // recent events kept per game for Last-Event-ID replay
+	sseLogRetention  = 30 * time.Minute // a game's events are kept this long after its last client left
+	ssePruneInterval = time.Minute      // least time between two scans for such logs
 )
 
+// event is a broadcast message with its per-game sequence number.
+type event struct {
+	Seq  uint64
+	Data string
+}
+
 // client represents a single SSE connection.
 type client struct {
-	ch     chan string
+	ch     chan event
 	gameID string
+	log    *gameLog
+	start  uint64 // last sequence number when the client registered
+}
+
+// gameLog numbers the events of one game and keeps the most recent ones.
+type gameLog struct {
+	seq       uint64
+	recent    [sseReplayBuffer]event // ring buffer indexed by seq % sseReplayBuffer
+	clients   int
+	idleSince time.Time // last event or departure while no client is connected
+}
+
+// since returns the events after seq, or ok=false if some were already
+// evicted from the ring buffer or seq is unknown.
+func (l *gameLog) since(seq uint64) (missed []event, ok bool) {
+	if seq > l.seq {
+		return nil, false
+	}
+	if l.seq-seq > sseReplayBuffer {
+		return nil, false
+	}
+	for s := seq + 1; s <= l.seq; s++ {
+		missed = append(missed, l.recent[s%sseReplayBuffer])
+	}
+	return missed, true
 }
 
 // Broadcaster manages SSE clients grouped by game session.
+//
+// Every broadcast gets a sequence number, monotonically increasing per game.
+// Event IDs sent to clients combine it with an epoch that changes on each
+// server start, so that IDs from a previous run are never mistaken for
+// current ones.
+//
+// The events of a game are forgotten sseLogRetention after its last client
+// left: a client coming back later gets a snapshot instead of a replay.
 type Broadcaster struct {
-	mu      sync.RWMutex
+	mu      sync.Mutex
 	clients map[*client]struct{}
+	logs    map[string]*gameLog
+	epoch   string
+	pruned  time.Time // last scan for idle logs
 }
 
 // NewBroadcaster creates an empty broadcaster.
 func NewBroadcaster() *Broadcaster {
 	return &Broadcaster{
 		clients: make(map[*client]struct{}),
+		logs:    make(map[string]*gameLog),
+		epoch:   generateID()[:8],
 	}
 }
 
 // Register adds a client for a game session and returns it.
 func (b *Broadcaster) Register(gameID string) *client {
-	c := &client{
-		ch:     make(chan string, sseChannelBuffer),
+	c, _, _ := b.Resume(gameID, "")
+	return c
+}
+
+// Resume registers a client for a game session and returns the events it
+// missed since lastEventID. resumed is false when lastEventID is empty,
+// from another server run, or too old for the replay buffer: the caller
+// must then send a full snapshot instead.
+func (b *Broadcaster) Resume(gameID, lastEventID string) (c *client, missed []event, resumed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune()
+	l := b.log(gameID)
+	c = &client{
+		ch:     make(chan event, sseChannelBuffer),
 		gameID: gameID,
+		log:    l,
+		start:  l.seq,
 	}
-	b.mu.Lock()
 	b.clients[c] = struct{}{}
-	b.mu.Unlock()
-	return c
+	l.clients++
+
+	if seq, ok := b.parseEventID(lastEventID); ok {
+		missed, resumed = l.since(seq)
+	}
+	return c, missed, resumed
 }
 
 // Unregister removes a client and closes its channel.
 func (b *Broadcaster) Unregister(c *client) {
 	b.mu.Lock()
-	if _, ok := b.clients[c]; ok {
-		delete(b.clients, c)
-		close(c.ch)
-	}
+	b.drop(c)
 	b.mu.Unlock()
 }
 
 // Broadcast sends a message to all clients of a game session.
+// A client whose buffer is full is disconnected rather than silently
+// skipped: it reconnects with Last-Event-ID and replays what it missed.
 func (b *Broadcaster) Broadcast(gameID, data string) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune()
+	l := b.log(gameID)
+	l.seq++
+	evt := event{Seq: l.seq, Data: data}
+	l.recent[l.seq%sseReplayBuffer] = evt
+	if l.clients == 0 {
+		l.idleSince = time.Now()
+	}
 
 	for c := range b.clients {
 		if c.gameID == gameID {
 			select {
-			case c.ch <- data:
+			case c.ch <- evt:
 			default:
-				// Channel full, skip slow client.
+				b.drop(c)
 			}
 		}
 	}
 }
 
+// Forget drops the event log of a game, once no client can resume it.
+// Connected clients stay registered until they disconnect.
+func (b *Broadcaster) Forget(gameID string) {
+	b.mu.Lock()
+	delete(b.logs, gameID)
+	b.mu.Unlock()
+}
+
+// Active returns the games whose events are kept: those with clients, or
+// left by their last client less than sseLogRetention ago.
+func (b *Broadcaster) Active() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune()
+	ids := make([]string, 0, len(b.logs))
+	for id := range b.logs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 // ClientCount returns the number of connected clients for a game.
 func (b *Broadcaster) ClientCount(gameID string) int {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	n := 0
 	for c := range b.clients {
@@ -84,7 +182,10 @@ func (b *Broadcaster) ClientCount(gameID string) int {
 }
 
 // ServeSSE handles an SSE connection for a game session.
-func (b *Broadcaster) ServeSSE(w http.ResponseWriter, r *http.Request, gameID string, onConnect func(c *client), onDisconnect func()) {
+// Clients resuming with a Last-Event-ID header (or a last_event_id query
+// parameter) get the events they missed; others get snapshot() as their
+// first event.
+func (b *Broadcaster) ServeSSE(w http.ResponseWriter, r *http.Request, gameID string, snapshot func() string, onDisconnect func()) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming non supporté", http.StatusInternalServerError)
@@ -95,7 +196,12 @@ func (b *Broadcaster) ServeSSE(w http.ResponseWriter, r *http.Request, gameID st
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	c := b.Register(gameID)
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	c, missed, resumed := b.Resume(gameID, lastEventID)
 	defer func() {
 		b.Unregister(c)
 		if onDisconnect != nil {
@@ -103,9 +209,14 @@ func (b *Broadcaster) ServeSSE(w http.ResponseWriter, r *http.Request, gameID st
 		}
 	}()
 
-	if onConnect != nil {
-		onConnect(c)
+	if resumed {
+		for _, evt := range missed {
+			b.writeEvent(w, evt)
+		}
+	} else if snapshot != nil {
+		b.writeEvent(w, event{Seq: c.start, Data: snapshot()})
 	}
+	flusher.Flush()
 
 	ticker := time.NewTicker(sseHeartbeat)
 	defer ticker.Stop()
@@ -114,11 +225,11 @@ func (b *Broadcaster) ServeSSE(w http.ResponseWriter, r *http.Request, gameID st
 		select {
 		case <-r.Context().Done():
 			return
-		case msg, ok := <-c.ch:
+		case evt, ok := <-c.ch:
 			if !ok {
 				return
 			}
-			fmt.Fprintf(w, "data: %s\n\n", msg)
+			b.writeEvent(w, evt)
 			flusher.Flush()
 		case <-ticker.C:
 			fmt.Fprintf(w, ": heartbeat\n\n")
@@ -126,3 +237,58 @@ func (b *Broadcaster) ServeSSE(w http.ResponseWriter, r *http.Request, gameID st
 		}
 	}
 }
+
+func (b *Broadcaster) writeEvent(w http.ResponseWriter, evt event) {
+	fmt.Fprintf(w, "id: %s\ndata: %s\n\n", b.eventID(evt.Seq), evt.Data)
+}
+
+// eventID formats a sequence number as an SSE event ID.
+func (b *Broadcaster) eventID(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventID extracts the sequence number of an event ID from this run.
+func (b *Broadcaster) parseEventID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// log returns the event log of a game, creating it. Caller must hold b.mu.
+func (b *Broadcaster) log(gameID string) *gameLog {
+	l, ok := b.logs[gameID]
+	if !ok {
+		l = &gameLog{idleSince: time.Now()}
+		b.logs[gameID] = l
+	}
+	return l
+}
+
+// prune forgets the logs of the games left by their last client more than
+// sseLogRetention ago, scanning at most once per ssePruneInterval.
+// Caller must hold b.mu.
+func (b *Broadcaster) prune() {
+	if time.Since(b.pruned) < ssePruneInterval {
+		return
+	}
+	b.pruned = time.Now()
+	for id, l := range b.logs {
+		if l.clients == 0 && time.Since(l.idleSince) > sseLogRetention {
+			delete(b.logs, id)
+		}
+	}
+}
+
+// drop removes a client and closes its channel. Caller must hold b.mu.
+func (b *Broadcaster) drop(c *client) {
+	if _, ok := b.clients[c]; ok {
+		delete(b.clients, c)
+		close(c.ch)
+		if c.log.clients--; c.log.clients == 0 {
+			c.log.idleSince = time.Now()
+		}
+	}
+}
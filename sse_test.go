@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
@@ -50,8 +52,8 @@ func TestBroadcast(t *testing.T) {
 
 	select {
 	case msg := <-c1.ch:
-		if msg != "hello" {
-			t.Fatalf("c1 expected 'hello', got %q", msg)
+		if msg.Data != "hello" {
+			t.Fatalf("c1 expected 'hello', got %q", msg.Data)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("c1 did not receive message")
@@ -59,8 +61,8 @@ func TestBroadcast(t *testing.T) {
 
 	select {
 	case msg := <-c2.ch:
-		if msg != "hello" {
-			t.Fatalf("c2 expected 'hello', got %q", msg)
+		if msg.Data != "hello" {
+			t.Fatalf("c2 expected 'hello', got %q", msg.Data)
 		}
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("c2 did not receive message")
@@ -79,7 +81,7 @@ func TestBroadcast(t *testing.T) {
 	b.Unregister(c3)
 }
 
-func TestBroadcastSkipsFullChannel(t *testing.T) {
+func TestBroadcastDropsSlowClient(t *testing.T) {
 	b := NewBroadcaster()
 	c := b.Register("game1")
 
@@ -88,10 +90,165 @@ func TestBroadcastSkipsFullChannel(t *testing.T) {
 		b.Broadcast("game1", "fill")
 	}
 
-	// This should not block.
+	// This should not block, and disconnects the slow client.
 	b.Broadcast("game1", "overflow")
 
+	if b.ClientCount("game1") != 0 {
+		t.Fatal("slow client should be disconnected")
+	}
+	for range sseChannelBuffer {
+		<-c.ch
+	}
+	if _, ok := <-c.ch; ok {
+		t.Fatal("slow client channel should be closed")
+	}
+
+	b.Unregister(c) // should not panic
+}
+
+func TestBroadcastSequence(t *testing.T) {
+	b := NewBroadcaster()
+	c := b.Register("game1")
+	defer b.Unregister(c)
+
+	b.Broadcast("game1", "a")
+	b.Broadcast("game2", "x")
+	b.Broadcast("game1", "b")
+
+	if e := <-c.ch; e.Seq != 1 || e.Data != "a" {
+		t.Fatalf("expected seq 1, got %+v", e)
+	}
+	if e := <-c.ch; e.Seq != 2 || e.Data != "b" {
+		t.Fatalf("sequence should be per game, got %+v", e)
+	}
+}
+
+func TestResume(t *testing.T) {
+	b := NewBroadcaster()
+	for _, msg := range []string{"a", "b", "c"} {
+		b.Broadcast("game1", msg)
+	}
+
+	c, missed, resumed := b.Resume("game1", b.eventID(1))
+	defer b.Unregister(c)
+	if !resumed {
+		t.Fatal("expected to resume from a recent event")
+	}
+	if len(missed) != 2 || missed[0].Data != "b" || missed[1].Data != "c" {
+		t.Fatalf("unexpected replay: %+v", missed)
+	}
+
+	cases := map[string]string{
+		"no id":         "",
+		"other run":     "deadbeef-1",
+		"future":        b.eventID(10),
+		"garbage":       b.epoch + "-x",
+		"unknown shape": "42",
+	}
+	for name, id := range cases {
+		c, _, resumed := b.Resume("game1", id)
+		b.Unregister(c)
+		if resumed {
+			t.Errorf("%s: expected a snapshot instead of a replay", name)
+		}
+	}
+
+	// Up to date: nothing to replay, but no snapshot needed either.
+	c2, missed, resumed := b.Resume("game1", b.eventID(3))
+	b.Unregister(c2)
+	if !resumed || len(missed) != 0 {
+		t.Fatalf("expected empty replay, got resumed=%v missed=%d", resumed, len(missed))
+	}
+}
+
+func TestResumeGapTooLarge(t *testing.T) {
+	b := NewBroadcaster()
+	for range sseReplayBuffer + 2 {
+		b.Broadcast("game1", "msg")
+	}
+
+	c, _, resumed := b.Resume("game1", b.eventID(1))
+	b.Unregister(c)
+	if resumed {
+		t.Fatal("events evicted from the ring buffer cannot be replayed")
+	}
+
+	c, missed, resumed := b.Resume("game1", b.eventID(2))
+	b.Unregister(c)
+	if !resumed || len(missed) != sseReplayBuffer {
+		t.Fatalf("expected a full-buffer replay, got resumed=%v missed=%d", resumed, len(missed))
+	}
+}
+
+func TestBroadcasterForgetsIdleGames(t *testing.T) {
+	b := NewBroadcaster()
+	left := b.Register("left")
+	b.Broadcast("left", "a")
+	b.Unregister(left)
+	watched := b.Register("watched")
+	defer b.Unregister(watched)
+	b.Broadcast("watched", "a")
+
+	// Left within the retention window: still resumable.
+	b.pruned = time.Time{}
+	c, _, resumed := b.Resume("left", b.eventID(1))
+	b.Unregister(c)
+	if !resumed {
+		t.Fatal("a game left recently should be resumable")
+	}
+
+	for _, l := range b.logs {
+		l.idleSince = time.Now().Add(-sseLogRetention - time.Second)
+	}
+	b.pruned = time.Time{}
+	b.Broadcast("other", "a")
+	if _, ok := b.logs["left"]; ok {
+		t.Fatal("the log of a game without clients should be forgotten")
+	}
+	if _, ok := b.logs["watched"]; !ok {
+		t.Fatal("the log of a game with clients should be kept")
+	}
+	c, _, resumed = b.Resume("left", b.eventID(1))
 	b.Unregister(c)
+	if resumed {
+		t.Fatal("a forgotten game should get a snapshot")
+	}
+}
+
+func TestServeSSEReplaysAfterLastEventID(t *testing.T) {
+	b := NewBroadcaster()
+	b.Broadcast("game1", "a")
+	b.Broadcast("game1", "b")
+
+	read := func(lastEventID string) string {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", "/events", nil).WithContext(ctx)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			b.ServeSSE(w, req, "game1", func() string { return "snapshot" }, nil)
+			close(done)
+		}()
+		for b.ClientCount("game1") == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-done
+		return w.Body.String()
+	}
+
+	body := read("")
+	if body != "id: "+b.eventID(2)+"\ndata: snapshot\n\n" {
+		t.Fatalf("new client should get a snapshot, got %q", body)
+	}
+
+	body = read(b.eventID(1))
+	if body != "id: "+b.eventID(2)+"\ndata: b\n\n" {
+		t.Fatalf("resuming client should get missed events, got %q", body)
+	}
 }
 
 func TestBroadcasterConcurrent(t *testing.T) {
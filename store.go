@@ -3,47 +3,159 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 )
 
-// Store holds all grids and game sessions in memory.
-type Store struct {
-	mu    sync.RWMutex
-	grids map[string]*Grid
-	games map[string]*GameSession
+// Store persists grids and game sessions.
+//
+// Game sessions are live objects: handlers mutate them through their own
+// methods and then call SaveGame so that durable stores can write them out.
+type Store interface {
+	// SaveGrid persists a new grid and returns it with a generated ID.
+	SaveGrid(g *Grid) (*Grid, error)
+	// GetGrid returns a grid by ID, or nil if not found.
+	GetGrid(id string) *Grid
+	// UpdateGrid replaces a stored grid with a modified copy, keeping its
+	// version. g.Version must be the latest stored version, otherwise
+	// errVersionConflict is returned.
+	UpdateGrid(g *Grid) error
+	// ReviseGrid stores g as the next version of an existing grid. g.Version
+	// must be the latest stored version; it is incremented. Earlier versions
+	// stay readable with GetGridVersion, for the games created on them.
+	ReviseGrid(g *Grid) error
+	// GetGridVersion returns a given version of a grid, or nil if not found.
+	GetGridVersion(id string, version int) *Grid
+	// ListGrids returns all grids, most recent first.
+	ListGrids() []*Grid
+
+	// SaveImage stores an uploaded image, or updates the metadata of the
+	// image with the same hash. The data and preview of a stored image
+	// never change.
+	SaveImage(img *SourceImage) error
+	// GetImage returns an image, its data and preview by hash, or nil if
+	// not found.
+	GetImage(hash string) *SourceImage
+	// ListImages returns all images, without their data and preview.
+	ListImages() []*SourceImage
+	// SaveImageVariant stores a version of an image derived from its data,
+	// such as the one prepared for the analyzer, under a name.
+	SaveImageVariant(hash, name string, data []byte) error
+	// GetImageVariant returns a version of an image by name, or nil if not
+	// found.
+	GetImageVariant(hash, name string) []byte
+
+	// CreateGame creates a new game session for a given grid.
+	CreateGame(gridID string) (*GameSession, error)
+	// GetGame returns a game session by ID, or nil if not found.
+	GetGame(id string) *GameSession
+	// SaveGame persists the current state of a game session.
+	SaveGame(game *GameSession) error
+	// ListGames returns all game sessions.
+	ListGames() []*GameSession
+
+	// Close releases resources held by the store.
+	Close() error
+}
+
+// errVersionConflict is returned by UpdateGrid and ReviseGrid when the grid
+// was revised in the meantime.
+var errVersionConflict = errors.New("grid version conflict")
+
+// MemoryStore holds all grids and game sessions in memory.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	grids    map[string]*Grid
+	versions map[string][]*Grid // earlier versions of each grid, oldest first
+	images   map[string]*SourceImage
+	variants map[string][]byte // by hash and name
+	games    map[string]*GameSession
 }
 
-// NewStore creates an empty store.
-func NewStore() *Store {
-	return &Store{
-		grids: make(map[string]*Grid),
-		games: make(map[string]*GameSession),
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		grids:    make(map[string]*Grid),
+		versions: make(map[string][]*Grid),
+		images:   make(map[string]*SourceImage),
+		variants: make(map[string][]byte),
+		games:    make(map[string]*GameSession),
 	}
 }
 
 // SaveGrid persists a grid and returns it with a generated ID.
-func (s *Store) SaveGrid(g *Grid) *Grid {
+func (s *MemoryStore) SaveGrid(g *Grid) (*Grid, error) {
 	g.ID = generateID()
+	g.Version = 1
 	g.CreatedAt = time.Now()
 
 	s.mu.Lock()
 	s.grids[g.ID] = g
 	s.mu.Unlock()
 
-	return g
+	return g, nil
 }
 
 // GetGrid returns a grid by ID, or nil if not found.
-func (s *Store) GetGrid(id string) *Grid {
+func (s *MemoryStore) GetGrid(id string) *Grid {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.grids[id]
 }
 
+// UpdateGrid replaces a stored grid with a modified copy.
+// Returns an error if the grid does not exist.
+func (s *MemoryStore) UpdateGrid(g *Grid) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest, ok := s.grids[g.ID]
+	if !ok {
+		return fmt.Errorf("grid not found: %s", g.ID)
+	}
+	if latest.Version != g.Version {
+		return errVersionConflict
+	}
+	s.grids[g.ID] = g
+	return nil
+}
+
+// ReviseGrid stores g as the next version of an existing grid.
+func (s *MemoryStore) ReviseGrid(g *Grid) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest, ok := s.grids[g.ID]
+	if !ok {
+		return fmt.Errorf("grid not found: %s", g.ID)
+	}
+	if latest.Version != g.Version {
+		return errVersionConflict
+	}
+	s.versions[g.ID] = append(s.versions[g.ID], latest)
+	g.Version++
+	s.grids[g.ID] = g
+	return nil
+}
+
+// GetGridVersion returns a given version of a grid, or nil if not found.
+func (s *MemoryStore) GetGridVersion(id string, version int) *Grid {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if g := s.grids[id]; g != nil && g.Version == version {
+		return g
+	}
+	if older := s.versions[id]; version >= 1 && version <= len(older) {
+		return older[version-1]
+	}
+	return nil
+}
+
 // ListGrids returns all grids, most recent first.
-func (s *Store) ListGrids() []*Grid {
+func (s *MemoryStore) ListGrids() []*Grid {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -51,18 +163,72 @@ func (s *Store) ListGrids() []*Grid {
 	for _, g := range s.grids {
 		list = append(list, g)
 	}
-	// Sort by CreatedAt descending (simple insertion, small N).
-	for i := 1; i < len(list); i++ {
-		for j := i; j > 0 && list[j].CreatedAt.After(list[j-1].CreatedAt); j-- {
-			list[j], list[j-1] = list[j-1], list[j]
-		}
+	sortGridsByDate(list)
+	return list
+}
+
+// SaveImage stores a copy of an image, keeping the data already stored
+// under the same hash.
+func (s *MemoryStore) SaveImage(img *SourceImage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp := img.clone()
+	if old, ok := s.images[img.Hash]; ok {
+		cp.Data, cp.Preview = old.Data, old.Preview
+	}
+	s.images[img.Hash] = cp
+	return nil
+}
+
+// GetImage returns a copy of an image by hash, or nil if not found.
+func (s *MemoryStore) GetImage(hash string) *SourceImage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if img, ok := s.images[hash]; ok {
+		return img.clone()
+	}
+	return nil
+}
+
+// ListImages returns copies of all images, without their data.
+func (s *MemoryStore) ListImages() []*SourceImage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*SourceImage, 0, len(s.images))
+	for _, img := range s.images {
+		cp := img.clone()
+		cp.Data, cp.Preview = nil, nil
+		list = append(list, cp)
 	}
 	return list
 }
 
+// SaveImageVariant stores a derived version of an image.
+func (s *MemoryStore) SaveImageVariant(hash, name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.images[hash]; !ok {
+		return fmt.Errorf("image %s not found", hash)
+	}
+	s.variants[hash+"/"+name] = data
+	return nil
+}
+
+// GetImageVariant returns a derived version of an image, or nil.
+func (s *MemoryStore) GetImageVariant(hash, name string) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.variants[hash+"/"+name]
+}
+
 // CreateGame creates a new game session for a given grid.
 // Returns an error if the grid does not exist.
-func (s *Store) CreateGame(gridID string) (*GameSession, error) {
+func (s *MemoryStore) CreateGame(gridID string) (*GameSession, error) {
 	s.mu.RLock()
 	grid := s.grids[gridID]
 	s.mu.RUnlock()
@@ -71,19 +237,7 @@ func (s *Store) CreateGame(gridID string) (*GameSession, error) {
 		return nil, fmt.Errorf("grid not found: %s", gridID)
 	}
 
-	// Initialize empty state matching grid dimensions.
-	state := make([][]string, grid.Rows)
-	for i := range state {
-		state[i] = make([]string, grid.Cols)
-	}
-
-	game := &GameSession{
-		ID:        generateID(),
-		GridID:    gridID,
-		Players:   make(map[string]*Player),
-		State:     state,
-		CreatedAt: time.Now(),
-	}
+	game := newGameSession(grid)
 
 	s.mu.Lock()
 	s.games[game.ID] = game
@@ -93,14 +247,19 @@ func (s *Store) CreateGame(gridID string) (*GameSession, error) {
 }
 
 // GetGame returns a game session by ID, or nil if not found.
-func (s *Store) GetGame(id string) *GameSession {
+func (s *MemoryStore) GetGame(id string) *GameSession {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.games[id]
 }
 
+// SaveGame is a no-op: in-memory sessions are always up to date.
+func (s *MemoryStore) SaveGame(*GameSession) error {
+	return nil
+}
+
 // ListGames returns all game sessions.
-func (s *Store) ListGames() []*GameSession {
+func (s *MemoryStore) ListGames() []*GameSession {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -111,6 +270,37 @@ func (s *Store) ListGames() []*GameSession {
 	return list
 }
 
+// Close is a no-op for the in-memory store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// newGameSession creates a session with an empty state matching the grid.
+func newGameSession(grid *Grid) *GameSession {
+	state := make([][]string, grid.Rows)
+	for i := range state {
+		state[i] = make([]string, grid.Cols)
+	}
+
+	return &GameSession{
+		ID:          generateID(),
+		GridID:      grid.ID,
+		GridVersion: grid.Version,
+		Players:     make(map[string]*Player),
+		State:       state,
+		CreatedAt:   time.Now(),
+	}
+}
+
+// sortGridsByDate sorts by CreatedAt descending (simple insertion, small N).
+func sortGridsByDate(list []*Grid) {
+	for i := 1; i < len(list); i++ {
+		for j := i; j > 0 && list[j].CreatedAt.After(list[j-1].CreatedAt); j-- {
+			list[j], list[j-1] = list[j-1], list[j]
+		}
+	}
+}
+
 func generateID() string {
 	b := make([]byte, 8)
 	rand.Read(b)
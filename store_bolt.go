@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketMeta         = []byte("meta")
+	bucketGrids        = []byte("grids")
+	bucketGridVersions = []byte("grid_versions")
+	bucketGames        = []byte("games")
+	bucketImages       = []byte("images")
+	bucketImageData    = []byte("image_data")
+
+	keySchemaVersion = []byte("schema_version")
+)
+
+// boltMigrations upgrade the database schema one version at a time.
+// Migration i brings the schema from version i to version i+1; append new
+// steps at the end and never edit a released one.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// v1: grids and games stored as JSON documents keyed by ID.
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketGrids, bucketGames} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// v2: grids are versioned. Earlier versions are kept under
+	// "<id>/<version>"; existing grids and games are on version 1.
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketGridVersions); err != nil {
+			return err
+		}
+		if err := setJSONField(tx.Bucket(bucketGrids), "version", 1); err != nil {
+			return err
+		}
+		return setJSONField(tx.Bucket(bucketGames), "grid_version", 1)
+	},
+	// v3: uploaded images, keyed by the SHA-256 of their bytes: metadata
+	// as JSON in images, the bytes themselves in image_data (and the
+	// downscaled variant under "<hash>/preview").
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketImages, bucketImageData} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// setJSONField sets a field of every JSON document in a bucket.
+func setJSONField(b *bolt.Bucket, field string, value any) error {
+	updated := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		var doc map[string]any
+		if err := json.Unmarshal(v, &doc); err != nil {
+			return fmt.Errorf("decode %s: %w", k, err)
+		}
+		doc[field] = value
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		updated[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Keys cannot be written while iterating.
+	for k, data := range updated {
+		if err := b.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BoltStore persists grids and game sessions in an embedded bbolt database.
+// Sessions in use are kept in memory so that all handlers share the same
+// live object; SaveGame writes them back to disk.
+type BoltStore struct {
+	db *bolt.DB
+
+	mu    sync.Mutex // guards games and serializes session writes
+	games map[string]*GameSession
+}
+
+// OpenBoltStore opens (or creates) the database at path and migrates its
+// schema to the current version.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := migrateBolt(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{
+		db:    db,
+		games: make(map[string]*GameSession),
+	}, nil
+}
+
+func migrateBolt(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if v := meta.Get(keySchemaVersion); v != nil {
+			if err := json.Unmarshal(v, &version); err != nil {
+				return fmt.Errorf("read schema version: %w", err)
+			}
+		}
+		if version > len(boltMigrations) {
+			return fmt.Errorf("database schema v%d is newer than supported v%d", version, len(boltMigrations))
+		}
+
+		for ; version < len(boltMigrations); version++ {
+			if err := boltMigrations[version](tx); err != nil {
+				return fmt.Errorf("migrate schema to v%d: %w", version+1, err)
+			}
+		}
+		v, _ := json.Marshal(version)
+		return meta.Put(keySchemaVersion, v)
+	})
+}
+
+// SaveGrid persists a grid and returns it with a generated ID.
+func (s *BoltStore) SaveGrid(g *Grid) (*Grid, error) {
+	g.ID = generateID()
+	g.Version = 1
+	g.CreatedAt = time.Now()
+	if err := s.putJSON(bucketGrids, g.ID, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// GetGrid returns a grid by ID, or nil if not found.
+func (s *BoltStore) GetGrid(id string) *Grid {
+	var g Grid
+	found, err := s.getJSON(bucketGrids, id, &g)
+	if err != nil {
+		log.Printf("Load grid %s: %v", id, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	return &g
+}
+
+// UpdateGrid replaces a stored grid with a modified copy.
+// Returns an error if the grid does not exist.
+func (s *BoltStore) UpdateGrid(g *Grid) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("encode grid: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGrids)
+		current := b.Get([]byte(g.ID))
+		if current == nil {
+			return fmt.Errorf("grid not found: %s", g.ID)
+		}
+		var latest Grid
+		if err := json.Unmarshal(current, &latest); err != nil {
+			return fmt.Errorf("decode grid: %w", err)
+		}
+		if latest.Version != g.Version {
+			return errVersionConflict
+		}
+		return b.Put([]byte(g.ID), data)
+	})
+}
+
+// ReviseGrid stores g as the next version of an existing grid, moving the
+// current version to the grid_versions bucket.
+func (s *BoltStore) ReviseGrid(g *Grid) error {
+	revised := *g
+	revised.Version++
+	data, err := json.Marshal(&revised)
+	if err != nil {
+		return fmt.Errorf("encode grid: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGrids)
+		current := b.Get([]byte(g.ID))
+		if current == nil {
+			return fmt.Errorf("grid not found: %s", g.ID)
+		}
+		var latest Grid
+		if err := json.Unmarshal(current, &latest); err != nil {
+			return fmt.Errorf("decode grid: %w", err)
+		}
+		if latest.Version != g.Version {
+			return errVersionConflict
+		}
+		if err := tx.Bucket(bucketGridVersions).Put(gridVersionKey(g.ID, latest.Version), current); err != nil {
+			return err
+		}
+		return b.Put([]byte(g.ID), data)
+	})
+	if err != nil {
+		return err
+	}
+	g.Version = revised.Version
+	return nil
+}
+
+// GetGridVersion returns a given version of a grid, or nil if not found.
+func (s *BoltStore) GetGridVersion(id string, version int) *Grid {
+	if g := s.GetGrid(id); g == nil || g.Version == version {
+		return g
+	}
+	var g Grid
+	found, err := s.getJSON(bucketGridVersions, string(gridVersionKey(id, version)), &g)
+	if err != nil {
+		log.Printf("Load grid %s v%d: %v", id, version, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	return &g
+}
+
+func gridVersionKey(id string, version int) []byte {
+	return fmt.Appendf(nil, "%s/%08d", id, version)
+}
+
+// ListGrids returns all grids, most recent first.
+func (s *BoltStore) ListGrids() []*Grid {
+	list := []*Grid{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketGrids).ForEach(func(k, v []byte) error {
+			var g Grid
+			if err := json.Unmarshal(v, &g); err != nil {
+				log.Printf("Skip unreadable grid %s: %v", k, err)
+				return nil
+			}
+			list = append(list, &g)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("List grids: %v", err)
+	}
+	sortGridsByDate(list)
+	return list
+}
+
+// SaveImage stores the metadata of an image, and its data and preview if
+// it is new.
+func (s *BoltStore) SaveImage(img *SourceImage) error {
+	meta, err := json.Marshal(img)
+	if err != nil {
+		return fmt.Errorf("encode image: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketImageData)
+		if data.Get([]byte(img.Hash)) == nil && img.Data != nil {
+			if err := data.Put([]byte(img.Hash), img.Data); err != nil {
+				return err
+			}
+			if img.Preview != nil {
+				if err := data.Put(imagePreviewKey(img.Hash), img.Preview); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(bucketImages).Put([]byte(img.Hash), meta)
+	})
+}
+
+// GetImage returns an image and its data by hash, or nil if not found.
+func (s *BoltStore) GetImage(hash string) *SourceImage {
+	var img SourceImage
+	found, err := s.getJSON(bucketImages, hash, &img)
+	if err != nil {
+		log.Printf("Load image %s: %v", hash, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		// The slices are only valid during the transaction.
+		data := tx.Bucket(bucketImageData)
+		img.Data = bytes.Clone(data.Get([]byte(hash)))
+		img.Preview = bytes.Clone(data.Get(imagePreviewKey(hash)))
+		return nil
+	})
+	return &img
+}
+
+// imagePreviewKey is the key of the downscaled variant of an image in the
+// image_data bucket.
+func imagePreviewKey(hash string) []byte {
+	return imageVariantKey(hash, "preview")
+}
+
+// imageVariantKey is the key of a derived version of an image in the
+// image_data bucket.
+func imageVariantKey(hash, name string) []byte {
+	return []byte(hash + "/" + name)
+}
+
+// SaveImageVariant stores a derived version of an image.
+func (s *BoltStore) SaveImageVariant(hash, name string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketImages).Get([]byte(hash)) == nil {
+			return fmt.Errorf("image %s not found", hash)
+		}
+		return tx.Bucket(bucketImageData).Put(imageVariantKey(hash, name), data)
+	})
+}
+
+// GetImageVariant returns a derived version of an image, or nil.
+func (s *BoltStore) GetImageVariant(hash, name string) []byte {
+	var data []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		data = bytes.Clone(tx.Bucket(bucketImageData).Get(imageVariantKey(hash, name)))
+		return nil
+	})
+	return data
+}
+
+// ListImages returns all images, without their data and preview.
+func (s *BoltStore) ListImages() []*SourceImage {
+	var list []*SourceImage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketImages).ForEach(func(k, v []byte) error {
+			var img SourceImage
+			if err := json.Unmarshal(v, &img); err != nil {
+				return fmt.Errorf("decode image %s: %w", k, err)
+			}
+			list = append(list, &img)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("List images: %v", err)
+	}
+	return list
+}
+
+// CreateGame creates a new game session for a given grid.
+// Returns an error if the grid does not exist.
+func (s *BoltStore) CreateGame(gridID string) (*GameSession, error) {
+	grid := s.GetGrid(gridID)
+	if grid == nil {
+		return nil, fmt.Errorf("grid not found: %s", gridID)
+	}
+
+	game := newGameSession(grid)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeGame(game); err != nil {
+		return nil, err
+	}
+	s.games[game.ID] = game
+	return game, nil
+}
+
+// GetGame returns a game session by ID, or nil if not found.
+// Sessions are loaded from disk on first access and then shared.
+func (s *BoltStore) GetGame(id string) *GameSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if game, ok := s.games[id]; ok {
+		return game
+	}
+
+	var game GameSession
+	found, err := s.getJSON(bucketGames, id, &game)
+	if err != nil {
+		log.Printf("Load game %s: %v", id, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	if game.Players == nil {
+		game.Players = make(map[string]*Player)
+	}
+	s.games[id] = &game
+	return &game
+}
+
+// SaveGame writes the current state of a game session to disk.
+func (s *BoltStore) SaveGame(game *GameSession) error {
+	// Holding s.mu across snapshot and write keeps the last write the most recent.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeGame(game)
+}
+
+// ListGames returns all game sessions.
+func (s *BoltStore) ListGames() []*GameSession {
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketGames).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("List games: %v", err)
+	}
+
+	list := make([]*GameSession, 0, len(ids))
+	for _, id := range ids {
+		if game := s.GetGame(id); game != nil {
+			list = append(list, game)
+		}
+	}
+	return list
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// writeGame stores a session snapshot. Caller must hold s.mu.
+func (s *BoltStore) writeGame(game *GameSession) error {
+	data, err := game.MarshalSnapshot()
+	if err != nil {
+		return fmt.Errorf("encode game: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketGames).Put([]byte(game.ID), data)
+	})
+}
+
+func (s *BoltStore) putJSON(bucket []byte, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", bucket, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// getJSON decodes the value at key into v. It reports whether the key exists.
+func (s *BoltStore) getJSON(bucket []byte, key string, v any) (bool, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket).Get([]byte(key)); b != nil {
+			// Values are only valid during the transaction.
+			data = append([]byte(nil), b...)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return true, fmt.Errorf("decode %s/%s: %w", bucket, key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStorePersistsAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crossword.db")
+
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	g := newTestGrid(2, 2)
+	g.Cells[0][0].Black = true
+	g.Cells[0][0].Definitions = []Definition{{Text: "Test", Direction: "down"}}
+	g.SetSolution([]string{"#A", "BC"})
+	mustSaveGrid(t, s, g)
+
+	game, err := s.CreateGame(g.ID)
+	if err != nil {
+		t.Fatalf("create game: %v", err)
+	}
+	game.AddPlayer("Alice")
+	game.Play("Alice", 1, 0, "B")
+	if err := s.SaveGame(game); err != nil {
+		t.Fatalf("save game: %v", err)
+	}
+	s.Close()
+
+	s, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	grid := s.GetGrid(g.ID)
+	if grid == nil {
+		t.Fatal("grid lost after restart")
+	}
+	if grid.Cells[0][0].Definitions[0].Text != "Test" || grid.Cells[1][1].Solution != "C" {
+		t.Fatalf("grid content lost after restart: %+v", grid.Cells)
+	}
+
+	loaded := s.GetGame(game.ID)
+	if loaded == nil {
+		t.Fatal("game lost after restart")
+	}
+	if loaded.GetState()[1][0] != "B" {
+		t.Fatalf("cell state lost after restart: %v", loaded.GetState())
+	}
+	if p := loaded.Players["Alice"]; p == nil || p.Color != game.Players["Alice"].Color {
+		t.Fatal("players lost after restart")
+	}
+	if loaded.Authors[1][0] != "Alice" {
+		t.Fatal("letter authors lost after restart")
+	}
+
+	// The reloaded session is shared between callers.
+	if s.GetGame(game.ID) != loaded {
+		t.Fatal("expected the same live session on every GetGame")
+	}
+	if len(s.ListGames()) != 1 {
+		t.Fatal("expected 1 game after restart")
+	}
+}
+
+func TestBoltStoreSchemaVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crossword.db")
+
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	s.Close()
+
+	// Reopening an up-to-date database is a no-op.
+	s, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	s.Close()
+
+	// Simulate a database written by a newer server.
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("raw open: %v", err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		v, _ := json.Marshal(len(boltMigrations) + 1)
+		return tx.Bucket(bucketMeta).Put(keySchemaVersion, v)
+	})
+	db.Close()
+
+	if _, err := OpenBoltStore(path); err == nil {
+		t.Fatal("expected an error for a newer schema version")
+	}
+}
+
+func TestBoltStoreMigratesToVersionedGrids(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crossword.db")
+
+	// A database at schema v1, from before grids were versioned.
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("raw open: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucket(bucketMeta)
+		meta.Put(keySchemaVersion, []byte("1"))
+		if err := boltMigrations[0](tx); err != nil {
+			return err
+		}
+		tx.Bucket(bucketGrids).Put([]byte("g1"), []byte(`{"id":"g1","rows":1,"cols":2,"cells":[[{"black":false},{"black":false}]]}`))
+		return tx.Bucket(bucketGames).Put([]byte("p1"), []byte(`{"id":"p1","grid_id":"g1","state":[["",""]]}`))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("seed v1 database: %v", err)
+	}
+
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	if g := s.GetGrid("g1"); g == nil || g.Version != 1 {
+		t.Fatalf("expected existing grid on version 1, got %+v", g)
+	}
+	game := s.GetGame("p1")
+	if game == nil || game.GridVersion != 1 {
+		t.Fatalf("expected existing game on version 1, got %+v", game)
+	}
+	if s.GetGridVersion(game.GridID, game.GridVersion) == nil {
+		t.Fatal("existing game should find its grid")
+	}
+}
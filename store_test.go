@@ -1,10 +1,43 @@
 package main
 
 import (
+	"path/filepath"
 	"sync"
 	"testing"
 )
 
+// storeFactories lists the Store implementations the suite runs against.
+var storeFactories = map[string]func(t *testing.T) Store{
+	"memory": func(t *testing.T) Store {
+		return NewMemoryStore()
+	},
+	"bolt": func(t *testing.T) Store {
+		s, err := OpenBoltStore(filepath.Join(t.TempDir(), "crossword.db"))
+		if err != nil {
+			t.Fatalf("open bolt store: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	},
+}
+
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			fn(t, newStore(t))
+		})
+	}
+}
+
+func mustSaveGrid(t *testing.T, s Store, g *Grid) *Grid {
+	t.Helper()
+	saved, err := s.SaveGrid(g)
+	if err != nil {
+		t.Fatalf("save grid: %v", err)
+	}
+	return saved
+}
+
 func newTestGrid(rows, cols int) *Grid {
 	cells := make([][]Cell, rows)
 	for i := range cells {
@@ -14,128 +47,403 @@ func newTestGrid(rows, cols int) *Grid {
 }
 
 func TestSaveAndGetGrid(t *testing.T) {
-	s := NewStore()
-	g := s.SaveGrid(newTestGrid(10, 10))
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(10, 10))
 
-	if g.ID == "" {
-		t.Fatal("expected grid to have an ID")
-	}
-	if got := s.GetGrid(g.ID); got == nil {
-		t.Fatal("expected to find saved grid")
-	}
-	if got := s.GetGrid("nonexistent"); got != nil {
-		t.Fatal("expected nil for unknown ID")
-	}
+		if g.ID == "" {
+			t.Fatal("expected grid to have an ID")
+		}
+		if got := s.GetGrid(g.ID); got == nil {
+			t.Fatal("expected to find saved grid")
+		}
+		if got := s.GetGrid("nonexistent"); got != nil {
+			t.Fatal("expected nil for unknown ID")
+		}
+	})
 }
 
 func TestListGrids(t *testing.T) {
-	s := NewStore()
-	s.SaveGrid(newTestGrid(5, 5))
-	s.SaveGrid(newTestGrid(8, 8))
+	forEachStore(t, func(t *testing.T, s Store) {
+		mustSaveGrid(t, s, newTestGrid(5, 5))
+		mustSaveGrid(t, s, newTestGrid(8, 8))
 
-	list := s.ListGrids()
-	if len(list) != 2 {
-		t.Fatalf("expected 2 grids, got %d", len(list))
-	}
-	// Most recent first.
-	if list[0].CreatedAt.Before(list[1].CreatedAt) {
-		t.Fatal("expected grids sorted by descending creation time")
-	}
+		list := s.ListGrids()
+		if len(list) != 2 {
+			t.Fatalf("expected 2 grids, got %d", len(list))
+		}
+		// Most recent first.
+		if list[0].CreatedAt.Before(list[1].CreatedAt) {
+			t.Fatal("expected grids sorted by descending creation time")
+		}
+	})
 }
 
 func TestCreateGame(t *testing.T) {
-	s := NewStore()
+	forEachStore(t, func(t *testing.T, s Store) {
 
-	// Error on unknown grid.
-	if _, err := s.CreateGame("unknown"); err == nil {
-		t.Fatal("expected error for unknown grid")
-	}
+		// Error on unknown grid.
+		if _, err := s.CreateGame("unknown"); err == nil {
+			t.Fatal("expected error for unknown grid")
+		}
 
-	g := s.SaveGrid(newTestGrid(3, 4))
-	game, err := s.CreateGame(g.ID)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if game.GridID != g.ID {
-		t.Fatal("game should reference the grid")
-	}
-	if len(game.State) != 3 || len(game.State[0]) != 4 {
-		t.Fatalf("expected 3x4 state, got %dx%d", len(game.State), len(game.State[0]))
-	}
+		g := mustSaveGrid(t, s, newTestGrid(3, 4))
+		game, err := s.CreateGame(g.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if game.GridID != g.ID {
+			t.Fatal("game should reference the grid")
+		}
+		if len(game.State) != 3 || len(game.State[0]) != 4 {
+			t.Fatalf("expected 3x4 state, got %dx%d", len(game.State), len(game.State[0]))
+		}
+	})
 }
 
 func TestGameAddPlayer(t *testing.T) {
-	s := NewStore()
-	g := s.SaveGrid(newTestGrid(5, 5))
-	game, _ := s.CreateGame(g.ID)
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(5, 5))
+		game, _ := s.CreateGame(g.ID)
 
-	p1 := game.AddPlayer("Alice")
-	p2 := game.AddPlayer("Bob")
+		p1 := game.AddPlayer("Alice")
+		p2 := game.AddPlayer("Bob")
 
-	if p1.Pseudo != "Alice" || p2.Pseudo != "Bob" {
-		t.Fatal("unexpected pseudo")
-	}
-	if p1.Color == p2.Color {
-		t.Fatal("players should have different colors")
-	}
+		if p1.Pseudo != "Alice" || p2.Pseudo != "Bob" {
+			t.Fatal("unexpected pseudo")
+		}
+		if p1.Color == p2.Color {
+			t.Fatal("players should have different colors")
+		}
 
-	// Adding same pseudo returns existing player.
-	p1bis := game.AddPlayer("Alice")
-	if p1bis.Color != p1.Color {
-		t.Fatal("same pseudo should return same player")
-	}
+		// Adding same pseudo returns existing player.
+		p1bis := game.AddPlayer("Alice")
+		if p1bis.Color != p1.Color {
+			t.Fatal("same pseudo should return same player")
+		}
+	})
 }
 
 func TestGameSetCell(t *testing.T) {
-	s := NewStore()
-	g := s.SaveGrid(newTestGrid(3, 3))
-	game, _ := s.CreateGame(g.ID)
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(3, 3))
+		game, _ := s.CreateGame(g.ID)
 
-	if !game.SetCell(0, 0, "A") {
-		t.Fatal("expected SetCell to succeed")
-	}
-	if game.SetCell(-1, 0, "X") {
-		t.Fatal("expected SetCell to fail for negative row")
-	}
-	if game.SetCell(0, 3, "X") {
-		t.Fatal("expected SetCell to fail for out-of-bounds col")
-	}
+		if !game.SetCell(0, 0, "A") {
+			t.Fatal("expected SetCell to succeed")
+		}
+		if game.SetCell(-1, 0, "X") {
+			t.Fatal("expected SetCell to fail for negative row")
+		}
+		if game.SetCell(0, 3, "X") {
+			t.Fatal("expected SetCell to fail for out-of-bounds col")
+		}
+
+		state := game.GetState()
+		if state[0][0] != "A" {
+			t.Fatalf("expected 'A', got %q", state[0][0])
+		}
+	})
+}
+
+func TestGameCheck(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := newTestGrid(2, 2)
+		g.Cells[0][0].Black = true
+		g.SetSolution([]string{"#A", "BC"})
+		mustSaveGrid(t, s, g)
+		game, _ := s.CreateGame(g.ID)
+
+		game.SetCell(0, 1, "A")
+		game.SetCell(1, 0, "X")
+
+		wrong, filled := game.Check(g)
+		if filled != 2 {
+			t.Fatalf("expected 2 filled cells, got %d", filled)
+		}
+		if len(wrong) != 1 || wrong[0] != (Position{Row: 1, Col: 0}) {
+			t.Fatalf("expected (1,0) to be wrong, got %v", wrong)
+		}
+	})
+}
+
+func TestGameCompletion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := newTestGrid(2, 2)
+		g.Cells[0][0].Black = true
+		mustSaveGrid(t, s, g)
+		game, _ := s.CreateGame(g.ID)
+
+		game.Play("Alice", 0, 1, "A")
+		game.Play("Bob", 1, 0, "X")
+		game.Play("Bob", 1, 0, "B")
+		if game.CheckCompletion(g) != nil {
+			t.Fatal("game should not complete with an empty cell")
+		}
+
+		game.Play("Alice", 1, 1, "C")
+		c := game.CheckCompletion(g)
+		if c == nil {
+			t.Fatal("expected the game to complete")
+		}
+		if len(c.Stats) != 2 || c.Stats[0] != (PlayerStats{Pseudo: "Alice", Letters: 2, Moves: 2}) ||
+			c.Stats[1] != (PlayerStats{Pseudo: "Bob", Letters: 1, Moves: 2}) {
+			t.Fatalf("unexpected stats: %+v", c.Stats)
+		}
 
-	state := game.GetState()
-	if state[0][0] != "A" {
-		t.Fatalf("expected 'A', got %q", state[0][0])
+		// Completion is reported once and freezes the board.
+		if game.CheckCompletion(g) != nil {
+			t.Fatal("completion should only be reported once")
+		}
+		if err := game.Play("Bob", 1, 1, "Z"); err != errGameCompleted {
+			t.Fatalf("expected errGameCompleted, got %v", err)
+		}
+		if game.GetState()[1][1] != "C" {
+			t.Fatal("completed board should be frozen")
+		}
+	})
+}
+
+func TestPlaySameLetter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(2, 2))
+		game, _ := s.CreateGame(g.ID)
+
+		game.Play("Alice", 0, 0, "A")
+		if err := game.Play("Bob", 0, 0, "A"); err != nil {
+			t.Fatal(err)
+		}
+		if len(game.History) != 1 || game.MoveCounts["Bob"] != 0 || game.MoveCounts["Alice"] != 1 {
+			t.Fatalf("retyping a letter should not count as a move: history %+v, counts %v", game.History, game.MoveCounts)
+		}
+		if _, err := game.Undo("Bob"); err != errNothingToUndo {
+			t.Fatalf("expected errNothingToUndo, got %v", err)
+		}
+	})
+}
+
+func TestGameCompletionRequiresCorrectLetters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := newTestGrid(1, 2)
+		g.SetSolution([]string{"OK"})
+		mustSaveGrid(t, s, g)
+		game, _ := s.CreateGame(g.ID)
+
+		game.Play("Alice", 0, 0, "O")
+		game.Play("Alice", 0, 1, "X")
+		if game.CheckCompletion(g) != nil {
+			t.Fatal("a wrong letter should prevent completion")
+		}
+
+		game.Play("Alice", 0, 1, "K")
+		if game.CheckCompletion(g) == nil {
+			t.Fatal("expected completion once all letters are correct")
+		}
+	})
+}
+
+func TestGameUndoRedo(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(2, 2))
+		game, _ := s.CreateGame(g.ID)
+
+		game.Play("Alice", 0, 0, "A")
+		game.Play("Alice", 0, 1, "B")
+		game.Play("Bob", 1, 1, "C")
+
+		m, err := game.Undo("Alice")
+		if err != nil {
+			t.Fatalf("undo: %v", err)
+		}
+		if m.Row != 0 || m.Col != 1 || m.Old != "B" || m.New != "" || m.Kind != moveUndo || m.Ref != 2 {
+			t.Fatalf("unexpected undo move: %+v", m)
+		}
+		if game.GetState()[0][1] != "" {
+			t.Fatal("undo should restore the previous value")
+		}
+
+		if _, err := game.Redo("Alice"); err != nil {
+			t.Fatalf("redo: %v", err)
+		}
+		if game.GetState()[0][1] != "B" {
+			t.Fatal("redo should re-apply the move")
+		}
+		if _, err := game.Redo("Alice"); err != errNothingToRedo {
+			t.Fatalf("expected errNothingToRedo, got %v", err)
+		}
+
+		// Undo only touches the player's own moves, newest first.
+		game.Undo("Alice")
+		game.Undo("Alice")
+		if state := game.GetState(); state[0][0] != "" || state[1][1] != "C" {
+			t.Fatalf("unexpected state after two undos: %v", state)
+		}
+		if _, err := game.Undo("Alice"); err != errNothingToUndo {
+			t.Fatalf("expected errNothingToUndo, got %v", err)
+		}
+
+		// A new move clears what could be redone.
+		game.Play("Alice", 1, 0, "D")
+		if _, err := game.Redo("Alice"); err != errNothingToRedo {
+			t.Fatalf("expected errNothingToRedo after a new move, got %v", err)
+		}
+
+		// Undo refuses to clobber another player's later change.
+		game.Play("Bob", 1, 0, "E")
+		if _, err := game.Undo("Alice"); err != errCellChanged {
+			t.Fatalf("expected errCellChanged, got %v", err)
+		}
+
+		history := game.GetHistory(0)
+		if len(history) != 9 {
+			t.Fatalf("expected 9 history entries, got %d", len(history))
+		}
+		for i, m := range history {
+			if m.Seq != i+1 {
+				t.Fatalf("history entry %d has seq %d", i, m.Seq)
+			}
+		}
+		if got := game.GetHistory(7); len(got) != 2 || got[0].Seq != 8 {
+			t.Fatalf("GetHistory(7) = %+v", got)
+		}
+	})
+}
+
+func TestUndoRestoresAuthor(t *testing.T) {
+	g := newTestGrid(1, 1)
+	game := newGameSession(g)
+
+	game.Play("Alice", 0, 0, "A")
+	game.Play("Bob", 0, 0, "B")
+	game.Undo("Bob")
+
+	if game.Authors[0][0] != "Alice" {
+		t.Fatalf("expected Alice to own the restored letter, got %q", game.Authors[0][0])
 	}
 }
 
 func TestGetStateCopy(t *testing.T) {
-	s := NewStore()
-	g := s.SaveGrid(newTestGrid(2, 2))
-	game, _ := s.CreateGame(g.ID)
-	game.SetCell(0, 0, "X")
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(2, 2))
+		game, _ := s.CreateGame(g.ID)
+		game.SetCell(0, 0, "X")
 
-	state := game.GetState()
-	state[0][0] = "Z" // mutate the copy
+		state := game.GetState()
+		state[0][0] = "Z" // mutate the copy
 
-	original := game.GetState()
-	if original[0][0] != "X" {
-		t.Fatal("GetState should return a copy, not a reference")
-	}
+		original := game.GetState()
+		if original[0][0] != "X" {
+			t.Fatal("GetState should return a copy, not a reference")
+		}
+	})
 }
 
 func TestConcurrentAccess(t *testing.T) {
-	s := NewStore()
-	g := s.SaveGrid(newTestGrid(10, 10))
-	game, _ := s.CreateGame(g.ID)
-
-	var wg sync.WaitGroup
-	for i := range 100 {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			game.SetCell(i%10, i%10, "A")
-			game.GetState()
-			game.AddPlayer("player" + string(rune('A'+i%26)))
-		}(i)
-	}
-	wg.Wait()
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(10, 10))
+		game, _ := s.CreateGame(g.ID)
+
+		var wg sync.WaitGroup
+		for i := range 100 {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				game.SetCell(i%10, i%10, "A")
+				game.GetState()
+				game.AddPlayer("player" + string(rune('A'+i%26)))
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+func TestReviseGrid(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := mustSaveGrid(t, s, newTestGrid(2, 2))
+		if g.Version != 1 {
+			t.Fatalf("expected version 1, got %d", g.Version)
+		}
+		game, _ := s.CreateGame(g.ID)
+
+		revised := s.GetGrid(g.ID).Clone()
+		revised.Cells[0][0].Black = true
+		if err := s.ReviseGrid(revised); err != nil {
+			t.Fatalf("revise: %v", err)
+		}
+		if revised.Version != 2 || s.GetGrid(g.ID).Version != 2 {
+			t.Fatal("expected the latest version to be 2")
+		}
+
+		// Games keep the version they were created on.
+		if game.GridVersion != 1 {
+			t.Fatalf("expected game on version 1, got %d", game.GridVersion)
+		}
+		if v1 := s.GetGridVersion(g.ID, 1); v1 == nil || v1.Cells[0][0].Black {
+			t.Fatal("version 1 should be unchanged")
+		}
+		if v2 := s.GetGridVersion(g.ID, 2); v2 == nil || !v2.Cells[0][0].Black {
+			t.Fatal("version 2 should hold the revision")
+		}
+		if s.GetGridVersion(g.ID, 3) != nil {
+			t.Fatal("expected nil for an unknown version")
+		}
+		if newGame, _ := s.CreateGame(g.ID); newGame.GridVersion != 2 {
+			t.Fatal("new games should use the latest version")
+		}
+
+		// A revision based on an outdated version is rejected.
+		stale := s.GetGridVersion(g.ID, 1).Clone()
+		if err := s.ReviseGrid(stale); err != errVersionConflict {
+			t.Fatalf("expected a version conflict, got %v", err)
+		}
+		if err := s.UpdateGrid(stale); err != errVersionConflict {
+			t.Fatalf("update: expected a version conflict, got %v", err)
+		}
+		if err := s.UpdateGrid(s.GetGrid(g.ID).Clone()); err != nil || s.GetGrid(g.ID).Version != 2 {
+			t.Fatalf("update of the latest version: %v", err)
+		}
+		if err := s.ReviseGrid(&Grid{ID: "nonexistent", Version: 1}); err == nil {
+			t.Fatal("expected an error for an unknown grid")
+		}
+	})
+}
+
+func TestSaveImage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		img := NewSourceImage([]byte("photo"), "image/jpeg")
+		img.Preview = []byte("small")
+		if err := s.SaveImage(img); err != nil {
+			t.Fatalf("save image: %v", err)
+		}
+
+		// Updating the metadata keeps the data.
+		meta := &SourceImage{Hash: img.Hash, MIMEType: "image/jpeg", Grids: map[string]string{KindArrow: "g1"}}
+		if err := s.SaveImage(meta); err != nil {
+			t.Fatalf("update image: %v", err)
+		}
+		got := s.GetImage(img.Hash)
+		if got == nil || string(got.Data) != "photo" || string(got.Preview) != "small" || got.Grids[KindArrow] != "g1" {
+			t.Fatalf("unexpected stored image: %+v", got)
+		}
+		if s.GetImage("unknown") != nil {
+			t.Fatal("expected nil for an unknown hash")
+		}
+
+		list := s.ListImages()
+		if len(list) != 1 || list[0].Hash != img.Hash || list[0].Data != nil || list[0].Preview != nil {
+			t.Fatalf("expected one image without data, got %+v", list)
+		}
+
+		if err := s.SaveImageVariant(img.Hash, "processed:deskew", []byte("straight")); err != nil {
+			t.Fatalf("save variant: %v", err)
+		}
+		if got := s.GetImageVariant(img.Hash, "processed:deskew"); string(got) != "straight" {
+			t.Fatalf("unexpected variant %q", got)
+		}
+		if s.GetImageVariant(img.Hash, "processed") != nil {
+			t.Fatal("expected nil for an unknown variant")
+		}
+		if err := s.SaveImageVariant("unknown", "processed", []byte("x")); err == nil {
+			t.Fatal("expected an error for a variant of an unknown image")
+		}
+	})
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	_ "golang.org/x/image/webp" // register the WebP decoder for image.Decode
+)
+
+// Upload formats, as sniffed from the content of the file.
+const (
+	formatJPEG = "image/jpeg"
+	formatPNG  = "image/png"
+	formatWebP = "image/webp"
+	formatHEIC = "image/heic"
+	formatPDF  = "application/pdf"
+)
+
+const (
+	convertedQuality  = 92               // JPEG quality of converted uploads
+	conversionTimeout = 30 * time.Second // per external conversion
+	pdfResolution     = 200              // dots per inch of rendered PDF pages
+)
+
+// heifBrands are the ftyp brands of HEIF files holding HEVC images, as
+// produced by phone cameras.
+var heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+// sniffFormat tells the format of an uploaded file from its first bytes,
+// or returns "" if it is not one of the upload formats.
+func sniffFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return formatJPEG
+	case bytes.HasPrefix(data, pngSignature):
+		return formatPNG
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return formatWebP
+	case bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")):
+		// The header may follow some garbage, which readers skip.
+		return formatPDF
+	case isHEIF(data):
+		return formatHEIC
+	}
+	return ""
+}
+
+// isHEIF tells whether data starts with the ftyp box of a HEIF image,
+// looking at its major and compatible brands.
+func isHEIF(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 16 || size > len(data) {
+		size = min(len(data), 64)
+	}
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue // minor version
+		}
+		for _, brand := range heifBrands {
+			if string(data[i:i+4]) == brand {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errConverterMissing is returned when the program converting a format is
+// not installed on the server.
+var errConverterMissing = errors.New("converter not installed")
+
+// externalConverter converts a file into a PNG image with a command-line
+// program, found on the PATH unless program is a path.
+type externalConverter struct {
+	program string
+	// args returns the arguments converting the file in into the image
+	// out (without its ".png" extension), for the given page (from 1).
+	args func(in, out string, page int) []string
+}
+
+var (
+	// pdfRenderer renders a page of a PDF file with pdftoppm (Poppler).
+	pdfRenderer = externalConverter{
+		program: "pdftoppm",
+		args: func(in, out string, page int) []string {
+			p := strconv.Itoa(page)
+			return []string{"-f", p, "-l", p, "-r", strconv.Itoa(pdfResolution), "-png", "-singlefile", in, out}
+		},
+	}
+	// heifConverter decodes HEIC photos with heif-convert (libheif), which
+	// applies their rotation.
+	heifConverter = externalConverter{
+		program: "heif-convert",
+		args: func(in, out string, _ int) []string {
+			return []string{in, out + ".png"}
+		},
+	}
+)
+
+// convert runs the program on data and returns the PNG image it wrote.
+func (c externalConverter) convert(ctx context.Context, data []byte, page int) ([]byte, error) {
+	program, err := exec.LookPath(c.program)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.program, errConverterMissing)
+	}
+	dir, err := os.MkdirTemp("", "crossword-upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "upload"), filepath.Join(dir, "page")
+	if err := os.WriteFile(in, data, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, conversionTimeout)
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, program, c.args(in, out, page)...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", c.program, err, bytes.TrimSpace(output))
+	}
+	return os.ReadFile(out + ".png")
+}
+
+// convertUpload turns an uploaded file of the given format into a JPEG or
+// PNG image, which every analyzer reads: WebP images are decoded here,
+// HEIC photos and PDF pages (page counting from 1) by external programs.
+// JPEG and PNG files are returned as is. Images larger than
+// maxImagePixels are rejected with errImageTooLarge before being decoded.
+func convertUpload(ctx context.Context, data []byte, format string, page int) ([]byte, string, error) {
+	var err error
+	switch format {
+	case formatJPEG, formatPNG:
+		if err := checkImageSize(data); err != nil {
+			return nil, "", err
+		}
+		return data, format, nil
+	case formatWebP:
+	case formatHEIC:
+		data, err = heifConverter.convert(ctx, data, 1)
+	case formatPDF:
+		data, err = pdfRenderer.convert(ctx, data, page)
+	default:
+		return nil, "", fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode %s: %w", format, err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: convertedQuality}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), formatJPEG, nil
+}
+
+// formatName is the usual name of an upload format, for messages.
+func formatName(format string) string {
+	switch format {
+	case formatJPEG:
+		return "JPEG"
+	case formatPNG:
+		return "PNG"
+	case formatWebP:
+		return "WebP"
+	case formatHEIC:
+		return "HEIC"
+	case formatPDF:
+		return "PDF"
+	}
+	return format
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF", formatJPEG},
+		{"png", string(pngSignature) + "\x00\x00\x00\x0dIHDR", formatPNG},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", formatWebP},
+		{"pdf", "%PDF-1.7\n%\xE2\xE3\xCF\xD3", formatPDF},
+		{"pdf after garbage", "\r\n\r\n%PDF-1.4", formatPDF},
+		{"heic", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", formatHEIC},
+		{"heif brand listed as compatible", "\x00\x00\x00\x1cftypmp42\x00\x00\x00\x00isommif1heic", formatHEIC},
+		{"mp4", "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00isomavc1", ""},
+		{"gif", "GIF89a", ""},
+		{"text", "not an image", ""},
+		{"empty", "", ""},
+	} {
+		if got := sniffFormat([]byte(tc.data)); got != tc.want {
+			t.Errorf("%s: sniffFormat = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// fakeConverter replaces a converter by a script writing page as its
+// output, and recording its arguments in the returned file.
+func fakeConverter(t *testing.T, c *externalConverter, page []byte) (argsFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile = filepath.Join(dir, "args")
+	pageFile := filepath.Join(dir, "page.png")
+	if err := os.WriteFile(pageFile, page, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "convert")
+	body := "#!/bin/sh\necho \"$@\" > " + argsFile + "\nfor out; do :; done\ncp " + pageFile + " \"${out%.png}.png\"\n"
+	if err := os.WriteFile(script, []byte(body), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	saved := *c
+	c.program = script
+	t.Cleanup(func() { *c = saved })
+	return argsFile
+}
+
+func TestUploadConvertsFormats(t *testing.T) {
+	analyzer := &recordingAnalyzer{}
+	srv := newAnalyzerServer(t, analyzer)
+	srv.uploadRL = newRateLimiter(20, time.Minute)
+	request := func(contentType string, data []byte, query string) *http.Request {
+		req := newUploadRequest(t, contentType, data)
+		req.URL.RawQuery = "preprocess=none&" + query
+		return req
+	}
+	upload := func(contentType string, data []byte, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, request(contentType, data, query))
+		return w
+	}
+	// lastImage checks that the analyzer got a w×h JPEG image.
+	lastImage := func(w, h int) {
+		t.Helper()
+		last := len(analyzer.images) - 1
+		if analyzer.mimes[last] != formatJPEG {
+			t.Fatalf("analyzer got %s, want a JPEG image", analyzer.mimes[last])
+		}
+		img, err := jpeg.Decode(bytes.NewReader(analyzer.images[last]))
+		if err != nil {
+			t.Fatalf("converted image does not decode: %v", err)
+		}
+		if b := img.Bounds(); b.Dx() != w || b.Dy() != h {
+			t.Fatalf("converted image is %dx%d, want %dx%d", b.Dx(), b.Dy(), w, h)
+		}
+	}
+
+	// The declared type does not matter: the content does.
+	webp, err := os.ReadFile("test_data/gopher.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzeUpload(t, srv, request("application/octet-stream", webp, ""))
+	lastImage(75, 100)
+	if w := upload("image/png", []byte("GIF89a"), ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("gif declared as png: expected 400, got %d", w.Code)
+	}
+
+	// PDF pages are rendered by pdftoppm.
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<< >>\nendobj\n%%EOF\n")
+	args := fakeConverter(t, &pdfRenderer, encodePNG(t, testPhoto(120, 90, 0)))
+	job := analyzeUpload(t, srv, request("application/pdf", pdf, "page=2"))
+	lastImage(120, 90)
+	if got, _ := os.ReadFile(args); !strings.HasPrefix(string(got), "-f 2 -l 2 ") {
+		t.Fatalf("pdftoppm should render page 2, got arguments %q", got)
+	}
+	stored := srv.store.GetImage(srv.store.GetGrid(job.GridID).ImageHash)
+	if stored.MIMEType != formatJPEG || stored.Width != 120 {
+		t.Fatalf("the rendered page should be stored, got %s %dx%d", stored.MIMEType, stored.Width, stored.Height)
+	}
+	if w := upload("application/pdf", pdf, "page=0"); w.Code != http.StatusBadRequest {
+		t.Fatalf("page 0: expected 400, got %d", w.Code)
+	}
+
+	// A page the renderer cannot produce is reported.
+	fakeConverter(t, &pdfRenderer, []byte("not a png"))
+	if w := upload("application/pdf", pdf, "page=9"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unreadable page: expected 400, got %d", w.Code)
+	}
+
+	// Without heif-convert, HEIC photos are refused.
+	heifConverter.program = "heif-convert-missing"
+	t.Cleanup(func() { heifConverter.program = "heif-convert" })
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	w := upload("image/heic", heic, "")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("heic without converter: expected 415, got %d", w.Code)
+	}
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if !strings.Contains(resp["error"], "HEIC") {
+		t.Fatalf("unexpected error %q", resp["error"])
+	}
+}
+
+func TestConvertUploadKeepsJPEGAndPNG(t *testing.T) {
+	photo := encodePNG(t, image.NewGray(image.Rect(0, 0, 4, 4)))
+	data, mimeType, err := convertUpload(t.Context(), photo, formatPNG, 1)
+	if err != nil || mimeType != formatPNG || !bytes.Equal(data, photo) {
+		t.Fatalf("PNG files should be kept as is, got %s, %v", mimeType, err)
+	}
+}
+
+// hugePNG returns a tiny PNG file declaring a width×height image.
+func hugePNG(t *testing.T, width, height uint32) []byte {
+	data := encodePNG(t, image.NewGray(image.Rect(0, 0, 1, 1)))
+	ihdr := data[8+8 : 8+8+13] // after the signature and the chunk length and type
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestUploadRejectsHugeImages(t *testing.T) {
+	bomb := hugePNG(t, 100_000, 100_000)
+	if _, err := decodeImage(bomb); !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("expected errImageTooLarge, got %v", err)
+	}
+	if _, img := cleanUpload(bomb); img != nil {
+		t.Fatal("a huge image should not be decoded")
+	}
+	if err := checkImageSize(hugePNG(t, 5000, 5000)); err != nil {
+		t.Fatalf("a 25 megapixel photo should pass: %v", err)
+	}
+
+	srv := newFixtureServer(t)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newUploadRequest(t, "image/png", bomb))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Problem codes reported by Grid.Validate.
+const (
+	problemRowCount           = "row_count"           // Rows does not match the cells
+	problemColCount           = "col_count"           // Cols does not match the cells
+	problemRaggedRow          = "ragged_row"          // row padded or truncated to Cols
+	problemLetterDefinition   = "letter_definition"   // letter cell holding definitions
+	problemInvalidDirection   = "invalid_direction"   // definition with an unknown direction
+	problemEmptyDefinition    = "empty_definition"    // definition without text
+	problemArrowOffGrid       = "arrow_off_grid"      // definition pointing to no letter cell
+	problemDuplicateDirection = "duplicate_direction" // two definitions with the same arrow
+	problemSolutionDropped    = "solution_dropped"    // solution removed after an edit
+	problemInvalidKind        = "invalid_kind"        // unknown grid kind, read as arrow words
+	problemClassicDefinition  = "classic_definition"  // definition inside a classic grid cell
+	problemClueOffGrid        = "clue_off_grid"       // numbered clue for no row or column
+	problemClueCount          = "clue_count"          // clues and words of a line do not match
+)
+
+var errEmptyGrid = errors.New("grid has no cells")
+
+// Problem is an inconsistency found in a grid, usually one extracted from a
+// photo. Repaired is set when Validate fixed it; the others are left for
+// the user to check.
+type Problem struct {
+	Code     string    `json:"code"`
+	Cell     *Position `json:"cell,omitempty"`
+	Message  string    `json:"message"`
+	Repaired bool      `json:"repaired"`
+}
+
+// Validate checks the grid structure and repairs what can be safely
+// repaired: Rows and Cols are made to match the cells, ragged rows are
+// padded with letter cells or truncated, and definitions that cannot be
+// placed are dropped. It returns an error only if there is no grid at all.
+func (g *Grid) Validate() ([]Problem, error) {
+	var problems []Problem
+	report := func(code string, cell *Position, repaired bool, format string, args ...any) {
+		problems = append(problems, Problem{code, cell, fmt.Sprintf(format, args...), repaired})
+	}
+
+	switch g.Kind = strings.ToLower(strings.TrimSpace(g.Kind)); g.Kind {
+	case "", KindArrow, KindClassic:
+	default:
+		report(problemInvalidKind, nil, true, "Type de grille %q inconnu, lu comme des mots fléchés", g.Kind)
+		g.Kind = ""
+	}
+
+	if len(g.Cells) == 0 {
+		return nil, errEmptyGrid
+	}
+	if g.Rows != len(g.Cells) {
+		report(problemRowCount, nil, true, "La grille annonçait %d lignes, elle en a %d", g.Rows, len(g.Cells))
+		g.Rows = len(g.Cells)
+	}
+
+	// The most common row length is more reliable than the announced one.
+	if cols := commonRowLength(g.Cells, g.Cols); cols != g.Cols {
+		report(problemColCount, nil, true, "La grille annonçait %d colonnes, elle en a %d", g.Cols, cols)
+		g.Cols = cols
+	}
+	if g.Cols == 0 {
+		return nil, errEmptyGrid
+	}
+	for i, row := range g.Cells {
+		switch {
+		case len(row) < g.Cols:
+			report(problemRaggedRow, nil, true, "Ligne %d : %d case(s) manquante(s) ajoutée(s)", i+1, g.Cols-len(row))
+			g.Cells[i] = append(row, make([]Cell, g.Cols-len(row))...)
+		case len(row) > g.Cols:
+			report(problemRaggedRow, nil, true, "Ligne %d : %d case(s) en trop supprimée(s)", i+1, len(row)-g.Cols)
+			g.Cells[i] = row[:g.Cols]
+		}
+	}
+
+	if g.Classic() {
+		g.validateClassic(report)
+		return problems, nil
+	}
+	// Numbered clues only make sense beside a classic grid.
+	g.Clues = nil
+
+	for i, row := range g.Cells {
+		for j := range row {
+			cell := &g.Cells[i][j]
+			cell.Confidence = clampConfidence(cell.Confidence)
+			pos := &Position{Row: i, Col: j}
+			if !cell.Black {
+				if len(cell.Definitions) == 0 {
+					continue
+				}
+				report(problemLetterDefinition, pos, true, "Case (%d, %d) : case lettre avec définition, transformée en case de définition", i+1, j+1)
+				cell.Black = true
+				cell.Solution = ""
+			}
+
+			var kept []Definition
+			seen := make(map[string]string) // text by start side and direction
+			for _, def := range cell.Definitions {
+				def.Text = strings.TrimSpace(def.Text)
+				def.Direction = strings.ToLower(strings.TrimSpace(def.Direction))
+				def.Start = strings.ToLower(strings.TrimSpace(def.Start))
+				def.Confidence = clampConfidence(def.Confidence)
+				if def.Start == def.Direction {
+					def.Start = ""
+				}
+				switch {
+				case !validDirection(def.Direction):
+					report(problemInvalidDirection, pos, true, "Case (%d, %d) : direction %q inconnue, définition « %s » supprimée", i+1, j+1, def.Direction, def.Text)
+					continue
+				case def.Start != "" && !validDirection(def.Start):
+					report(problemInvalidDirection, pos, true, "Case (%d, %d) : départ %q inconnu, définition « %s » supprimée", i+1, j+1, def.Start, def.Text)
+					continue
+				case def.Text == "":
+					report(problemEmptyDefinition, pos, true, "Case (%d, %d) : définition vide supprimée", i+1, j+1)
+					continue
+				case len(g.wordCells(i, j, def)) == 0:
+					report(problemArrowOffGrid, pos, true, "Case (%d, %d) : la définition « %s » ne mène à aucune case lettre, supprimée", i+1, j+1, def.Text)
+					continue
+				}
+				key := def.StartSide() + "/" + def.Direction
+				if text, dup := seen[key]; dup {
+					if text == def.Text {
+						report(problemDuplicateDirection, pos, true, "Case (%d, %d) : définition « %s » en double supprimée", i+1, j+1, def.Text)
+						continue
+					}
+					report(problemDuplicateDirection, pos, false, "Case (%d, %d) : deux définitions avec la même flèche (« %s » et « %s »)", i+1, j+1, text, def.Text)
+				}
+				seen[key] = def.Text
+				kept = append(kept, def)
+			}
+			cell.Definitions = kept
+		}
+	}
+	return problems, nil
+}
+
+// validateClassic checks a classic grid: cells hold no definitions, and
+// each row and column has as many clues as words.
+func (g *Grid) validateClassic(report func(code string, cell *Position, repaired bool, format string, args ...any)) {
+	for i, row := range g.Cells {
+		for j := range row {
+			cell := &g.Cells[i][j]
+			cell.Confidence = clampConfidence(cell.Confidence)
+			if len(cell.Definitions) > 0 {
+				report(problemClassicDefinition, &Position{Row: i, Col: j}, true, "Case (%d, %d) : définition dans une grille de mots croisés, supprimée", i+1, j+1)
+				cell.Definitions = nil
+			}
+		}
+	}
+	if g.Clues == nil {
+		g.Clues = &NumberedClues{}
+	}
+
+	counts := map[string]map[int]int{"right": {}, "down": {}}
+	for _, w := range g.Words() {
+		if w.Direction == "right" {
+			counts["right"][w.Start.Row+1]++
+		} else {
+			counts["down"][w.Start.Col+1]++
+		}
+	}
+	check := func(clues []NumberedClue, dir, line string, max int) []NumberedClue {
+		var kept []NumberedClue
+		index := make(map[int]int) // in kept, by number
+		for _, c := range clues {
+			if c.Number < 1 || c.Number > max {
+				report(problemClueOffGrid, nil, true, "Pas de %s %d dans la grille, définitions supprimées", line, c.Number)
+				continue
+			}
+			k, ok := index[c.Number]
+			if !ok {
+				k = len(kept)
+				index[c.Number] = k
+				kept = append(kept, NumberedClue{Number: c.Number})
+			}
+			kept[k].Confidence = lowestConfidence(kept[k].Confidence, clampConfidence(c.Confidence))
+			for _, t := range c.Texts {
+				if t = strings.TrimSpace(t); t != "" {
+					kept[k].Texts = append(kept[k].Texts, t)
+				}
+			}
+		}
+		for number := 1; number <= max; number++ {
+			texts := 0
+			if k, ok := index[number]; ok {
+				texts = len(kept[k].Texts)
+			}
+			if n := counts[dir][number]; n != texts {
+				report(problemClueCount, nil, false, "Définitions de la %s %d : %d pour %d mot(s)", line, number, texts, n)
+			}
+		}
+		slices.SortFunc(kept, func(a, b NumberedClue) int { return cmp.Compare(a.Number, b.Number) })
+		return kept
+	}
+	g.Clues.Horizontal = check(g.Clues.Horizontal, "right", "ligne", g.Rows)
+	g.Clues.Vertical = check(g.Clues.Vertical, "down", "colonne", g.Cols)
+}
+
+func validDirection(d string) bool {
+	return d == "right" || d == "down"
+}
+
+// commonRowLength returns the most frequent length of the rows, preferring
+// fallback in case of a tie.
+func commonRowLength(rows [][]Cell, fallback int) int {
+	counts := make(map[int]int)
+	for _, row := range rows {
+		counts[len(row)]++
+	}
+	best := fallback
+	for n, c := range counts {
+		switch {
+		case c > counts[best]:
+			best = n
+		case c == counts[best] && best != fallback && (n == fallback || n > best):
+			best = n
+		}
+	}
+	return best
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// brokenGrid is a grid as a model might return it: wrong Rows and Cols,
+// ragged rows and definitions that cannot be placed.
+const brokenGrid = `{
+	"rows": 4,
+	"cols": 4,
+	"cells": [
+		[{"black": true}, {"black": true, "definitions": [{"text": "Vers le bas", "direction": "Down"}, {"text": "Nulle part", "direction": "up"}]}, {"black": true, "definitions": [{"text": "Vers le bas", "direction": "down"}, {"text": "Vers le bas", "direction": "down"}]}],
+		[{"black": true, "definitions": [{"text": "Hors grille", "direction": "down"}, {"text": "Un", "direction": "right"}, {"text": "Deux", "direction": "right"}]}, {}, {"definitions": [{"text": " Égaré ", "direction": "down"}]}],
+		[{"black": true, "definitions": [{"text": "", "direction": "right"}]}, {}],
+		[{"black": true}, {}, {}, {}]
+	]
+}`
+
+func problemCodes(problems []Problem) map[string]int {
+	codes := make(map[string]int)
+	for _, p := range problems {
+		codes[p.Code]++
+	}
+	return codes
+}
+
+func TestValidateRepairs(t *testing.T) {
+	var g Grid
+	if err := json.Unmarshal([]byte(brokenGrid), &g); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := g.Validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	if g.Rows != 4 || g.Cols != 3 {
+		t.Fatalf("expected 4x3 grid, got %dx%d", g.Rows, g.Cols)
+	}
+	for i, row := range g.Cells {
+		if len(row) != 3 {
+			t.Fatalf("row %d has %d cells", i, len(row))
+		}
+	}
+
+	want := map[string]int{
+		problemColCount:           1,
+		problemRaggedRow:          2,
+		problemInvalidDirection:   1,
+		problemDuplicateDirection: 2,
+		problemArrowOffGrid:       1, // (1,0) down hits the definition cell below
+		problemLetterDefinition:   1,
+		problemEmptyDefinition:    1,
+	}
+	got := problemCodes(problems)
+	for code, n := range want {
+		if got[code] != n {
+			t.Errorf("%s: got %d problems, want %d (%+v)", code, got[code], n, problems)
+		}
+	}
+
+	if defs := g.Cells[0][1].Definitions; len(defs) != 1 || defs[0].Direction != "down" {
+		t.Errorf("expected direction normalized and unknown one dropped, got %+v", defs)
+	}
+	if defs := g.Cells[0][2].Definitions; len(defs) != 1 {
+		t.Errorf("expected identical duplicate dropped, got %+v", defs)
+	}
+	if defs := g.Cells[1][0].Definitions; len(defs) != 2 {
+		t.Errorf("expected conflicting duplicates kept for review, got %+v", defs)
+	}
+	for _, p := range problems {
+		if p.Code == problemDuplicateDirection && p.Cell != nil && *p.Cell == (Position{Row: 1, Col: 0}) && p.Repaired {
+			t.Error("conflicting duplicates should not be reported as repaired")
+		}
+	}
+	if !g.Cells[1][2].Black {
+		t.Error("letter cell with a definition should become a definition cell")
+	}
+	if g.Cells[2][2].Black {
+		t.Error("padded cells should be letter cells")
+	}
+}
+
+func TestValidateCleanGrid(t *testing.T) {
+	g := loadFixtureGrid(t)
+	problems, err := g.Validate()
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected no problems, got %+v, %v", problems, err)
+	}
+}
+
+// TestValidateEvaluationGrids checks that the grids expected by cmd/evaluate
+// are consistent: every definition placed, every word described.
+func TestValidateEvaluationGrids(t *testing.T) {
+	files, err := filepath.Glob("test_data/evaluation/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no expected grids: %v", err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var g Grid
+		if err := json.Unmarshal(data, &g); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if problems, err := g.Validate(); err != nil || len(problems) != 0 {
+			t.Errorf("%s: expected no problems, got %+v, %v", file, problems, err)
+		}
+		for _, w := range g.Words() {
+			if w.Definition == nil {
+				t.Errorf("%s: word %s at %v has no definition", file, w.Direction, w.Start)
+			}
+		}
+	}
+}
+
+func TestValidateEmptyGrid(t *testing.T) {
+	for _, g := range []*Grid{{Rows: 3, Cols: 3}, {Rows: 1, Cols: 1, Cells: [][]Cell{{}}}} {
+		if _, err := g.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", g)
+		}
+	}
+}
+
+func TestAnalysisJobReturnsWarnings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.json")
+	if err := os.WriteFile(path, []byte(brokenGrid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	analyzer, err := NewFixtureAnalyzer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newAnalyzerServer(t, analyzer)
+
+	job := analyzeUpload(t, srv, newUploadRequest(t, "image/png", fakePNG("png")))
+	if len(job.Warnings) == 0 {
+		t.Fatal("expected warnings in the analysis job")
+	}
+	stored := srv.store.GetGrid(job.GridID)
+	if stored == nil || stored.Cols != 3 || len(stored.Cells[2]) != 3 {
+		t.Fatal("the repaired grid should be stored")
+	}
+}
+
+func TestValidateBentArrows(t *testing.T) {
+	g := newTestGrid(3, 3)
+	g.Cells[0][0] = Cell{Black: true, Definitions: []Definition{
+		{Text: "Droit", Direction: "right", Start: "right"},
+		{Text: "Coudé", Direction: "right", Start: "down"},
+		{Text: "Tordu", Direction: "down", Start: "left"},
+	}}
+	g.Cells[0][2] = Cell{Black: true, Definitions: []Definition{{Text: "Dehors", Direction: "down", Start: "right"}}}
+
+	problems, err := g.Validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	defs := g.Cells[0][0].Definitions
+	if len(defs) != 2 || defs[0].Start != "" || defs[1].Start != "down" {
+		t.Fatalf("expected straight start cleared and bent arrow kept, got %+v", defs)
+	}
+	if len(g.Cells[0][2].Definitions) != 0 {
+		t.Fatal("a bent arrow starting off the grid should be dropped")
+	}
+	// A straight and a bent arrow in the same direction are no duplicate.
+	codes := problemCodes(problems)
+	if codes[problemDuplicateDirection] != 0 || codes[problemInvalidDirection] != 1 || codes[problemArrowOffGrid] != 1 {
+		t.Fatalf("unexpected problems: %+v", problems)
+	}
+}
+
+func TestValidateClassic(t *testing.T) {
+	g := classicTestGrid()
+	if problems, _ := g.Validate(); len(problems) != 0 {
+		t.Fatalf("clean classic grid: unexpected problems %+v", problems)
+	}
+
+	g.Kind = " Classic "
+	g.Cells[0][2].Definitions = []Definition{{Text: "Perdue", Direction: "down"}}
+	g.Clues.Horizontal = append(g.Clues.Horizontal,
+		NumberedClue{Number: 3, Texts: []string{" ", "en trop"}},
+		NumberedClue{Number: 4, Texts: []string{"hors grille"}},
+	)
+	g.Clues.Vertical = g.Clues.Vertical[1:]
+
+	problems, err := g.Validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	want := map[string]int{
+		problemClassicDefinition: 1,
+		problemClueOffGrid:       1,
+		problemClueCount:         2, // row 3 has two clues, column 1 none
+	}
+	if got := problemCodes(problems); len(got) != len(want) {
+		t.Fatalf("problems = %v, want %v", got, want)
+	} else {
+		for code, n := range want {
+			if got[code] != n {
+				t.Errorf("%s: got %d, want %d (%+v)", code, got[code], n, problems)
+			}
+		}
+	}
+	if g.Kind != KindClassic || g.Cells[0][2].Definitions != nil {
+		t.Fatalf("expected a repaired classic grid, got kind %q and %+v", g.Kind, g.Cells[0][2])
+	}
+	if h := g.Clues.Horizontal; len(h) != 3 || len(h[2].Texts) != 2 || h[2].Texts[1] != "en trop" {
+		t.Fatalf("expected row 3 clues merged, got %+v", h)
+	}
+
+	// Numbered clues are dropped from arrow-word grids.
+	arrow := newTestGrid(2, 2)
+	arrow.Clues = &NumberedClues{Horizontal: []NumberedClue{{Number: 1, Texts: []string{"Perdue"}}}}
+	arrow.Validate()
+	if arrow.Clues != nil {
+		t.Fatal("expected clues dropped from an arrow-word grid")
+	}
+}
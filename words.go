@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Word is an entry of the grid: a run of letter cells read in one
+// direction, with the definition that describes it, if any.
+type Word struct {
+	Start      Position        `json:"start"`
+	Direction  string          `json:"direction"` // "right" or "down"
+	Length     int             `json:"length"`
+	Cells      []Position      `json:"cells"`
+	Definition *WordDefinition `json:"definition,omitempty"`
+}
+
+// WordDefinition locates the definition of a word: a definition cell in
+// arrow-word grids, a row or column number in classic grids.
+type WordDefinition struct {
+	Cell   *Position `json:"cell,omitempty"`   // definition cell
+	Number int       `json:"number,omitempty"` // row (right) or column (down), from 1
+	Index  int       `json:"index"`            // in the cell's Definitions or the number's clue texts
+	Text   string    `json:"text"`
+}
+
+// Words returns the entries of the grid, in reading order of their first
+// letter, across before down. Following the mots fléchés convention, each
+// definition starts its word in an adjacent cell: the one its arrow points
+// to, or for bent arrows the one it leaves from (see Definition).
+// Runs of two letters or more that no definition describes are listed
+// without one. In classic grids, the k-th word of a row or column gets the
+// k-th clue of its number.
+func (g *Grid) Words() []Word {
+	var words []Word
+	described := make(map[Position]map[string]bool)
+	for i, row := range g.Cells {
+		for j, cell := range row {
+			if !cell.Black {
+				continue
+			}
+			for k, def := range cell.Definitions {
+				cells := g.wordCells(i, j, def)
+				if len(cells) == 0 {
+					continue
+				}
+				words = append(words, Word{
+					Start:      cells[0],
+					Direction:  def.Direction,
+					Length:     len(cells),
+					Cells:      cells,
+					Definition: &WordDefinition{Cell: &Position{Row: i, Col: j}, Index: k, Text: def.Text},
+				})
+				if described[cells[0]] == nil {
+					described[cells[0]] = make(map[string]bool)
+				}
+				described[cells[0]][def.Direction] = true
+			}
+		}
+	}
+
+	for i := range g.Rows {
+		for j := range g.Cols {
+			if g.Cells[i][j].Black {
+				continue
+			}
+			start := Position{Row: i, Col: j}
+			for _, dir := range []string{"right", "down"} {
+				di, dj := directionStep(dir)
+				if described[start][dir] || !g.isBlack(i-di, j-dj) {
+					continue
+				}
+				// The run starts here: (i, j) follows a definition cell or the edge.
+				if cells := g.run(i, j, di, dj); len(cells) >= 2 {
+					words = append(words, Word{Start: start, Direction: dir, Length: len(cells), Cells: cells})
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(words, func(a, b Word) int {
+		return cmp.Or(
+			cmp.Compare(a.Start.Row, b.Start.Row),
+			cmp.Compare(a.Start.Col, b.Start.Col),
+			cmp.Compare(directionOrder(a.Direction), directionOrder(b.Direction)),
+		)
+	})
+	if g.Classic() && g.Clues != nil {
+		g.attachNumberedClues(words)
+	}
+	return words
+}
+
+// attachNumberedClues gives the words of a classic grid, sorted in reading
+// order, the clues of their row or column.
+func (g *Grid) attachNumberedClues(words []Word) {
+	texts := map[string]map[int][]string{
+		"right": numberedTexts(g.Clues.Horizontal),
+		"down":  numberedTexts(g.Clues.Vertical),
+	}
+	seen := make(map[string]map[int]int)
+	for i := range words {
+		w := &words[i]
+		number := w.Start.Row + 1
+		if w.Direction == "down" {
+			number = w.Start.Col + 1
+		}
+		if seen[w.Direction] == nil {
+			seen[w.Direction] = make(map[int]int)
+		}
+		k := seen[w.Direction][number]
+		seen[w.Direction][number]++
+		if list := texts[w.Direction][number]; k < len(list) {
+			w.Definition = &WordDefinition{Number: number, Index: k, Text: list[k]}
+		}
+	}
+}
+
+func numberedTexts(clues []NumberedClue) map[int][]string {
+	m := make(map[int][]string, len(clues))
+	for _, c := range clues {
+		m[c.Number] = append(m[c.Number], c.Texts...)
+	}
+	return m
+}
+
+// wordCells returns the letter cells of the word described by def in the
+// definition cell (row, col): it starts next to the definition on the
+// def.StartSide() side and runs in def.Direction until the next definition
+// cell or the edge of the grid.
+func (g *Grid) wordCells(row, col int, def Definition) []Position {
+	si, sj := directionStep(def.StartSide())
+	di, dj := directionStep(def.Direction)
+	if si == 0 && sj == 0 || di == 0 && dj == 0 {
+		return nil
+	}
+	return g.run(row+si, col+sj, di, dj)
+}
+
+// run returns the letter cells from (row, col) on, stepping by (di, dj)
+// until a definition cell or the edge of the grid.
+func (g *Grid) run(row, col, di, dj int) []Position {
+	var cells []Position
+	for i, j := row, col; !g.isBlack(i, j); i, j = i+di, j+dj {
+		cells = append(cells, Position{Row: i, Col: j})
+	}
+	return cells
+}
+
+// isBlack reports whether (row, col) is a definition cell or outside the grid.
+func (g *Grid) isBlack(row, col int) bool {
+	if row < 0 || row >= len(g.Cells) || col < 0 || col >= len(g.Cells[row]) {
+		return true
+	}
+	return g.Cells[row][col].Black
+}
+
+// directionStep returns the row and column increments of a direction, or
+// zeros for an unknown one.
+func directionStep(direction string) (di, dj int) {
+	switch direction {
+	case "right":
+		return 0, 1
+	case "down":
+		return 1, 0
+	}
+	return 0, 0
+}
+
+func directionOrder(direction string) int {
+	if direction == "right" {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	words := loadFixtureGrid(t).Words()
+
+	type entry struct {
+		start Position
+		dir   string
+		text  string
+	}
+	want := []entry{
+		{Position{1, 1}, "right", "Rongeur"},
+		{Position{1, 1}, "down", "Tondu de près"},
+		{Position{1, 2}, "down", "Siège de l'esprit"},
+		{Position{1, 3}, "down", "Mouvement nerveux"},
+		{Position{2, 1}, "right", "Copain"},
+		{Position{3, 1}, "right", "Pas mouillé"},
+	}
+	if len(words) != len(want) {
+		t.Fatalf("expected %d words, got %d: %+v", len(want), len(words), words)
+	}
+	for i, w := range want {
+		got := words[i]
+		if got.Start != w.start || got.Direction != w.dir || got.Definition == nil || got.Definition.Text != w.text || got.Length != 3 {
+			t.Errorf("word %d = %+v, want %+v", i, got, w)
+		}
+	}
+	if def := words[2].Definition; *def.Cell != (Position{0, 2}) || def.Index != 0 {
+		t.Errorf("unexpected definition location: %+v", def)
+	}
+	if want := []Position{{1, 2}, {2, 2}, {3, 2}}; !reflect.DeepEqual(words[2].Cells, want) {
+		t.Errorf("cells = %v, want %v", words[2].Cells, want)
+	}
+}
+
+func TestWordsWithoutDefinition(t *testing.T) {
+	//  #  A  B     (0,0): "Un" right, "Court" down (no room: dropped)
+	//  #  #  C     (1,1): "Seul" down, a one-letter word
+	//  D  E  F
+	g := newTestGrid(3, 3)
+	g.Cells[0][0] = Cell{Black: true, Definitions: []Definition{{Text: "Un", Direction: "right"}, {Text: "Court", Direction: "down"}}}
+	g.Cells[1][0].Black = true
+	g.Cells[1][1] = Cell{Black: true, Definitions: []Definition{{Text: "Seul", Direction: "down"}}}
+
+	var got []string
+	for _, w := range g.Words() {
+		label := fmt.Sprintf("%d,%d %s %d", w.Start.Row, w.Start.Col, w.Direction, w.Length)
+		if w.Definition != nil {
+			label += " " + w.Definition.Text
+		}
+		got = append(got, label)
+	}
+	want := []string{
+		"0,1 right 2 Un",
+		"0,2 down 3",  // B-C-F, no definition
+		"2,0 right 3", // D-E-F from the edge, no definition
+		"2,1 down 1 Seul",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("words = %q, want %q", got, want)
+	}
+}
+
+func TestGridWordsEndpoint(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/words", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var words []Word
+	json.NewDecoder(w.Body).Decode(&words)
+	if len(words) == 0 || words[0].Definition == nil || words[0].Definition.Text != "Test" {
+		t.Fatalf("unexpected words: %+v", words)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/grids/"+grid.ID+"/words?version=9", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown version: expected 404, got %d", w.Code)
+	}
+
+	game, _ := srv.store.CreateGame(grid.ID)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/games/"+game.ID, nil))
+	var resp struct {
+		Words []Word `json:"words"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if !reflect.DeepEqual(resp.Words, words) {
+		t.Fatal("the game should come with the words of its grid")
+	}
+}
+
+func TestWordsBentArrows(t *testing.T) {
+	//  .  .  .  .
+	//  .  #  .  .     (1,1): ↳ "Coudé droite" starts at (2,1), runs right
+	//  .  .  .  .            ↴ "Coudé bas" starts at (1,2), runs down
+	//  .  .  .  .
+	g := newTestGrid(4, 4)
+	g.Cells[1][1] = Cell{Black: true, Definitions: []Definition{
+		{Text: "Coudé droite", Direction: "right", Start: "down"},
+		{Text: "Coudé bas", Direction: "down", Start: "right"},
+	}}
+
+	described := make(map[string]Word)
+	for _, w := range g.Words() {
+		if w.Definition != nil {
+			described[w.Definition.Text] = w
+		}
+	}
+
+	right := described["Coudé droite"]
+	if want := []Position{{2, 1}, {2, 2}, {2, 3}}; !reflect.DeepEqual(right.Cells, want) || right.Direction != "right" {
+		t.Errorf("↳ word = %+v, want cells %v", right, want)
+	}
+	down := described["Coudé bas"]
+	if want := []Position{{1, 2}, {2, 2}, {3, 2}}; !reflect.DeepEqual(down.Cells, want) || down.Direction != "down" {
+		t.Errorf("↴ word = %+v, want cells %v", down, want)
+	}
+}
+
+// classicTestGrid returns a mots croisés grid with one clue per word:
+//
+//	     1  2  3  4  5
+//	I    A  B  #  C  D
+//	II   E  F  G  H  I
+//	III  J  #  K  L  #
+func classicTestGrid() *Grid {
+	g := newTestGrid(3, 5)
+	g.Kind = KindClassic
+	for _, p := range []Position{{0, 2}, {2, 1}, {2, 4}} {
+		g.Cells[p.Row][p.Col].Black = true
+	}
+	g.Clues = &NumberedClues{
+		Horizontal: []NumberedClue{
+			{Number: 1, Texts: []string{"h1a", "h1b"}},
+			{Number: 2, Texts: []string{"h2"}},
+			{Number: 3, Texts: []string{"h3"}},
+		},
+		Vertical: []NumberedClue{
+			{Number: 1, Texts: []string{"v1"}},
+			{Number: 2, Texts: []string{"v2"}},
+			{Number: 3, Texts: []string{"v3"}},
+			{Number: 4, Texts: []string{"v4"}},
+			{Number: 5, Texts: []string{"v5"}},
+		},
+	}
+	return g
+}
+
+func TestWordsClassic(t *testing.T) {
+	var got []string
+	for _, w := range classicTestGrid().Words() {
+		label := fmt.Sprintf("%d,%d %s %d", w.Start.Row, w.Start.Col, w.Direction, w.Length)
+		if d := w.Definition; d != nil {
+			if d.Cell != nil {
+				t.Errorf("classic word %s has a definition cell", label)
+			}
+			label += fmt.Sprintf(" %d/%d %s", d.Number, d.Index, d.Text)
+		}
+		got = append(got, label)
+	}
+	want := []string{
+		"0,0 right 2 1/0 h1a",
+		"0,0 down 3 1/0 v1",
+		"0,1 down 2 2/0 v2",
+		"0,3 right 2 1/1 h1b",
+		"0,3 down 3 4/0 v4",
+		"0,4 down 2 5/0 v5",
+		"1,0 right 5 2/0 h2",
+		"1,2 down 2 3/0 v3",
+		"2,2 right 2 3/0 h3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("words:\n got %q\nwant %q", got, want)
+	}
+}
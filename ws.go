@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 2 * sseHeartbeat
+	wsMaxMessage   = 1 << 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The default CheckOrigin only accepts same-host origins.
+}
+
+// wsInbound is a message sent by a WebSocket client.
+type wsInbound struct {
+	Type  string `json:"type"` // "move", "undo" or "redo"
+	Row   int    `json:"row"`
+	Col   int    `json:"col"`
+	Value string `json:"value"`
+}
+
+// wsOutbound wraps a broadcast event with its ID, so that clients can
+// reconnect with ?last_event_id= exactly like with SSE.
+type wsOutbound struct {
+	ID    string          `json:"id,omitempty"`
+	Event json.RawMessage `json:"event"`
+}
+
+// GET /api/games/{id}/ws — bidirectional alternative to /move + /events.
+//
+// Outbound frames carry the same events as the SSE stream, taken from the
+// same Broadcaster. Inbound frames are moves, validated like POST /move,
+// and undo/redo requests; errors are sent back only to the sender as
+// {"event":{"type":"error",...}}.
+func (s *Server) handleGameWS(w http.ResponseWriter, r *http.Request) {
+	game := s.store.GetGame(r.PathValue("id"))
+	if game == nil {
+		jsonError(w, "Partie introuvable", http.StatusNotFound)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an HTTP error.
+		return
+	}
+	defer conn.Close()
+
+	pseudo := sanitizePseudo(r.URL.Query().Get("pseudo"))
+	s.playerConnected(game, pseudo)
+
+	c, missed, resumed := s.sse.Resume(game.ID, r.URL.Query().Get("last_event_id"))
+	defer func() {
+		s.sse.Unregister(c)
+		s.playerDisconnected(game, pseudo)
+	}()
+
+	// Missed events (or the snapshot) go out first, in order.
+	var initial []wsOutbound
+	if resumed {
+		for _, evt := range missed {
+			initial = append(initial, s.wsEvent(evt))
+		}
+	} else {
+		initial = append(initial, s.wsEvent(event{Seq: c.start, Data: s.gameSnapshot(game)}))
+	}
+
+	// Replies to this client only; the writer goroutine owns the connection.
+	replies := make(chan wsOutbound, sseChannelBuffer)
+	done := make(chan struct{})
+	go s.wsWriter(conn, c, initial, replies, done)
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var msg wsInbound
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			break
+		}
+
+		if apiErr := s.handleWSMessage(r, game, pseudo, msg); apiErr != nil {
+			reply, _ := json.Marshal(map[string]any{
+				"type":   "error",
+				"error":  apiErr.msg,
+				"status": apiErr.status,
+			})
+			select {
+			case replies <- wsOutbound{Event: reply}:
+			case <-done:
+			}
+		}
+	}
+	close(replies)
+	<-done
+}
+
+func (s *Server) handleWSMessage(r *http.Request, game *GameSession, pseudo string, msg wsInbound) *apiError {
+	if !s.moveRL.allow(r.RemoteAddr) {
+		return &apiError{http.StatusTooManyRequests, "Trop de requêtes, réessayez plus tard"}
+	}
+
+	switch msg.Type {
+	case "move":
+		return s.playMove(game, pseudo, msg.Row, msg.Col, msg.Value)
+	case "undo", "redo":
+		if pseudo == "" {
+			return &apiError{http.StatusBadRequest, "Paramètre 'pseudo' requis"}
+		}
+		apply := (*GameSession).Undo
+		if msg.Type == "redo" {
+			apply = (*GameSession).Redo
+		}
+		_, err := s.playUndoRedo(game, pseudo, apply)
+		return err
+	default:
+		return &apiError{http.StatusBadRequest, "Type de message inconnu"}
+	}
+}
+
+func (s *Server) wsEvent(evt event) wsOutbound {
+	return wsOutbound{ID: s.sse.eventID(evt.Seq), Event: json.RawMessage(evt.Data)}
+}
+
+// wsWriter sends the initial frames, then forwards broadcast events and
+// direct replies to the connection, with periodic pings. It returns when
+// replies is closed, when the broadcaster drops the client, or on a write
+// error.
+func (s *Server) wsWriter(conn *websocket.Conn, c *client, initial []wsOutbound, replies <-chan wsOutbound, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+
+	write := func(v wsOutbound) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(v) == nil
+	}
+
+	for _, out := range initial {
+		if !write(out) {
+			conn.Close()
+			return
+		}
+	}
+
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return
+			}
+			if !write(reply) {
+				conn.Close()
+				return
+			}
+		case evt, ok := <-c.ch:
+			if !ok {
+				// Too slow: close so that the client resumes from its last ID.
+				conn.Close()
+				return
+			}
+			if !write(s.wsEvent(evt)) {
+				conn.Close()
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
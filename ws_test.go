@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsFrame struct {
+	ID    string `json:"id"`
+	Event struct {
+		Type   string `json:"type"`
+		Row    int    `json:"row"`
+		Col    int    `json:"col"`
+		Value  string `json:"value"`
+		Pseudo string `json:"pseudo"`
+		Error  string `json:"error"`
+	} `json:"event"`
+}
+
+func dialGameWS(t *testing.T, ts *httptest.Server, gameID, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/games/" + gameID + "/ws?" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFrame reads frames until one of the wanted type arrives.
+func readFrame(t *testing.T, conn *websocket.Conn, wantType string) wsFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var f wsFrame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatalf("waiting for %s: %v", wantType, err)
+		}
+		if f.Event.Type == wantType {
+			return f
+		}
+	}
+}
+
+func TestGameWebSocket(t *testing.T) {
+	srv := newTestServer()
+	grid := seedGrid(srv)
+	game, _ := srv.store.CreateGame(grid.ID)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	alice := dialGameWS(t, ts, game.ID, "pseudo=Alice")
+	readFrame(t, alice, "game_state")
+
+	alice.WriteJSON(map[string]any{"type": "move", "row": 0, "col": 1, "value": "a"})
+	f := readFrame(t, alice, "cell_update")
+	if f.ID == "" || f.Event.Value != "A" || f.Event.Pseudo != "Alice" {
+		t.Fatalf("unexpected cell_update: %+v", f)
+	}
+	if game.GetState()[0][1] != "A" {
+		t.Fatal("move over WebSocket should update the game")
+	}
+
+	// Validation errors are only sent back to the sender.
+	alice.WriteJSON(map[string]any{"type": "move", "row": 0, "col": 0, "value": "B"})
+	if f := readFrame(t, alice, "error"); f.Event.Error != "Case de définition" {
+		t.Fatalf("unexpected error frame: %+v", f)
+	}
+
+	// Moves posted over HTTP reach WebSocket clients through the same fan-out.
+	body := `{"pseudo":"Bob","row":2,"col":2,"value":"C"}`
+	req := httptest.NewRequest("POST", "/api/games/"+game.ID+"/move", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("http move: expected 204, got %d", w.Code)
+	}
+	f = readFrame(t, alice, "cell_update")
+	if f.Event.Pseudo != "Bob" {
+		t.Fatalf("expected Bob's move, got %+v", f)
+	}
+
+	alice.WriteJSON(map[string]any{"type": "undo"})
+	f = readFrame(t, alice, "cell_update")
+	if f.Event.Row != 0 || f.Event.Col != 1 || f.Event.Value != "" {
+		t.Fatalf("unexpected undo update: %+v", f)
+	}
+	lastID := f.ID
+
+	// A client resuming from an event ID gets what it missed, not a snapshot.
+	srv.playMove(game, "Bob", 1, 1, "D")
+	resumed := dialGameWS(t, ts, game.ID, "last_event_id="+lastID)
+	resumed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var first wsFrame
+	if err := resumed.ReadJSON(&first); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if first.Event.Type != "cell_update" || first.Event.Value != "D" {
+		t.Fatalf("expected replayed cell_update, got %+v", first)
+	}
+}
+
+func TestGameWebSocketUnknownGame(t *testing.T) {
+	srv := newTestServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/games/nope/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected dial to fail for an unknown game")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %v", resp)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// XD (https://github.com/century-arcade/xd) is a plain-text crossword
+// format: metadata lines ("Title: ..."), the grid with one line per row
+// ('#' for blocks, letters of the solution elsewhere), then clues written
+// "A1. Clue ~ ANSWER" or "D1. Clue ~ ANSWER". Sections are separated by
+// blank lines or "## Section" headers; we recognize lines by their shape
+// instead.
+
+var (
+	xdGridRow = regexp.MustCompile(`^[A-Za-z0-9#_.]+$`)
+	xdClue    = regexp.MustCompile(`^([AD])(\d+)\.\s*(.*?)(?:\s+~\s+\S.*)?$`)
+)
+
+func parseXD(text string) (*numberedPuzzle, error) {
+	var rows []string
+	var clues []numberedClue
+	gridDone := false
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if m := xdClue.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			dir := "right"
+			if m[1] == "D" {
+				dir = "down"
+			}
+			clues = append(clues, numberedClue{Direction: dir, Number: n, Text: m[3]})
+			continue
+		}
+		// The grid is the first run of rows of the same width.
+		if gridDone {
+			continue
+		}
+		isRow := xdGridRow.MatchString(line)
+		switch {
+		case isRow && (len(rows) == 0 || len(line) == len(rows[0])):
+			rows = append(rows, line)
+		case len(rows) > 1:
+			gridDone = true
+		case isRow:
+			rows = []string{line}
+		default:
+			rows = nil
+		}
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("XD file has no grid")
+	}
+	if len(clues) == 0 {
+		return nil, fmt.Errorf("XD file has no clues")
+	}
+
+	p := &numberedPuzzle{Rows: len(rows), Cols: len(rows[0]), Clues: clues}
+	if err := checkImportSize(p.Rows, p.Cols); err != nil {
+		return nil, err
+	}
+	p.Black = make([][]bool, p.Rows)
+	p.Solution = make([][]string, p.Rows)
+	for i, row := range rows {
+		p.Black[i] = make([]bool, p.Cols)
+		p.Solution[i] = make([]string, p.Cols)
+		for j, c := range []byte(row) {
+			switch {
+			case c == '#' || c == '_':
+				p.Black[i][j] = true
+			case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+				p.Solution[i][j] = strings.ToUpper(string(c))
+			}
+			// Other characters ('.', rebus keys) are letters we don't know.
+		}
+	}
+	return p, nil
+}